@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/internal/configuration"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/simulator"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/supervisor"
+)
+
+const (
+	//simulatorInternal runs the simulator inside elevctl
+	simulatorInternal = "internal"
+	//simulatorExternal runs SimElevatorServer as a separate process
+	simulatorExternal = "external"
+	//simulatorNone expects the elevator servers to be running already
+	simulatorNone = "none"
+)
+
+//clusterConfig is the content of the elevctl configuration file
+type clusterConfig struct {
+	//Binary is the path to the elevator node binary
+	Binary string `toml:"binary"`
+	//Simulator is one of internal, external or none
+	Simulator string `toml:"simulator"`
+	//SimulatorBinary is the path to SimElevatorServer, used by the external simulator
+	SimulatorBinary string `toml:"simulator_binary"`
+	//TravelTime is the time between floors in the internal simulator
+	TravelTime configuration.Duration `toml:"travel_time"`
+	Floors     int                    `toml:"floors"`
+	BasePort   int                    `toml:"base_port"`
+	//ControlAddress is used by elevctl commands to control a running cluster
+	ControlAddress string `toml:"control_address"`
+	//Dir is the folder used to store order files
+	Dir   string       `toml:"dir"`
+	Nodes []nodeConfig `toml:"node"`
+}
+
+//nodeConfig contains the configuration of a single node
+type nodeConfig struct {
+	ID           int      `toml:"id"`
+	ElevatorPort int      `toml:"elevator_port"`
+	Args         []string `toml:"args"`
+}
+
+//readClusterConfig reads and validates the configuration file
+func readClusterConfig(path string) (clusterConfig, error) {
+	conf := clusterConfig{
+		Binary:          "./main",
+		Simulator:       simulatorInternal,
+		SimulatorBinary: "./SimElevatorServer",
+		TravelTime:      configuration.Duration{Duration: 2 * time.Second},
+		Floors:          4,
+		BasePort:        2000,
+		ControlAddress:  defaultControlAddress,
+		Dir:             ".",
+	}
+	if _, err := toml.DecodeFile(path, &conf); err != nil {
+		return conf, err
+	}
+
+	switch conf.Simulator {
+	case simulatorInternal, simulatorExternal, simulatorNone:
+	default:
+		return conf, fmt.Errorf("simulator must be %s, %s or %s, got %q", simulatorInternal, simulatorExternal, simulatorNone, conf.Simulator)
+	}
+	if conf.Floors < 2 {
+		return conf, errors.New("floors must be at least 2")
+	}
+	if len(conf.Nodes) == 0 {
+		return conf, errors.New("no nodes configured")
+	}
+	ids := make(map[int]struct{})
+	ports := make(map[int]struct{})
+	for _, n := range conf.Nodes {
+		if _, ok := ids[n.ID]; ok || n.ID < 0 {
+			return conf, fmt.Errorf("node id %d is invalid or used more than once", n.ID)
+		}
+		if _, ok := ports[n.ElevatorPort]; ok || n.ElevatorPort <= 0 {
+			return conf, fmt.Errorf("elevator port %d of node %d is invalid or used more than once", n.ElevatorPort, n.ID)
+		}
+		ids[n.ID] = struct{}{}
+		ports[n.ElevatorPort] = struct{}{}
+	}
+	return conf, nil
+}
+
+//node is a running elevator node with its simulator
+type node struct {
+	conf nodeConfig
+	//cancel stops the node process, nil if the node is stopped
+	cancel func()
+	//done is closed when the node supervisor has exited
+	done      chan struct{}
+	simulator *simulator.Simulator
+}
+
+//cluster manages all nodes and simulators
+type cluster struct {
+	conf   clusterConfig
+	mtx    sync.Mutex
+	nodes  map[int]*node
+	output *prefixedOutput
+	logger *logging.Logger
+}
+
+//newCluster creates a cluster without starting any nodes
+func newCluster(conf clusterConfig, logger *logging.Logger) *cluster {
+	c := &cluster{
+		conf:   conf,
+		nodes:  make(map[int]*node),
+		output: &prefixedOutput{w: os.Stdout},
+		logger: logger,
+	}
+	for _, n := range conf.Nodes {
+		c.nodes[n.ID] = &node{conf: n}
+	}
+	return c
+}
+
+//run starts all simulators and nodes, and blocks until the context is done
+func (c *cluster) run(ctx context.Context) error {
+	if err := os.MkdirAll(c.conf.Dir, 0755); err != nil {
+		return err
+	}
+	for _, id := range c.ids() {
+		n := c.nodes[id]
+		switch c.conf.Simulator {
+		case simulatorInternal:
+			n.simulator = simulator.New(simulator.Config{
+				Address:    fmt.Sprintf("localhost:%d", n.conf.ElevatorPort),
+				NumFloors:  c.conf.Floors,
+				TravelTime: c.conf.TravelTime.Duration,
+				Logger:     c.logger.Component("simulator").With("node", id),
+			})
+			sim := n.simulator
+			go supervisor.Run(ctx, supervisor.DefaultConfig(c.logger), fmt.Sprintf("simulator %d", id), sim.Run)
+		case simulatorExternal:
+			args := []string{fmt.Sprintf("--port=%d", n.conf.ElevatorPort), fmt.Sprintf("--numfloors=%d", c.conf.Floors)}
+			prefix := fmt.Sprintf("[sim %d] ", id)
+			go supervisor.Run(ctx, supervisor.DefaultConfig(c.logger), fmt.Sprintf("simulator %d", id), func(ctx context.Context) error {
+				return c.runProcess(ctx, prefix, c.conf.SimulatorBinary, args...)
+			})
+		}
+	}
+
+	//Give the simulators some time to start listening
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	for _, id := range c.ids() {
+		if err := c.start(ctx, id); err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+
+	//Wait for all nodes to stop
+	for _, id := range c.ids() {
+		c.stop(id)
+	}
+	return nil
+}
+
+//ids returns the sorted node ids
+func (c *cluster) ids() []int {
+	ids := make([]int, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+//start starts a stopped node. The node is restarted if it crashes.
+func (c *cluster) start(ctx context.Context, id int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return fmt.Errorf("unknown node %d", id)
+	}
+	if n.cancel != nil {
+		return fmt.Errorf("node %d is already running", id)
+	}
+
+	args := []string{
+		"--id=" + strconv.Itoa(id),
+		fmt.Sprintf("--elevator-port=%d", n.conf.ElevatorPort),
+		fmt.Sprintf("--floors=%d", c.conf.Floors),
+		fmt.Sprintf("--baseport=%d", c.conf.BasePort),
+		"--folder=" + filepath.Join(c.conf.Dir, fmt.Sprintf("orders%d.json", id)),
+	}
+	args = append(args, n.conf.Args...)
+	prefix := fmt.Sprintf("[node %d] ", id)
+
+	nodeCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	n.cancel = cancel
+	n.done = done
+	go func() {
+		defer close(done)
+		supervisor.Run(nodeCtx, supervisor.DefaultConfig(c.logger), fmt.Sprintf("node %d", id), func(ctx context.Context) error {
+			return c.runProcess(ctx, prefix, c.conf.Binary, args...)
+		})
+	}()
+	c.logger.Infof("Started node %d", id)
+	return nil
+}
+
+//stop kills a running node and waits for it to exit
+func (c *cluster) stop(id int) error {
+	c.mtx.Lock()
+	n, ok := c.nodes[id]
+	if !ok {
+		c.mtx.Unlock()
+		return fmt.Errorf("unknown node %d", id)
+	}
+	if n.cancel == nil {
+		c.mtx.Unlock()
+		return fmt.Errorf("node %d is not running", id)
+	}
+	n.cancel()
+	n.cancel = nil
+	done := n.done
+	c.mtx.Unlock()
+
+	<-done
+	c.logger.Infof("Stopped node %d", id)
+	return nil
+}
+
+//restart kills a node if it is running and starts it again
+func (c *cluster) restart(ctx context.Context, id int) error {
+	//Not running is fine - the node is started anyway
+	c.stop(id)
+	return c.start(ctx, id)
+}
+
+//status returns a human readable status line for each node
+func (c *cluster) status() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	lines := []string{}
+	for _, id := range c.ids() {
+		n := c.nodes[id]
+		state := "stopped"
+		if n.cancel != nil {
+			state = "running"
+		}
+		line := fmt.Sprintf("node %d: %s (elevator port %d)", id, state, n.conf.ElevatorPort)
+		if n.simulator != nil {
+			s := n.simulator.Status()
+			line += fmt.Sprintf(", position %.2f, motor %d, door open %t", s.Position, s.MotorDirection, s.DoorOpen)
+			if s.Load > 0 {
+				line += fmt.Sprintf(", load %d%%", s.Load)
+			}
+			if s.StopLamp {
+				line += ", stop lamp on"
+			}
+			for floor, car := range s.Keypads {
+				if car != simulator.NoCar {
+					line += fmt.Sprintf(", keypad %d shows car %d", floor, car)
+				}
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+//press simulates a button press on the internal simulator of a node
+func (c *cluster) press(id int, floor int, button simulator.ButtonType) error {
+	c.mtx.Lock()
+	n, ok := c.nodes[id]
+	c.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown node %d", id)
+	}
+	if n.simulator == nil {
+		return errors.New("button presses require the internal simulator")
+	}
+	return n.simulator.PressButton(floor, button)
+}
+
+//call simulates a destination call entered at a keypad on the internal simulator of a node
+func (c *cluster) call(id int, origin int, destination int) error {
+	c.mtx.Lock()
+	n, ok := c.nodes[id]
+	c.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown node %d", id)
+	}
+	if n.simulator == nil {
+		return errors.New("destination calls require the internal simulator")
+	}
+	return n.simulator.EnterDestination(origin, destination)
+}
+
+//setLoad simulates the load of the car on the internal simulator of a node
+func (c *cluster) setLoad(id int, load int) error {
+	c.mtx.Lock()
+	n, ok := c.nodes[id]
+	c.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown node %d", id)
+	}
+	if n.simulator == nil {
+		return errors.New("the load requires the internal simulator")
+	}
+	return n.simulator.SetLoad(load)
+}
+
+//presentCard simulates a card presented at the card reader of the car on the internal simulator of a node
+func (c *cluster) presentCard(id int, card int) error {
+	c.mtx.Lock()
+	n, ok := c.nodes[id]
+	c.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown node %d", id)
+	}
+	if n.simulator == nil {
+		return errors.New("the card reader requires the internal simulator")
+	}
+	return n.simulator.PresentCard(card)
+}
+
+//runProcess runs a process until it exits or the context is done.
+//Output is written to stdout with a prefix on every line.
+func (c *cluster) runProcess(ctx context.Context, prefix string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go c.output.copyLines(&wg, prefix, stdout)
+	go c.output.copyLines(&wg, prefix, stderr)
+	//All output must be read before calling Wait
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s exited: %s", name, err)
+	}
+	return nil
+}
+
+//prefixedOutput multiplexes lines from several processes
+type prefixedOutput struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+//copyLines copies every line from r to the output with a prefix
+func (o *prefixedOutput) copyLines(wg *sync.WaitGroup, prefix string, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		o.mtx.Lock()
+		fmt.Fprintf(o.w, "%s%s\n", prefix, scanner.Text())
+		o.mtx.Unlock()
+	}
+}
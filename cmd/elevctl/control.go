@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/simulator"
+)
+
+//defaultControlAddress is used if no control address is configured
+const defaultControlAddress = "localhost:7070"
+
+//controlTimeout is the maximum time used to handle a control command
+const controlTimeout = 10 * time.Second
+
+//runControlServer accepts control commands, one command per connection.
+//Returns an error if the listener fails.
+func runControlServer(ctx context.Context, address string, c *cluster) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go handleControlConn(ctx, conn, c)
+	}
+}
+
+//handleControlConn reads a single command and writes the result
+func handleControlConn(ctx context.Context, conn net.Conn, c *cluster) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(conn, "error: %s\n", err)
+		return
+	}
+	args := strings.Fields(line)
+	c.logger.Infof("Control command %q", strings.Join(args, " "))
+	result, err := executeCommand(ctx, c, args)
+	if err != nil {
+		fmt.Fprintf(conn, "error: %s\n", err)
+		return
+	}
+	for _, l := range result {
+		fmt.Fprintln(conn, l)
+	}
+}
+
+//executeCommand executes a control command on the cluster
+func executeCommand(ctx context.Context, c *cluster, args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing command")
+	}
+	switch args[0] {
+	case "status":
+		return c.status(), nil
+	case "kill", "start", "restart":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: %s <node id>", args[0])
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+		switch args[0] {
+		case "kill":
+			err = c.stop(id)
+		case "start":
+			err = c.start(ctx, id)
+		case "restart":
+			err = c.restart(ctx, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []string{fmt.Sprintf("%s node %d: ok", args[0], id)}, nil
+	case "press":
+		if len(args) != 4 {
+			return nil, fmt.Errorf("usage: press <node id> <floor> <up|down|cab>")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+		floor, err := strconv.Atoi(args[2])
+		if err != nil {
+			return nil, err
+		}
+		button, err := parseButton(args[3])
+		if err != nil {
+			return nil, err
+		}
+		if err := c.press(id, floor, button); err != nil {
+			return nil, err
+		}
+		return []string{"ok"}, nil
+	case "call":
+		if len(args) != 4 {
+			return nil, fmt.Errorf("usage: call <node id> <origin floor> <destination floor>")
+		}
+		floors := make([]int, 3)
+		for i := range floors {
+			var err error
+			if floors[i], err = strconv.Atoi(args[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.call(floors[0], floors[1], floors[2]); err != nil {
+			return nil, err
+		}
+		return []string{"ok"}, nil
+	case "load":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("usage: load <node id> <percent>")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+		load, err := strconv.Atoi(strings.TrimSuffix(args[2], "%"))
+		if err != nil {
+			return nil, err
+		}
+		if err := c.setLoad(id, load); err != nil {
+			return nil, err
+		}
+		return []string{"ok"}, nil
+	case "card":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("usage: card <node id> <card>")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+		card, err := strconv.Atoi(args[2])
+		if err != nil {
+			return nil, err
+		}
+		if err := c.presentCard(id, card); err != nil {
+			return nil, err
+		}
+		return []string{"ok"}, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+//parseButton returns the button type with the given name
+func parseButton(s string) (simulator.ButtonType, error) {
+	switch s {
+	case "up":
+		return simulator.HallUp, nil
+	case "down":
+		return simulator.HallDown, nil
+	case "cab":
+		return simulator.Cab, nil
+	}
+	return 0, fmt.Errorf("unknown button %q", s)
+}
+
+//sendControlCommand sends a command to a running elevctl and returns the reply
+func sendControlCommand(address string, args []string) (string, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return "", fmt.Errorf("elevctl is not running at %s: %s", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		return "", err
+	}
+	reply, err := ioutil.ReadAll(conn)
+	return string(reply), err
+}
@@ -0,0 +1,82 @@
+//elevctl launches and controls a cluster of elevator nodes for testing.
+//
+// Usage:
+//
+//	elevctl [-config elevctl.toml] run
+//	elevctl [-config elevctl.toml] status
+//	elevctl [-config elevctl.toml] kill <node id>
+//	elevctl [-config elevctl.toml] start <node id>
+//	elevctl [-config elevctl.toml] restart <node id>
+//	elevctl [-config elevctl.toml] press <node id> <floor> <up|down|cab>
+//	elevctl [-config elevctl.toml] call <node id> <origin floor> <destination floor>
+//	elevctl [-config elevctl.toml] load <node id> <percent>
+//	elevctl [-config elevctl.toml] card <node id> <card>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+func main() {
+	configPath := flag.String("config", "elevctl.toml", "Cluster configuration file")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: elevctl [-config file] <run|status|kill|start|restart|press|call|load|card> [args]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conf, err := readClusterConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration %s: %s\n", *configPath, err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) != "run" {
+		reply, err := sendControlCommand(conf.ControlAddress, flag.Args())
+		fmt.Print(reply)
+		if err != nil || strings.HasPrefix(reply, "error") {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	levels, _ := logging.ParseLevels("info")
+	logger := logging.New(os.Stdout, -1, levels).Component("elevctl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	c := newCluster(conf, logger)
+	go func() {
+		if err := runControlServer(ctx, conf.ControlAddress, c); err != nil {
+			logger.Errorf("Control server failed: %s", err)
+			cancel()
+		}
+	}()
+
+	if err := c.run(ctx); err != nil {
+		logger.Errorf("%s", err)
+		os.Exit(1)
+	}
+}
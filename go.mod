@@ -3,6 +3,7 @@ module github.com/HaavardM/TTK4145-Elevator
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/TTK4145/Network-go v0.0.0-20180219180549-80c76ced719b
 	github.com/TTK4145/driver-go v0.0.0-20180211222240-d63fde1778d1
 	github.com/davecgh/go-spew v1.1.1
@@ -0,0 +1,182 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/internal/scheduler"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+)
+
+//requestTimeout is the maximum time waiting for the scheduler to handle a command
+const requestTimeout = 2 * time.Second
+
+var errSchedulerTimeout = errors.New("the scheduler did not respond")
+
+//Config contains configuration for the admin interface
+type Config struct {
+	//Address is the HTTP address to listen on, e.g. localhost:8080
+	Address string
+	//Requests sends commands to the scheduler
+	Requests chan<- scheduler.AdminRequest
+	//Membership receives the members of the cluster. Optional.
+	Membership <-chan []network.Member
+	Logger     *logging.Logger
+}
+
+//status is the reply to all requests
+type status struct {
+	scheduler.Status
+	Members []network.Member `json:"members,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+//server handles the HTTP requests
+type server struct {
+	conf    Config
+	mtx     sync.Mutex
+	members []network.Member
+}
+
+//Run serves the admin interface until the context is done.
+//Returns an error if the address can not be used.
+func Run(ctx context.Context, conf Config) error {
+	listener, err := net.Listen("tcp", conf.Address)
+	if err != nil {
+		return err
+	}
+	s := &server{conf: conf}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handle(false, func(*http.Request) (interface{}, error) {
+		return nil, nil
+	}))
+	mux.HandleFunc("/independent", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.IndependentServiceCommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	mux.HandleFunc("/fire/recall", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.FireRecallCommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	mux.HandleFunc("/fire/phase2", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.FirePhaseIICommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	mux.HandleFunc("/fire/door", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.FireDoorCommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	mux.HandleFunc("/traffic", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.TrafficModeCommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	mux.HandleFunc("/cancel", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.CancelOrderCommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	mux.HandleFunc("/access", s.handle(true, func(r *http.Request) (interface{}, error) {
+		var cmd scheduler.CredentialCommand
+		return cmd, json.NewDecoder(r.Body).Decode(&cmd)
+	}))
+	httpServer := &http.Server{Handler: mux}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.runMembership(ctx)
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+
+	conf.Logger.Infof("Admin interface listening on %s", listener.Addr())
+	if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+//runMembership keeps the latest membership
+func (s *server) runMembership(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case members := <-s.conf.Membership:
+			s.mtx.Lock()
+			s.members = members
+			s.mtx.Unlock()
+		}
+	}
+}
+
+//handle returns a handler which decodes a command, sends it to the scheduler and replies with the status.
+//Commands must be posted, while the status can also be read with GET.
+func (s *server) handle(post bool, decode func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && (post || r.Method != http.MethodGet) {
+			w.Header().Set("Allow", "POST")
+			s.reply(w, http.StatusMethodNotAllowed, status{Error: "method not allowed"})
+			return
+		}
+		cmd, err := decode(r)
+		if err != nil {
+			s.reply(w, http.StatusBadRequest, status{Error: "invalid command: " + err.Error()})
+			return
+		}
+		result, err := s.request(r.Context(), cmd)
+		if err == errSchedulerTimeout {
+			s.reply(w, http.StatusServiceUnavailable, status{Error: err.Error()})
+			return
+		} else if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		reply := status{Status: result.Status, Members: s.members}
+		s.mtx.Unlock()
+		code := http.StatusOK
+		if result.Err != nil {
+			reply.Error = result.Err.Error()
+			code = http.StatusConflict
+		} else if cmd != nil {
+			s.conf.Logger.Infof("Admin command %s %+v", r.URL.Path, cmd)
+		}
+		s.reply(w, code, reply)
+	}
+}
+
+//request sends a command to the scheduler and waits for the reply
+func (s *server) request(ctx context.Context, cmd interface{}) (scheduler.AdminReply, error) {
+	reply := make(chan scheduler.AdminReply, 1)
+	timeout := time.After(requestTimeout)
+	select {
+	case s.conf.Requests <- scheduler.AdminRequest{Command: cmd, Reply: reply}:
+	case <-timeout:
+		return scheduler.AdminReply{}, errSchedulerTimeout
+	case <-ctx.Done():
+		return scheduler.AdminReply{}, ctx.Err()
+	}
+	select {
+	case result := <-reply:
+		return result, nil
+	case <-timeout:
+		return scheduler.AdminReply{}, errSchedulerTimeout
+	case <-ctx.Done():
+		return scheduler.AdminReply{}, ctx.Err()
+	}
+}
+
+//reply writes the status as JSON
+func (s *server) reply(w http.ResponseWriter, code int, body status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.conf.Logger.Debugf("Failed to write reply: %s", err)
+	}
+}
@@ -1,42 +1,470 @@
 package configuration
 
 import (
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
+
+	"github.com/HaavardM/TTK4145-Elevator/internal/scheduler"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
 )
 
+//EnvPrefix is the prefix of all environment variables used to override configuration values.
+//The variable name is the prefix followed by the section and key in upper case, e.g.
+//ELEVATOR_CONTROLLER_DOOR_OPEN_DURATION=3s
+const EnvPrefix = "ELEVATOR"
+
 //Config type contains system configuration
 type Config struct {
-	ElevatorID   int
-	BasePort     int
-	ElevatorPort int
-	Floors       int
-	FilePath     string
+	ElevatorID   int    `toml:"id"`
+	BasePort     int    `toml:"base_port"`
+	ElevatorPort int    `toml:"elevator_port"`
+	Floors       int    `toml:"floors"`
+	FilePath     string `toml:"order_file"`
+	//LogLevel is parsed into LogLevels
+	LogLevel  string         `toml:"log_level"`
+	LogLevels logging.Levels `toml:"-"`
+	//AdminAddress is the HTTP address of the admin interface, e.g. localhost:8080. Disabled if empty.
+	AdminAddress string `toml:"admin_address"`
+	//DestinationDispatch enables the destination dispatch keypads, which are only supported by the simulator
+	DestinationDispatch bool `toml:"destination_dispatch"`
+	//LoadWeighing enables the load weighing of the car, which is only supported by the simulator
+	LoadWeighing bool `toml:"load_weighing"`
+	//CardReader enables the card reader of the car, which is only supported by the simulator
+	CardReader bool             `toml:"card_reader"`
+	Controller ControllerConfig `toml:"controller"`
+	Scheduler  SchedulerConfig  `toml:"scheduler"`
+	Network    NetworkConfig    `toml:"network"`
+	Fire       FireConfig       `toml:"fire"`
+	//path is the configuration file, used when reloading
+	path string
+}
+
+//ControllerConfig contains configuration for the elevator controller
+type ControllerConfig struct {
+	//DoorOpenDuration is how long the door stays open at a floor
+	DoorOpenDuration Duration `toml:"door_open_duration"`
+	//MotorStallTimeout is the maximum time between floors before the elevator is considered stuck
+	MotorStallTimeout Duration `toml:"motor_stall_timeout"`
+	//BypassLoad is the load in percent of the capacity where the car is full and passes hall orders by
+	BypassLoad int `toml:"bypass_load"`
+	//PassengerLoad is the load of one passenger in percent of the capacity, used to estimate the number of passengers
+	PassengerLoad int `toml:"passenger_load"`
+}
+
+//SchedulerConfig contains configuration for the scheduler
+type SchedulerConfig struct {
+	//OrderTimeout is the time before an order is reassigned
+	OrderTimeout Duration `toml:"order_timeout"`
+	//CabPenalty is added to the cost of cab calls so that hall orders are prioritized at the same floor
+	CabPenalty float64 `toml:"cab_penalty"`
+	//CostFunction is the name of the cost function used to assign orders
+	CostFunction string `toml:"cost_function"`
+	//Parking is the parking policy for idle elevators
+	Parking string `toml:"parking"`
+	//LobbyFloor is the parking floor of the lobby parking policy
+	LobbyFloor int `toml:"lobby_floor"`
+	//ParkingDelay is the time an elevator is idle before it is parked
+	ParkingDelay Duration `toml:"parking_delay"`
+	//TrafficMode is the traffic mode used outside the traffic schedule, or "auto" to detect it from the hall orders
+	TrafficMode string `toml:"traffic_mode"`
+	//TrafficSchedule contains the traffic modes for periods of the day
+	TrafficSchedule []TrafficPeriod `toml:"traffic_schedule"`
+	//ServedFloors are the floors served by the elevator, e.g. for an express car. All floors are served if empty.
+	ServedFloors []int `toml:"served_floors"`
+	//SecuredFloors are the floors only reachable with a credential, and when they are secured
+	SecuredFloors []SecuredFloor `toml:"secured_floors"`
+	//AuthorizedCards are the cards accepted as credentials. All cards are accepted if empty.
+	AuthorizedCards []int `toml:"authorized_cards"`
+	//AccessWindow is the time a credential gives access to the secured floors
+	AccessWindow Duration `toml:"access_window"`
+	//NuisanceStops is the number of stops in a row for cab calls without passengers entering or leaving
+	//before all cab calls are cancelled as nuisance calls. Disabled if 0.
+	NuisanceStops int `toml:"nuisance_stops"`
+	//CallsPerPassenger is the highest number of cab calls for every passenger before all cab calls are
+	//cancelled as nuisance calls. Disabled if 0.
+	CallsPerPassenger int `toml:"calls_per_passenger"`
+}
+
+//TrafficPeriod is a period of the day with a traffic mode
+type TrafficPeriod struct {
+	From TimeOfDay `toml:"from"`
+	To   TimeOfDay `toml:"to"`
+	Mode string    `toml:"mode"`
+}
+
+//SchedulerPeriods converts the traffic schedule to the scheduler periods
+func (s SchedulerConfig) SchedulerPeriods() []scheduler.TrafficPeriod {
+	periods := make([]scheduler.TrafficPeriod, 0, len(s.TrafficSchedule))
+	for _, p := range s.TrafficSchedule {
+		periods = append(periods, scheduler.TrafficPeriod{From: p.From.Duration, To: p.To.Duration, Mode: p.Mode})
+	}
+	return periods
+}
+
+//SecuredFloor is a floor only reachable with a credential. The floor is secured from From to To,
+//or always if both are omitted.
+type SecuredFloor struct {
+	Floor int       `toml:"floor"`
+	From  TimeOfDay `toml:"from"`
+	To    TimeOfDay `toml:"to"`
+}
+
+//SchedulerSecuredFloors converts the secured floors to the scheduler secured floors
+func (s SchedulerConfig) SchedulerSecuredFloors() []scheduler.SecuredFloor {
+	floors := make([]scheduler.SecuredFloor, 0, len(s.SecuredFloors))
+	for _, f := range s.SecuredFloors {
+		floors = append(floors, scheduler.SecuredFloor{Floor: f.Floor, From: f.From.Duration, To: f.To.Duration})
+	}
+	return floors
+}
+
+//NetworkConfig contains configuration for the network modules
+type NetworkConfig struct {
+	//HeartbeatInterval is the time between heartbeats
+	HeartbeatInterval Duration `toml:"heartbeat_interval"`
+	//HeartbeatTimeout is the time without heartbeats before a node is considered lost
+	HeartbeatTimeout Duration `toml:"heartbeat_timeout"`
+	//ResendInterval is the time between resends of unacknowledged messages
+	ResendInterval Duration `toml:"resend_interval"`
+	//UnicastPort is the UDP port used for point-to-point requests. A free port is used if 0.
+	UnicastPort int `toml:"unicast_port"`
+	//Codec is the name of the codec used to encode broadcast messages
+	Codec string `toml:"codec"`
+	//Key is the shared cluster key used to sign broadcast and unicast messages. Messages are not signed if empty.
+	Key Secret `toml:"key"`
+}
+
+//FireConfig contains configuration for fire service
+type FireConfig struct {
+	//RecallFloor is the floor the elevators are recalled to, unless another floor is requested
+	RecallFloor int `toml:"recall_floor"`
+}
+
+//Duration is a time.Duration that can be read from text, e.g. "2s" or "500ms"
+type Duration struct {
+	time.Duration
+}
+
+//UnmarshalText parses a duration
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
-//GetConfig returns config based on default values and provided flags
-func GetConfig() Config {
-	conf := Config{}
+//MarshalText formats a duration
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+//TimeOfDay is a time since midnight that can be read from text, e.g. "07:30"
+type TimeOfDay struct {
+	time.Duration
+}
+
+//UnmarshalText parses a time of day on the form hh:mm
+func (t *TimeOfDay) UnmarshalText(text []byte) error {
+	parsed, err := time.Parse("15:04", string(text))
+	if err != nil {
+		return fmt.Errorf("invalid time of day %q, expected hh:mm", text)
+	}
+	t.Duration = time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute
+	return nil
+}
+
+//MarshalText formats a time of day
+func (t TimeOfDay) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%02d:%02d", int(t.Hours()), int(t.Minutes())%60)), nil
+}
+
+//Secret is a string that is not shown when the configuration is logged
+type Secret string
+
+//String hides the secret
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "<hidden>"
+}
+
+//minKeyLength is the shortest accepted cluster key
+const minKeyLength = 16
+
+//Default returns the default configuration
+func Default() Config {
 	currentDir, err := os.Getwd()
 	if err != nil {
-		log.Panic(err)
+		currentDir = "."
 	}
+	return Config{
+		ElevatorID:   -1,
+		BasePort:     2000,
+		ElevatorPort: 15657,
+		Floors:       4,
+		FilePath:     currentDir + "/orders.json",
+		LogLevel:     "info",
+		Controller: ControllerConfig{
+			DoorOpenDuration:  Duration{2 * time.Second},
+			MotorStallTimeout: Duration{5 * time.Second},
+			BypassLoad:        80,
+			PassengerLoad:     8,
+		},
+		Scheduler: SchedulerConfig{
+			OrderTimeout:      Duration{20 * time.Second},
+			CabPenalty:        0.5,
+			CostFunction:      scheduler.DefaultCostFunction,
+			Parking:           scheduler.DefaultParking,
+			ParkingDelay:      Duration{10 * time.Second},
+			TrafficMode:       scheduler.DefaultTrafficMode,
+			AccessWindow:      Duration{10 * time.Second},
+			NuisanceStops:     3,
+			CallsPerPassenger: 3,
+		},
+		Network: NetworkConfig{
+			HeartbeatInterval: Duration{50 * time.Millisecond},
+			HeartbeatTimeout:  Duration{500 * time.Millisecond},
+			ResendInterval:    Duration{50 * time.Millisecond},
+			Codec:             network.DefaultCodec,
+		},
+	}
+}
+
+//GetConfig returns config based on default values, the config file, environment variables and provided flags.
+//Later sources override earlier ones. Returns an error if the configuration is invalid.
+func GetConfig() (Config, error) {
+	conf := Default()
+	flagConf := Default()
+	var configPath string
 
-	flag.IntVar(&conf.ElevatorID, "id", -1, "Elevator ID")
-	flag.IntVar(&conf.BasePort, "baseport", 2000, "Base network UDP port")
-	flag.IntVar(&conf.ElevatorPort, "elevator-port", 15657, "Port for elevator server")
-	flag.IntVar(&conf.Floors, "floors", 4, "Number of floors")
-	flag.StringVar(&conf.FilePath, "folder", currentDir+"/orders.json", "Folder to store program files in")
+	flag.StringVar(&configPath, "config", "", "Configuration file (TOML)")
+	flag.IntVar(&flagConf.ElevatorID, "id", flagConf.ElevatorID, "Elevator ID")
+	flag.IntVar(&flagConf.BasePort, "baseport", flagConf.BasePort, "Network UDP broadcast port")
+	flag.IntVar(&flagConf.ElevatorPort, "elevator-port", flagConf.ElevatorPort, "Port for elevator server")
+	flag.IntVar(&flagConf.Floors, "floors", flagConf.Floors, "Number of floors")
+	flag.StringVar(&flagConf.FilePath, "folder", flagConf.FilePath, "Folder to store program files in")
+	flag.StringVar(&flagConf.LogLevel, "log-level", flagConf.LogLevel, "Log levels, e.g. info,scheduler=debug,network=warn")
+	flag.StringVar(&flagConf.AdminAddress, "admin-address", flagConf.AdminAddress, "HTTP address of the admin interface")
 	flag.Parse()
 
+	conf.path = configPath
+	if configPath != "" {
+		if err := readFile(configPath, &conf); err != nil {
+			return conf, err
+		}
+	}
+	if err := applyEnv(os.Environ(), &conf); err != nil {
+		return conf, err
+	}
+
+	//Only flags explicitly set override the other sources
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			conf.ElevatorID = flagConf.ElevatorID
+		case "baseport":
+			conf.BasePort = flagConf.BasePort
+		case "elevator-port":
+			conf.ElevatorPort = flagConf.ElevatorPort
+		case "floors":
+			conf.Floors = flagConf.Floors
+		case "folder":
+			conf.FilePath = flagConf.FilePath
+		case "log-level":
+			conf.LogLevel = flagConf.LogLevel
+		case "admin-address":
+			conf.AdminAddress = flagConf.AdminAddress
+		}
+	})
+
 	if conf.ElevatorID < 0 {
-		conf.ElevatorID, err = network.GetIDFromIP()
+		id, err := network.GetIDFromIP()
+		if err != nil {
+			return conf, fmt.Errorf("no id configured and unable to get id from ip: %s", err)
+		}
+		conf.ElevatorID = id
+	}
+
+	if err := conf.Validate(); err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+//readFile reads a TOML configuration file into conf
+func readFile(path string, conf *Config) error {
+	meta, err := toml.DecodeFile(path, conf)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	//Typos would otherwise be silently ignored
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return fmt.Errorf("unknown keys in config file %s: %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+//applyEnv overrides configuration values with environment variables on the form PREFIX_SECTION_KEY=value
+func applyEnv(environ []string, conf *Config) error {
+	env := make(map[string]string)
+	for _, e := range environ {
+		if parts := strings.SplitN(e, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return applyEnvToStruct(env, EnvPrefix, reflect.ValueOf(conf).Elem())
+}
+
+//applyEnvToStruct sets all fields of a struct with a matching environment variable
+func applyEnvToStruct(env map[string]string, prefix string, v reflect.Value) error {
+	durationType := reflect.TypeOf(Duration{})
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag := v.Type().Field(i).Tag.Get("toml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+
+		//Sections
+		if field.Kind() == reflect.Struct && field.Type() != durationType {
+			if err := applyEnvToStruct(env, name, field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", value, name, err)
+		}
+	}
+	return nil
+}
+
+//setField parses a value into a configuration field
+func setField(field reflect.Value, value string) error {
+	if d, ok := field.Addr().Interface().(*Duration); ok {
+		return d.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
 		if err != nil {
-			log.Panicln(err)
+			return err
 		}
+		field.SetBool(b)
+	case reflect.Slice:
+		//Lists of integers are comma separated, e.g. 0,4,5
+		if field.Type().Elem().Kind() != reflect.Int {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		list := []int{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			i, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			list = append(list, i)
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+//Validate checks that all values are within valid ranges and parses the log levels.
+//All problems are reported in a single error.
+func (c *Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.ElevatorID >= 0, "id must not be negative, got %d", c.ElevatorID)
+	check(c.BasePort > 0 && c.BasePort <= 65535, "base_port must be a valid UDP port, got %d", c.BasePort)
+	check(c.ElevatorPort > 0 && c.ElevatorPort <= 65535, "elevator_port must be a valid TCP port, got %d", c.ElevatorPort)
+	check(c.Floors >= 2, "floors must be at least 2, got %d", c.Floors)
+	check(c.FilePath != "", "order_file must be set")
+	check(c.Controller.DoorOpenDuration.Duration > 0, "controller.door_open_duration must be positive, got %s", c.Controller.DoorOpenDuration)
+	check(c.Controller.MotorStallTimeout.Duration > 0, "controller.motor_stall_timeout must be positive, got %s", c.Controller.MotorStallTimeout)
+	check(c.Controller.BypassLoad > 0 && c.Controller.BypassLoad <= 100, "controller.bypass_load must be a percentage between 1 and 100, got %d", c.Controller.BypassLoad)
+	check(c.Controller.PassengerLoad > 0 && c.Controller.PassengerLoad <= 100, "controller.passenger_load must be a percentage between 1 and 100, got %d", c.Controller.PassengerLoad)
+	check(c.Scheduler.OrderTimeout.Duration > 0, "scheduler.order_timeout must be positive, got %s", c.Scheduler.OrderTimeout)
+	check(c.Scheduler.CabPenalty > 0 && c.Scheduler.CabPenalty < 1, "scheduler.cab_penalty must be between 0 and 1, got %g", c.Scheduler.CabPenalty)
+	check(scheduler.ValidCostFunction(c.Scheduler.CostFunction), "scheduler.cost_function %q does not exist", c.Scheduler.CostFunction)
+	check(scheduler.ValidParkingPolicy(c.Scheduler.Parking), "scheduler.parking %q does not exist", c.Scheduler.Parking)
+	check(c.Scheduler.LobbyFloor >= 0 && c.Scheduler.LobbyFloor < c.Floors, "scheduler.lobby_floor must be a floor between 0 and %d, got %d", c.Floors-1, c.Scheduler.LobbyFloor)
+	check(c.Scheduler.ParkingDelay.Duration > 0, "scheduler.parking_delay must be positive, got %s", c.Scheduler.ParkingDelay)
+	check(scheduler.ValidTrafficMode(c.Scheduler.TrafficMode, true), "scheduler.traffic_mode %q does not exist", c.Scheduler.TrafficMode)
+	for i, p := range c.Scheduler.TrafficSchedule {
+		check(scheduler.ValidTrafficMode(p.Mode, true), "scheduler.traffic_schedule[%d].mode %q does not exist", i, p.Mode)
+		check(p.From != p.To, "scheduler.traffic_schedule[%d] must not be empty, from and to are both %s", i, p.From.Duration)
+	}
+	check(len(c.Scheduler.ServedFloors) != 1, "scheduler.served_floors must contain at least two floors, or none to serve all floors")
+	for i, floor := range c.Scheduler.ServedFloors {
+		check(floor >= 0 && floor < c.Floors, "scheduler.served_floors[%d] must be a floor between 0 and %d, got %d", i, c.Floors-1, floor)
+		for _, other := range c.Scheduler.ServedFloors[:i] {
+			check(other != floor, "scheduler.served_floors[%d] repeats floor %d", i, floor)
+		}
+	}
+	for i, s := range c.Scheduler.SecuredFloors {
+		check(s.Floor >= 0 && s.Floor < c.Floors, "scheduler.secured_floors[%d].floor must be a floor between 0 and %d, got %d", i, c.Floors-1, s.Floor)
+	}
+	check(c.Scheduler.AccessWindow.Duration > 0, "scheduler.access_window must be positive, got %s", c.Scheduler.AccessWindow)
+	check(c.Scheduler.NuisanceStops >= 0, "scheduler.nuisance_stops must be 0 or positive, got %d", c.Scheduler.NuisanceStops)
+	check(c.Scheduler.CallsPerPassenger >= 0, "scheduler.calls_per_passenger must be 0 or positive, got %d", c.Scheduler.CallsPerPassenger)
+	check(c.Network.HeartbeatInterval.Duration > 0, "network.heartbeat_interval must be positive, got %s", c.Network.HeartbeatInterval)
+	check(c.Network.HeartbeatTimeout.Duration > c.Network.HeartbeatInterval.Duration, "network.heartbeat_timeout (%s) must be longer than network.heartbeat_interval (%s)", c.Network.HeartbeatTimeout, c.Network.HeartbeatInterval)
+	check(c.Network.ResendInterval.Duration > 0, "network.resend_interval must be positive, got %s", c.Network.ResendInterval)
+	check(c.Network.Key == "" || len(c.Network.Key) >= minKeyLength, "network.key must be empty or at least %d characters", minKeyLength)
+	_, codecErr := network.LookupCodec(c.Network.Codec)
+	check(codecErr == nil, "network.codec %q does not exist", c.Network.Codec)
+	check(c.Fire.RecallFloor >= 0 && c.Fire.RecallFloor < c.Floors, "fire.recall_floor must be a floor between 0 and %d, got %d", c.Floors-1, c.Fire.RecallFloor)
+	check(c.Network.UnicastPort >= 0 && c.Network.UnicastPort <= 65535, "network.unicast_port must be a valid UDP port or 0, got %d", c.Network.UnicastPort)
+
+	levels, err := logging.ParseLevels(c.LogLevel)
+	check(err == nil, "log_level is invalid: %s", err)
+	c.LogLevels = levels
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
 	}
-	return conf
+	return nil
 }
@@ -0,0 +1,137 @@
+package configuration
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+//WatcherConfig contains configuration for the configuration watcher
+type WatcherConfig struct {
+	//Current is the configuration the node was started with
+	Current Config
+	//PollInterval is the time between checks for changes to the configuration file
+	PollInterval time.Duration
+	//Reloaded receives the new configuration every time the runtime values change
+	Reloaded chan<- Config
+	Logger   *logging.Logger
+}
+
+//Reload reads the configuration file and environment variables again.
+//Only the controller, scheduler and network heartbeat values can be changed at runtime.
+//All other values are kept from the current configuration.
+func (c Config) Reload() (Config, error) {
+	conf := Default()
+	if c.path != "" {
+		if err := readFile(c.path, &conf); err != nil {
+			return c, err
+		}
+	}
+	if err := applyEnv(os.Environ(), &conf); err != nil {
+		return c, err
+	}
+
+	//Values that require a restart
+	reloaded := c
+	reloaded.Controller = conf.Controller
+	reloaded.Scheduler = conf.Scheduler
+	reloaded.Network.HeartbeatInterval = conf.Network.HeartbeatInterval
+	reloaded.Network.HeartbeatTimeout = conf.Network.HeartbeatTimeout
+
+	if err := reloaded.Validate(); err != nil {
+		return c, err
+	}
+	return reloaded, nil
+}
+
+//RunWatcher reloads the configuration when the file changes or SIGHUP is received.
+//Invalid configurations are logged and ignored.
+func RunWatcher(ctx context.Context, conf WatcherConfig) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	ticker := time.NewTicker(conf.PollInterval)
+	defer ticker.Stop()
+
+	current := conf.Current
+	lastModified := modTime(current.path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			conf.Logger.Infof("Received SIGHUP - reloading configuration")
+		case <-ticker.C:
+			modified := modTime(current.path)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			conf.Logger.Infof("Configuration file %s changed - reloading configuration", current.path)
+		}
+
+		reloaded, err := current.Reload()
+		if err != nil {
+			conf.Logger.Errorf("Keeping current configuration: %s", err)
+			continue
+		}
+		if reloaded.Controller == current.Controller && reflect.DeepEqual(reloaded.Scheduler, current.Scheduler) && reloaded.Network == current.Network {
+			conf.Logger.Infof("No runtime configuration values changed")
+			continue
+		}
+		current = reloaded
+		conf.Logger.Infof("Applying configuration: controller %+v, scheduler %+v, network %+v", current.Controller, current.Scheduler, current.Network)
+		select {
+		case conf.Reloaded <- current:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//modTime returns the modification time of a file, or the zero time if it can not be read
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+//Store contains the latest configuration and is safe for concurrent use.
+//Used to start restarted modules with the latest runtime values.
+type Store struct {
+	mtx  sync.Mutex
+	conf Config
+}
+
+//NewStore creates a store containing conf
+func NewStore(conf Config) *Store {
+	return &Store{conf: conf}
+}
+
+//Get returns the latest configuration
+func (s *Store) Get() Config {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.conf
+}
+
+//Set replaces the configuration
+func (s *Store) Set(conf Config) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.conf = conf
+}
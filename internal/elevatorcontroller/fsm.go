@@ -1,11 +1,12 @@
 package elevatorcontroller
 
 import (
-	"log"
+	"fmt"
 	"time"
 
 	"github.com/HaavardM/TTK4145-Elevator/internal/elevatordriver"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
 	"golang.org/x/net/context"
 )
 
@@ -37,8 +38,6 @@ func (s state) String() string {
 	}
 }
 
-const doorOpenDuration = 2 * time.Second
-
 //Config used to configure the fsm
 type Config struct {
 	ElevatorCommand chan<- elevatordriver.Command
@@ -47,6 +46,31 @@ type Config struct {
 	NumberOfFloors  int
 	OrderCompleted  chan common.Order
 	ElevatorStatus  chan<- common.ElevatorStatus
+	//DoorOpenDuration is how long the door stays open at a floor
+	DoorOpenDuration time.Duration
+	//MotorStallTimeout is the maximum time between floors before the elevator is considered stuck
+	MotorStallTimeout time.Duration
+	//Reload receives new values for the runtime configuration
+	Reload <-chan RuntimeConfig
+	//DoorMode receives how the doors are operated. The doors are operated automatically until a mode is received.
+	DoorMode <-chan common.DoorMode
+	//DoorCommand receives commands from an operator, only used when the doors are operated manually
+	DoorCommand <-chan common.DoorCommand
+	//Load receives the load of the car in percent of the capacity
+	Load <-chan int
+	//BypassLoad is the load in percent of the capacity where the car is full and passes hall orders by
+	BypassLoad int
+	//PassengerLoad is the load of one passenger in percent of the capacity
+	PassengerLoad int
+	Logger        *logging.Logger
+}
+
+//RuntimeConfig contains configuration values that can be changed while running
+type RuntimeConfig struct {
+	DoorOpenDuration  time.Duration
+	MotorStallTimeout time.Duration
+	BypassLoad        int
+	PassengerLoad     int
 }
 
 //Struct containing variables and channels used by the statemachine
@@ -60,6 +84,13 @@ type fsm struct {
 	status             common.ElevatorStatus
 	statusSend         chan<- common.ElevatorStatus
 	lastFloorTimestamp time.Time
+	doorOpenDuration   time.Duration
+	doorMode           common.DoorMode
+	//loadKnown is set when a load is received, so stops without passengers can be detected
+	loadKnown bool
+	//stopLoad is the load when the doors opened, and cabStop is set if they opened for a cab order
+	stopLoad int
+	cabStop  bool
 }
 
 //runSendLatestElevatorStatus sends a message with the elevator status if it has changed
@@ -85,13 +116,14 @@ func runSendLatestElevatorStatus(ctx context.Context, send chan<- common.Elevato
 }
 
 //Initializes the fsm struct
-func newFSM(elevatorCommand chan<- elevatordriver.Command, orderCompleted chan<- common.Order, statusSend chan<- common.ElevatorStatus) *fsm {
+func newFSM(elevatorCommand chan<- elevatordriver.Command, orderCompleted chan<- common.Order, statusSend chan<- common.ElevatorStatus, doorOpenDuration time.Duration) *fsm {
 	temp := &fsm{
-		state:           stateDoorClosed,
-		timer:           time.NewTimer(doorOpenDuration),
-		elevatorCommand: elevatorCommand,
-		orderCompleted:  orderCompleted,
-		statusSend:      statusSend,
+		state:            stateDoorClosed,
+		timer:            time.NewTimer(doorOpenDuration),
+		elevatorCommand:  elevatorCommand,
+		orderCompleted:   orderCompleted,
+		statusSend:       statusSend,
+		doorOpenDuration: doorOpenDuration,
 	}
 	if !(temp.timer.Stop()) {
 		<-temp.timer.C
@@ -100,24 +132,48 @@ func newFSM(elevatorCommand chan<- elevatordriver.Command, orderCompleted chan<-
 }
 
 //Run starts the elevatorcontroller fsm
-func Run(ctx context.Context, conf Config) {
+//Returns an error if the fsm ends up in an invalid state
+func Run(ctx context.Context, conf Config) error {
+	//Stop status publisher on exit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	//Create elevator status publisher
 	elevatorStatus := make(chan common.ElevatorStatus)
 	go runSendLatestElevatorStatus(ctx, conf.ElevatorStatus, elevatorStatus)
 
-	fsm := newFSM(conf.ElevatorCommand, conf.OrderCompleted, elevatorStatus)
-	fsm.init(conf)
+	fsm := newFSM(conf.ElevatorCommand, conf.OrderCompleted, elevatorStatus, conf.DoorOpenDuration)
+	if err := fsm.init(ctx, conf); err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case nextOrder := <-conf.Order:
-			fsm.handleNewOrders(conf, nextOrder)
+			if err := fsm.handleNewOrders(conf, nextOrder); err != nil {
+				return err
+			}
 		case fsm.status.Floor = <-conf.ArrivedAtFloor:
 			fsm.handleAtFloor(conf)
 		case <-fsm.timer.C:
 			fsm.handleTimerElapsed(conf)
+		case r := <-conf.Reload:
+			//Applies from the next time the door opens
+			conf.DoorOpenDuration = r.DoorOpenDuration
+			conf.MotorStallTimeout = r.MotorStallTimeout
+			fsm.doorOpenDuration = r.DoorOpenDuration
+			conf.BypassLoad = r.BypassLoad
+			conf.PassengerLoad = r.PassengerLoad
+			fsm.handleLoad(conf, fsm.status.Load)
+		case load := <-conf.Load:
+			fsm.loadKnown = true
+			fsm.handleLoad(conf, load)
+		case mode := <-conf.DoorMode:
+			fsm.handleDoorMode(conf, mode)
+		case cmd := <-conf.DoorCommand:
+			fsm.handleDoorCommand(conf, cmd)
 		case <-ctx.Done():
-			break
+			return nil
 		case <-time.After(time.Second):
 		}
 
@@ -125,38 +181,50 @@ func Run(ctx context.Context, conf Config) {
 			//Reset timestamp if not moving
 			fsm.lastFloorTimestamp = time.Now()
 		}
-		if time.Now().Sub(fsm.lastFloorTimestamp) > 5*time.Second && fsm.status.Moving {
+		if time.Now().Sub(fsm.lastFloorTimestamp) > conf.MotorStallTimeout && fsm.status.Moving {
 			if !fsm.status.Error {
-				log.Println("Elevator not responding")
+				conf.Logger.Errorf("Elevator not responding")
 			}
 			fsm.status.Error = true
 		} else {
 			if fsm.status.Error {
-				log.Println("Elevator works fine again :)")
+				conf.Logger.Infof("Elevator works fine again :)")
 			}
 			fsm.status.Error = false
 		}
 		//Handle orders that have been buffer stored while elevator was
 		//in door-open state and could not execute a new order
 		if fsm.nextOrder != nil {
-			fsm.handleNewOrders(conf, *fsm.nextOrder)
+			if err := fsm.handleNewOrders(conf, *fsm.nextOrder); err != nil {
+				return err
+			}
+		}
+		select {
+		case elevatorStatus <- fsm.status:
+		case <-ctx.Done():
+			return nil
 		}
-		elevatorStatus <- fsm.status
 	}
 }
 
 //Initializes elevator when starting up so that it knows where it is
-func (f *fsm) init(conf Config) {
+func (f *fsm) init(ctx context.Context, conf Config) error {
 	f.elevatorCommand <- elevatordriver.MoveUp
-	f.status.Floor = <-conf.ArrivedAtFloor
+	select {
+	case f.status.Floor = <-conf.ArrivedAtFloor:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	f.lastFloorTimestamp = time.Now()
 	f.elevatorCommand <- elevatordriver.Stop
 	f.status.OrderDir = common.NoDir
 	f.statusSend <- f.status
+	return nil
 }
 
 //Handles incomming orders from the scheduler module
-func (f *fsm) handleNewOrders(conf Config, order common.Order) {
+//Returns an error if the order is invalid
+func (f *fsm) handleNewOrders(conf Config, order common.Order) error {
 
 	//Initializes variables for the statemachine
 	targetFloor := order.Floor
@@ -164,8 +232,8 @@ func (f *fsm) handleNewOrders(conf Config, order common.Order) {
 	targetDir := order.Dir
 
 	//Elevator out of range
-	if (targetDir == common.UpDir && targetFloor >= conf.NumberOfFloors) || (targetDir == common.DownDir && targetFloor <= 0) {
-		log.Panic()
+	if targetFloor < 0 || targetFloor >= conf.NumberOfFloors || (targetDir == common.DownDir && targetFloor <= 0) {
+		return fmt.Errorf("order %+v out of range", order)
 	}
 
 	//Clear next order - order is the new order
@@ -190,7 +258,7 @@ func (f *fsm) handleNewOrders(conf Config, order common.Order) {
 		f.currentOrder = &order
 		//Set state to current order dir
 		if currentFloor == targetFloor {
-			f.transitionToDoorOpen(conf)
+			f.transitionToArrived(conf)
 		} else if orderAbove(order, currentFloor) {
 			f.transitionToMovingUp(conf)
 		} else {
@@ -199,7 +267,13 @@ func (f *fsm) handleNewOrders(conf Config, order common.Order) {
 	case stateDoorOpen:
 		//We have to wait for the doors to close before executing next order
 		f.nextOrder = &order
+		//Doors held open are closed at once when sent to another floor
+		if f.doorMode == common.DoorHoldOpen && targetFloor != currentFloor {
+			f.stopTimer()
+			f.transitionToDoorClosed(conf)
+		}
 	}
+	return nil
 }
 
 //Handles events that occur when reaching a new floow
@@ -208,25 +282,55 @@ func (f *fsm) handleAtFloor(conf Config) {
 	switch f.state {
 	case stateMovingUp, stateMovingDown:
 		if f.shouldStop(f.status.Floor) {
-			f.transitionToDoorOpen(conf)
+			f.transitionToArrived(conf)
 		}
 	}
 }
 
+//Handles arriving at the floor of the current order.
+//The doors are opened unless they are operated manually or the elevator is parking.
+//Full cars pass hall orders by.
+func (f *fsm) transitionToArrived(conf Config) {
+	if f.status.Full && f.currentOrder != nil && f.currentOrder.Dir != common.NoDir {
+		//The order is not completed, so it is served later or by another elevator
+		conf.Logger.Infof("Passing by %s order at floor %d, the car is full", f.currentOrder.Dir, f.currentOrder.Floor)
+		f.elevatorCommand <- elevatordriver.Stop
+		f.status.Moving = false
+		f.currentOrder = nil
+		f.state = stateDoorClosed
+		return
+	}
+	if f.doorMode == common.DoorManual || (f.currentOrder != nil && f.currentOrder.Park) {
+		//The order is completed with the doors closed, and the operator opens them if operated manually
+		f.elevatorCommand <- elevatordriver.Stop
+		f.transitionToDoorClosed(conf)
+		return
+	}
+	f.transitionToDoorOpen(conf)
+}
+
 //Handles transition from one state to the open door state
 func (f *fsm) transitionToDoorOpen(conf Config) {
 	f.elevatorCommand <- elevatordriver.Stop
 	f.elevatorCommand <- elevatordriver.OpenDoor
-	f.timer.Reset(doorOpenDuration)
+	f.stopTimer()
+	if f.doorMode != common.DoorManual {
+		f.timer.Reset(f.doorOpenDuration)
+	}
 	f.status.Moving = false
 	if f.currentOrder != nil {
 		f.status.OrderDir = f.currentOrder.Dir
 	}
+	f.stopLoad = f.status.Load
+	f.cabStop = f.currentOrder != nil && f.currentOrder.Dir == common.NoDir
 	f.state = stateDoorOpen
 }
 
 //Handles transition from one state to door closed state
 func (f *fsm) transitionToDoorClosed(conf Config) {
+	if f.state == stateDoorOpen {
+		f.recordStop(conf)
+	}
 	f.elevatorCommand <- elevatordriver.CloseDoor
 	f.status.Moving = false
 	if f.currentOrder != nil {
@@ -276,6 +380,99 @@ func (f *fsm) shouldStop(floor int) bool {
 func (f *fsm) handleTimerElapsed(conf Config) {
 	switch f.state {
 	case stateDoorOpen:
+		switch f.doorMode {
+		case common.DoorHoldOpen:
+			//The doors are only closed when sent to another floor
+			f.timer.Reset(f.doorOpenDuration)
+			return
+		case common.DoorManual:
+			return
+		}
 		f.transitionToDoorClosed(conf)
 	}
 }
+
+//Handles a change of door mode. Open doors are closed after the door open duration
+//when leaving manual operation, and are left open when entering it.
+//An idle elevator opens the doors when they are held open, so the mode must only be sent at the floor the doors are held open at.
+func (f *fsm) handleDoorMode(conf Config, mode common.DoorMode) {
+	if mode == f.doorMode {
+		return
+	}
+	conf.Logger.Infof("Door mode changed from %s to %s", f.doorMode, mode)
+	f.doorMode = mode
+	if mode == common.DoorHoldOpen && f.state == stateDoorClosed && f.currentOrder == nil && f.nextOrder == nil {
+		f.transitionToDoorOpen(conf)
+		return
+	}
+	if f.state == stateDoorOpen {
+		f.stopTimer()
+		if mode != common.DoorManual {
+			f.timer.Reset(f.doorOpenDuration)
+		}
+	}
+}
+
+//Handles a door command from an operator. Ignored unless the doors are operated manually.
+func (f *fsm) handleDoorCommand(conf Config, cmd common.DoorCommand) {
+	if f.doorMode != common.DoorManual {
+		conf.Logger.Warnf("Ignoring door command %d, the doors are operated %s", cmd, f.doorMode)
+		return
+	}
+	switch cmd {
+	case common.OpenDoors:
+		if f.state == stateDoorClosed {
+			f.transitionToDoorOpen(conf)
+		} else if f.status.Moving {
+			conf.Logger.Warnf("Can not open the doors while moving")
+		}
+	case common.CloseDoors:
+		if f.state == stateDoorOpen {
+			f.transitionToDoorClosed(conf)
+		}
+	}
+}
+
+//Handles a new load of the car, and logs when the car becomes full or not
+func (f *fsm) handleLoad(conf Config, load int) {
+	f.status.Load = load
+	full := load >= conf.BypassLoad
+	if full != f.status.Full {
+		if full {
+			conf.Logger.Infof("Car is full with %d%% load, passing hall orders by", load)
+		} else {
+			conf.Logger.Infof("Car is no longer full with %d%% load", load)
+		}
+	}
+	f.status.Full = full
+	//Rounded to the closest number of passengers
+	f.status.Passengers = (load + conf.PassengerLoad/2) / conf.PassengerLoad
+}
+
+//recordStop counts the stops for cab orders in a row where the load did not change by at least half a passenger
+//while the doors were open, as when a child presses every cab button. Any stop where passengers enter or leave resets the count.
+func (f *fsm) recordStop(conf Config) {
+	if !f.loadKnown {
+		return
+	}
+	change := f.status.Load - f.stopLoad
+	if change < 0 {
+		change = -change
+	}
+	if 2*change >= conf.PassengerLoad {
+		f.status.EmptyStops = 0
+	} else if f.cabStop {
+		f.status.EmptyStops++
+		conf.Logger.Debugf("No passengers entered or left at floor %d, %d empty stops in a row", f.status.Floor, f.status.EmptyStops)
+	}
+}
+
+//Stops the door timer and removes any pending expiry
+func (f *fsm) stopTimer() {
+	if !f.timer.Stop() {
+		select {
+		case <-f.timer.C:
+		default:
+		}
+	}
+}
@@ -2,9 +2,15 @@ package elevatordriver
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
 	"github.com/TTK4145/driver-go/elevio"
 )
 
@@ -48,6 +54,8 @@ const (
 	InternalButtonLight
 	//AllLights used to set all lights at floor
 	AllLights
+	//FireServiceLight shows that the elevator is in fire service, using the stop lamp. The floor is ignored.
+	FireServiceLight
 )
 
 //Config contains neccessary configuration for the elevator driver
@@ -58,33 +66,102 @@ type Config struct {
 	SetStatusLight <-chan LightState
 	ArrivedAtFloor chan<- int
 	OnButtonPress  chan<- elevio.ButtonEvent
+	//Keypad enables the destination dispatch keypads, which are only supported by the simulator
+	Keypad bool
+	//OnDestinationCall receives destinations entered at the keypads
+	OnDestinationCall chan<- common.DestinationCall
+	//KeypadDisplay shows the cars assigned to destination calls
+	KeypadDisplay <-chan KeypadDisplay
+	//LoadWeighing enables the load weighing of the car, which is only supported by the simulator
+	LoadWeighing bool
+	//OnLoadChanged receives the load of the car in percent of the capacity
+	OnLoadChanged chan<- int
+	//CardReader enables the card reader of the car, which is only supported by the simulator
+	CardReader bool
+	//OnCredential receives the cards presented at the card reader
+	OnCredential chan<- common.Credential
+	Logger       *logging.Logger
 }
 
+//The elevio pollers can not be stopped, so they are only started once
+//and shared between restarts of the driver
+var (
+	pollersOnce    sync.Once
+	buttonPresses  = make(chan elevio.ButtonEvent)
+	arrivedAtFloor = make(chan int)
+)
+
 //Run runs the elevator driver module
-func Run(ctx context.Context, config Config) {
-	arrivedAtFloor := make(chan int)
+//Returns an error if the elevator server is unavailable
+func Run(ctx context.Context, config Config) error {
+	//elevio panics if the server is unavailable, so check the connection first
+	conn, err := net.DialTimeout("tcp", config.Address, time.Second)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
 	//Initialize elevio module
 	elevio.Init(config.Address, config.NumberOfFloors)
-	//Start button poller
-	go elevio.PollButtons(config.OnButtonPress)
-	//Start floor sensor poller
-	go elevio.PollFloorSensor(arrivedAtFloor)
+	pollersOnce.Do(func() {
+		//Start button poller
+		go elevio.PollButtons(buttonPresses)
+		//Start floor sensor poller
+		go elevio.PollFloorSensor(arrivedAtFloor)
+	})
 
 	//Initalize to a stop state
 	handleNewCommand(Stop)
 
+	//Stop the keypads, load weighing and card reader when the driver stops
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	extensionErr := make(chan error, 1)
+	if config.Keypad || config.LoadWeighing || config.CardReader {
+		go func() {
+			extensionErr <- runExtensions(ctx, config)
+		}()
+	}
+
 	//Run infite loop until context finishes
 	for {
 		select {
 		case c := <-config.Commands:
-			handleNewCommand(c)
+			if err := handleNewCommand(c); err != nil {
+				config.Logger.Errorf("Failed to execute command %d: %s", c, err)
+			}
 		case l := <-config.SetStatusLight:
-			handleNewLightState(l)
+			if err := handleNewLightState(l); err != nil {
+				config.Logger.Errorf("Failed to set light %+v: %s", l, err)
+			}
+		case b := <-buttonPresses:
+			//The scheduler sets the lights and handles button presses in the same goroutine,
+			//so lights are set while waiting to avoid a deadlock
+			for sent := false; !sent; {
+				select {
+				case config.OnButtonPress <- b:
+					sent = true
+				case l := <-config.SetStatusLight:
+					if err := handleNewLightState(l); err != nil {
+						config.Logger.Errorf("Failed to set light %+v: %s", l, err)
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		case err := <-extensionErr:
+			if err != nil {
+				return fmt.Errorf("keypad, load weighing or card reader failed: %s", err)
+			}
 		case f := <-arrivedAtFloor:
 			elevio.SetFloorIndicator(f)
-			config.ArrivedAtFloor <- f
+			select {
+			case config.ArrivedAtFloor <- f:
+			case <-ctx.Done():
+				return nil
+			}
 		case <-ctx.Done():
-			break
+			return nil
 		}
 	}
 }
@@ -121,6 +198,8 @@ func handleNewLightState(light LightState) error {
 		elevio.SetButtonLamp(elevio.BT_HallUp, light.Floor, light.State)
 		elevio.SetButtonLamp(elevio.BT_HallDown, light.Floor, light.State)
 		elevio.SetButtonLamp(elevio.BT_Cab, light.Floor, light.State)
+	case FireServiceLight:
+		elevio.SetStopLamp(light.State)
 	default:
 		return errors.New("Unrecognized light type")
 	}
@@ -0,0 +1,123 @@
+package elevatordriver
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//Destination dispatch keypads, load weighing and the card reader are not part of the elevator server protocol, so they are
+//read with the extra commands of the simulator on a separate connection. Every message is four bytes.
+const (
+	//cmdGetKeypad returns the oldest destination call as {cmd, valid, origin, destination}
+	cmdGetKeypad byte = 10
+	//cmdKeypadDisplay shows a car on the keypad at a floor as {cmd, floor, car high byte, car low byte}
+	cmdKeypadDisplay byte = 11
+	//cmdGetLoad returns the load of the car in percent of the capacity as {cmd, load, 0, 0}
+	cmdGetLoad byte = 12
+	//cmdGetCard returns the oldest card presented at the card reader as {cmd, valid, card high byte, card low byte}
+	cmdGetCard byte = 13
+)
+
+//extensionPollRate is the time between polls of the keypads, the load and the card reader
+const extensionPollRate = 20 * time.Millisecond
+
+//KeypadDisplay shows the car assigned to a destination call on the keypad at a floor
+type KeypadDisplay struct {
+	Floor int
+	Car   int
+}
+
+//extensionConn is the connection used for the extra commands
+type extensionConn struct {
+	conn net.Conn
+	buf  [4]byte
+}
+
+//query sends a command and returns the reply
+func (c *extensionConn) query(cmd byte) ([4]byte, error) {
+	if _, err := c.conn.Write([]byte{cmd, 0, 0, 0}); err != nil {
+		return c.buf, err
+	}
+	_, err := io.ReadFull(c.conn, c.buf[:])
+	return c.buf, err
+}
+
+//runExtensions polls the keypads for destination calls and shows the assigned cars if Keypad is set,
+//polls the load if LoadWeighing is set, and polls the card reader if CardReader is set.
+//Returns an error if the connection fails.
+func runExtensions(ctx context.Context, config Config) error {
+	conn, err := net.DialTimeout("tcp", config.Address, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	c := &extensionConn{conn: conn}
+
+	ticker := time.NewTicker(extensionPollRate)
+	defer ticker.Stop()
+	load := -1
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d := <-config.KeypadDisplay:
+			car := uint16(int16(d.Car))
+			if _, err := conn.Write([]byte{cmdKeypadDisplay, byte(d.Floor), byte(car >> 8), byte(car)}); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if config.Keypad {
+				reply, err := c.query(cmdGetKeypad)
+				if err != nil {
+					return err
+				}
+				if reply[1] != 0 {
+					call := common.DestinationCall{Origin: int(reply[2]), Destination: int(reply[3])}
+					select {
+					case config.OnDestinationCall <- call:
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}
+			if config.LoadWeighing {
+				reply, err := c.query(cmdGetLoad)
+				if err != nil {
+					return err
+				}
+				//Only changes are sent
+				if int(reply[1]) != load {
+					load = int(reply[1])
+					select {
+					case config.OnLoadChanged <- load:
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}
+			if config.CardReader {
+				reply, err := c.query(cmdGetCard)
+				if err != nil {
+					return err
+				}
+				if reply[1] != 0 {
+					credential := common.Credential{Card: int(reply[2])<<8 | int(reply[3])}
+					select {
+					case config.OnCredential <- credential:
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//AdminRequest is a command from the admin interface.
+//The scheduler replies with its status after handling the command.
+type AdminRequest struct {
+	//Command is one of the command types below, or nil to only get the status
+	Command interface{}
+	//Reply must be buffered
+	Reply chan<- AdminReply
+}
+
+//AdminReply is the reply to an admin request
+type AdminReply struct {
+	Status Status
+	//Err is set if the command is rejected
+	Err error
+}
+
+//Status is the state of the scheduler shown in the admin interface
+type Status struct {
+	ID     int  `json:"id"`
+	Floor  int  `json:"floor"`
+	Moving bool `json:"moving"`
+	//Load is the load of the car in percent of the capacity, and Full is set above the bypass threshold
+	Load        int        `json:"load"`
+	Full        bool       `json:"full"`
+	Coordinator int        `json:"coordinator"`
+	Fire        FireStatus `json:"fire"`
+	//IndependentService is set while the elevator only serves cab calls
+	IndependentService bool          `json:"independent_service"`
+	Traffic            TrafficStatus `json:"traffic"`
+	Access             AccessStatus  `json:"access"`
+}
+
+//AccessStatus is the floor security of the elevator
+type AccessStatus struct {
+	//Secured are the floors secured now
+	Secured []int `json:"secured"`
+	//Granted is set while a credential gives access to the secured floors
+	Granted bool `json:"granted"`
+}
+
+//TrafficStatus is the traffic mode of the elevator
+type TrafficStatus struct {
+	Mode string `json:"mode"`
+	//Override is the traffic mode set manually, if any
+	Override string `json:"override,omitempty"`
+}
+
+//FireStatus is the fire service state of the elevator
+type FireStatus struct {
+	Recall      bool `json:"recall"`
+	RecallFloor int  `json:"recall_floor"`
+	PhaseII     bool `json:"phase_ii"`
+}
+
+//IndependentServiceCommand takes this elevator out of the group or returns it
+type IndependentServiceCommand struct {
+	Active bool `json:"active"`
+}
+
+//FireRecallCommand starts or resets fire service Phase I for the whole building.
+//The configured recall floor is used if Floor is not set.
+type FireRecallCommand struct {
+	Active bool `json:"active"`
+	Floor  *int `json:"floor,omitempty"`
+}
+
+//FirePhaseIICommand starts or ends fire service Phase II for this elevator
+type FirePhaseIICommand struct {
+	Active bool `json:"active"`
+}
+
+//TrafficModeCommand sets the traffic mode of the whole building.
+//An empty mode removes the override, so the schedule or the configured mode is used again.
+type TrafficModeCommand struct {
+	Mode string `json:"mode"`
+}
+
+//CredentialCommand presents a credential, giving access to the secured floors if the card is authorized
+type CredentialCommand struct {
+	Card int `json:"card"`
+}
+
+//CancelOrderCommand cancels a call pressed by mistake. Button is "up" or "down" to cancel the hall call
+//for the whole building, or "cab" to cancel the cab call of this elevator.
+type CancelOrderCommand struct {
+	Floor  int    `json:"floor"`
+	Button string `json:"button"`
+}
+
+//FireDoorCommand opens or closes the doors in fire service Phase II
+type FireDoorCommand struct {
+	Open bool `json:"open"`
+}
+
+//handleAdminRequest executes a command from the admin interface and replies with the status
+func handleAdminRequest(ctx context.Context, req AdminRequest, orders *schedOrders, elevatorStatus common.ElevatorStatus, coord *coordinator, traffic *trafficDetector, access *accessControl, conf Config) {
+	var err error
+	switch cmd := req.Command.(type) {
+	case nil:
+	case IndependentServiceCommand:
+		setIndependentService(orders, cmd.Active, conf.Logger)
+	case FireRecallCommand:
+		err = startFireRecall(ctx, orders, cmd, conf)
+	case FirePhaseIICommand:
+		err = setFirePhaseII(orders, cmd.Active, elevatorStatus, conf.Logger)
+	case FireDoorCommand:
+		err = operateFireDoors(ctx, orders, cmd.Open, conf)
+	case TrafficModeCommand:
+		err = setTrafficOverride(ctx, orders, cmd.Mode, conf)
+	case CancelOrderCommand:
+		switch cmd.Button {
+		case "cab":
+			err = cancelCabOrder(orders, cmd.Floor, "the admin interface", conf)
+		case "up":
+			err = cancelHallOrder(ctx, orders, common.Order{Floor: cmd.Floor, Dir: common.UpDir}, coord, conf)
+		case "down":
+			err = cancelHallOrder(ctx, orders, common.Order{Floor: cmd.Floor, Dir: common.DownDir}, coord, conf)
+		default:
+			err = fmt.Errorf("unknown button %q, expected up, down or cab", cmd.Button)
+		}
+	case CredentialCommand:
+		err = access.grant(common.Credential{Card: cmd.Card}, time.Now(), conf)
+	default:
+		err = fmt.Errorf("unknown command %T", req.Command)
+	}
+	status := Status{
+		ID:          conf.ElevatorID,
+		Floor:       elevatorStatus.Floor,
+		Moving:      elevatorStatus.Moving,
+		Load:        elevatorStatus.Load,
+		Full:        elevatorStatus.Full,
+		Coordinator: coord.current.LeaderID,
+		Fire: FireStatus{
+			Recall:      fireRecallActive(orders),
+			RecallFloor: conf.RecallFloor,
+			PhaseII:     orders.FirePhaseII,
+		},
+		IndependentService: orders.IndependentService,
+		Traffic:            TrafficStatus{Mode: traffic.mode(orders, time.Now(), conf)},
+		Access:             AccessStatus{Secured: securedFloors(time.Now(), conf), Granted: access.granted(time.Now())},
+	}
+	if orders.FireRecall != nil {
+		status.Fire.RecallFloor = orders.FireRecall.Floor
+	}
+	if orders.TrafficOverride != nil {
+		status.Traffic.Override = orders.TrafficOverride.Mode
+	}
+	//The reply channel is buffered
+	req.Reply <- AdminReply{Status: status, Err: err}
+}
@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
+)
+
+//doublePressWindow is the longest time between two presses of a lit cab button cancelling the cab call
+const doublePressWindow = time.Second
+
+//pressDetector detects double presses of the lit cab buttons
+type pressDetector struct {
+	last []time.Time
+}
+
+//newPressDetector creates a press detector for a building with the given number of floors
+func newPressDetector(numFloors int) *pressDetector {
+	return &pressDetector{last: make([]time.Time, numFloors)}
+}
+
+//doublePress records a press of a lit cab button, and returns true if it is the second press within the window
+func (p *pressDetector) doublePress(floor int, now time.Time) bool {
+	if floor < 0 || floor >= len(p.last) {
+		return false
+	}
+	if now.Sub(p.last[floor]) < doublePressWindow {
+		p.last[floor] = time.Time{}
+		return true
+	}
+	p.last[floor] = now
+	return false
+}
+
+//cancelCabOrder removes the cab order at a floor.
+//Returns an error if there is no cab order at the floor.
+func cancelCabOrder(orders *schedOrders, floor int, reason string, conf Config) error {
+	if floor < 0 || floor >= len(orders.Cab) || orders.Cab[floor] == nil {
+		return fmt.Errorf("no cab order at floor %d", floor)
+	}
+	order := orders.Cab[floor]
+	orders.Cab[floor] = nil
+	conf.Logger.With(logging.FieldOrderID, order.OrderID).Infof("Cancelled cab order at floor %d by %s", floor, reason)
+	return nil
+}
+
+//cancelHallOrder completes the active hall order at the floor and direction of order, and drops a pending request for it.
+//The completion is replicated, so the lights are turned off on all nodes.
+//Returns an error if there is no active or pending hall order.
+func cancelHallOrder(ctx context.Context, orders *schedOrders, order common.Order, coord *coordinator, conf Config) error {
+	_, pending := coord.pending[order]
+	delete(coord.pending, order)
+	existing := getHallOrder(orders, order)
+	if existing == nil || existing.completed != nil {
+		if pending {
+			conf.Logger.Infof("Cancelled pending %s request at floor %d", order.Dir, order.Floor)
+			return nil
+		}
+		return fmt.Errorf("no %s order at floor %d", order.Dir, order.Floor)
+	}
+	completedTime := time.Now()
+	completion := *existing
+	completion.CompletedAt = conf.Clock.Now()
+	//Send order completed event to network when available
+	go utilities.SendMessage(ctx, conf.OrderCompletedSend, completion)
+	existing.completed = &completedTime
+	conf.Logger.With(logging.FieldOrderID, existing.OrderID).Infof("Cancelled %s order at floor %d assigned to %d", order.Dir, order.Floor, existing.Worker)
+	return nil
+}
+
+//activeOrder returns true if the order is still active and assigned to the elevator
+func activeOrder(orders *schedOrders, order SchedulableOrder) bool {
+	var current *SchedulableOrder
+	if order.Dir == common.NoDir {
+		if order.Floor >= 0 && order.Floor < len(orders.Cab) {
+			current = orders.Cab[order.Floor]
+		}
+	} else {
+		current = getHallOrder(orders, order.Order)
+	}
+	return current != nil && current.OrderID == order.OrderID && current.Worker == order.Worker && current.completed == nil
+}
+
+//stopOrder returns a parking move to the next served floor towards the cancelled order, or to the current floor
+//if the elevator is at the floor of the order. Used to stop an elevator when the order it is executing is cancelled
+//and it has no other order.
+//The direction is taken from the cancelled order, since the status may be older than the order.
+func stopOrder(cancelled SchedulableOrder, status common.ElevatorStatus, costs *common.OrderCosts, conf Config) *SchedulableOrder {
+	floor := status.Floor
+	if cancelled.Floor != status.Floor {
+		step := 1
+		if cancelled.Floor < status.Floor {
+			step = -1
+		}
+		floor += step
+		for floor >= 0 && floor < conf.NumFloors && !costs.Serves(floor) {
+			floor += step
+		}
+		if floor < 0 || floor >= conf.NumFloors {
+			floor = nearestServedFloor(status.Floor, costs, conf.NumFloors)
+		}
+	}
+	return &SchedulableOrder{
+		Order:  common.Order{Floor: floor, Dir: common.NoDir, Park: true},
+		Worker: conf.ElevatorID,
+	}
+}
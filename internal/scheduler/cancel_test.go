@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+func TestStopOrder(t *testing.T) {
+	conf := Config{NumFloors: 5, ElevatorID: 1}
+	tests := []struct {
+		name      string
+		cancelled int
+		floor     int
+		unserved  []int
+		stop      int
+	}{
+		{"at the floor of the order", 2, 2, nil, 2},
+		{"going up", 3, 1, nil, 2},
+		{"going down", 0, 3, nil, 2},
+		{"next floor not served", 4, 1, []int{2}, 3},
+		{"no served floor above", 4, 3, []int{4}, 3},
+		{"no served floor below", 0, 1, []int{0}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cancelled := SchedulableOrder{Order: common.Order{Floor: test.cancelled, Dir: common.NoDir}, Worker: 1, OrderID: "a"}
+			status := common.ElevatorStatus{Floor: test.floor, Moving: test.floor != test.cancelled}
+			costs := &common.OrderCosts{ID: 1, Unserved: test.unserved}
+			want := &SchedulableOrder{Order: common.Order{Floor: test.stop, Dir: common.NoDir, Park: true}, Worker: 1}
+			if order := stopOrder(cancelled, status, costs, conf); !reflect.DeepEqual(order, want) {
+				t.Errorf("got stop %+v, want %+v", order, want)
+			}
+		})
+	}
+}
+
+func TestPressDetectorDoublePress(t *testing.T) {
+	//Every step presses a lit cab button at a time after the start
+	type press struct {
+		floor  int
+		at     time.Duration
+		double bool
+	}
+	tests := []struct {
+		name    string
+		presses []press
+	}{
+		{"single press", []press{{1, 0, false}}},
+		{"double press", []press{{1, 0, false}, {1, 500 * time.Millisecond, true}}},
+		{"presses too far apart", []press{{1, 0, false}, {1, doublePressWindow, false}, {1, 2 * doublePressWindow, false}}},
+		{"third press starts again", []press{{1, 0, false}, {1, 100 * time.Millisecond, true}, {1, 200 * time.Millisecond, false}, {1, 300 * time.Millisecond, true}}},
+		{"floors are independent", []press{{1, 0, false}, {2, 100 * time.Millisecond, false}, {1, 200 * time.Millisecond, true}, {3, 300 * time.Millisecond, false}}},
+		{"invalid floors", []press{{-1, 0, false}, {-1, 100 * time.Millisecond, false}, {4, 200 * time.Millisecond, false}, {4, 300 * time.Millisecond, false}}},
+	}
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newPressDetector(4)
+			for i, press := range test.presses {
+				if double := p.doublePress(press.floor, start.Add(press.at)); double != press.double {
+					t.Errorf("press %d at floor %d: got double press %t, want %t", i, press.floor, double, press.double)
+				}
+			}
+		})
+	}
+}
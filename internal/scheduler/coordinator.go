@@ -0,0 +1,238 @@
+package scheduler
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
+	"github.com/rs/xid"
+)
+
+//hallRequestTimeout is the time before an unassigned hall request is sent again
+const hallRequestTimeout = 2 * time.Second
+
+//errStaleAssignment is returned when an assignment has a lower sequence than the current one
+var errStaleAssignment = errors.New("stale assignment")
+
+//HallRequest is sent by the node where a hall button is pressed.
+//Only the coordinator assigns the order, so that all nodes apply the same sequence of assignments.
+type HallRequest struct {
+	common.Order `json:"order"`
+	RequesterID  int    `json:"requester_id"`
+	RequestID    string `json:"request_id"`
+	//Version is the newest version of the slot known by the requester.
+	//The assignment gets a higher version.
+	Version uint64 `json:"version"`
+	//Destinations are the destination floors entered at a destination dispatch keypad
+	Destinations []int `json:"destinations,omitempty"`
+	//Release is set if the requester can no longer serve the order assigned to it, and the order must be reassigned
+	Release bool `json:"release,omitempty"`
+}
+
+//pendingRequest is a hall request not yet assigned
+type pendingRequest struct {
+	sent         time.Time
+	version      uint64
+	destinations []int
+}
+
+//coordinator keeps track of which node assigns hall orders and the sequence of assignments.
+//The coordinator is the elected leader.
+type coordinator struct {
+	id int
+	//pending contains hall requests from this node not yet assigned
+	pending map[common.Order]pendingRequest
+	//current is the current leadership
+	current network.Leadership
+	//maxTerm is the highest leader term seen in leaderships or assignments
+	maxTerm uint64
+	clock   *network.Clock
+	//traffic is the traffic mode used to select elevators
+	traffic trafficPolicy
+}
+
+//newCoordinator creates a coordinator for the node with the given id. No leader is known until
+//the first leadership is received.
+func newCoordinator(id int, clock *network.Clock) *coordinator {
+	return &coordinator{
+		id:      id,
+		clock:   clock,
+		pending: make(map[common.Order]pendingRequest),
+		current: network.Leadership{LeaderID: network.NoLeader},
+	}
+}
+
+//isCoordinator returns true if this node assigns hall orders.
+//A leader stops assigning orders when it sees a higher term.
+func (c *coordinator) isCoordinator() bool {
+	return c.current.LeaderID == c.id && c.current.Term >= c.maxTerm
+}
+
+//observe records the term of an assignment made by any coordinator.
+//A pending request is answered when the assignment includes its destinations.
+func (c *coordinator) observe(order SchedulableOrder) {
+	if order.Term > c.maxTerm {
+		c.maxTerm = order.Term
+	}
+	if p, ok := c.pending[order.Order]; ok && containsFloors(order.Destinations, p.destinations) {
+		delete(c.pending, order.Order)
+	}
+}
+
+//update sets the current leadership. Returns true if the leader changed.
+func (c *coordinator) update(l network.Leadership) bool {
+	if l.Term > c.maxTerm {
+		c.maxTerm = l.Term
+	}
+	changed := l.LeaderID != c.current.LeaderID
+	c.current = l
+	return changed
+}
+
+//assign marks an order with the current term and a version higher than both the newest version of
+//its slot and minVersion
+func (c *coordinator) assign(order *SchedulableOrder, orders *schedOrders, minVersion uint64) {
+	order.Term = c.current.Term
+	order.Version = slotVersion(orders, order.Order)
+	if minVersion > order.Version {
+		order.Version = minVersion
+	}
+	order.Version++
+}
+
+//cancelPending drops all pending requests, so they are not sent again
+func (c *coordinator) cancelPending() {
+	c.pending = make(map[common.Order]pendingRequest)
+}
+
+//request sends a hall request to the coordinator.
+//The destinations are added to those of a pending request for the same order.
+func (c *coordinator) request(ctx context.Context, order common.Order, version uint64, destinations []int, send chan<- HallRequest, logger *logging.Logger) {
+	destinations = mergeFloors(c.pending[order].destinations, destinations)
+	c.pending[order] = pendingRequest{sent: time.Now(), version: version, destinations: destinations}
+	req := HallRequest{
+		Order:        order,
+		RequesterID:  c.id,
+		RequestID:    xid.New().String(),
+		Version:      version,
+		Destinations: destinations,
+	}
+	//Send request to network when available
+	go utilities.SendMessage(ctx, send, req)
+	logger.Debugf("Sent hall request %+v to coordinator %d", order, c.current.LeaderID)
+}
+
+//release asks the coordinator to reassign a hall order assigned to this elevator to another elevator.
+//The release is not resent, since the coordinator also reassigns the orders of unavailable elevators.
+func (c *coordinator) release(ctx context.Context, order SchedulableOrder, send chan<- HallRequest, logger *logging.Logger) {
+	req := HallRequest{
+		Order:        order.Order,
+		RequesterID:  c.id,
+		RequestID:    xid.New().String(),
+		Version:      order.Version,
+		Destinations: order.Destinations,
+		Release:      true,
+	}
+	//Send request to network when available
+	go utilities.SendMessage(ctx, send, req)
+	logger.With(logging.FieldOrderID, order.OrderID).Infof("Released %s order at floor %d to coordinator %d", order.Dir, order.Floor, c.current.LeaderID)
+}
+
+//resendPending sends all pending requests again, e.g. when the coordinator has changed
+func (c *coordinator) resendPending(ctx context.Context, send chan<- HallRequest, logger *logging.Logger) {
+	for order, p := range c.pending {
+		c.request(ctx, order, p.version, p.destinations, send, logger)
+	}
+}
+
+//handleHallRequest assigns a hall request to the cheapest worker.
+//Only the coordinator assigns orders. Requests for floors with an active order are answered with the
+//active order, with the destinations of the request added. A released order is assigned to another elevator.
+func (c *coordinator) handleHallRequest(ctx context.Context, orders *schedOrders, req HallRequest, workers map[int]*common.OrderCosts, sendOrder chan<- SchedulableOrder, logger *logging.Logger) error {
+	if !c.isCoordinator() {
+		return nil
+	}
+	existing := getHallOrder(orders, req.Order)
+	released := req.Release && existing != nil && existing.completed == nil && existing.Worker == req.RequesterID
+	if released {
+		workers = withoutWorker(workers, req.RequesterID)
+		req.Destinations = mergeFloors(existing.Destinations, req.Destinations)
+	} else if existing != nil && existing.completed == nil && existing.Term > 0 {
+		if containsFloors(existing.Destinations, req.Destinations) {
+			//Publish the existing assignment again so that the requester gets it
+			go utilities.SendMessage(ctx, sendOrder, *existing)
+			logger.Debugf("Request %s from %d already assigned to %d", req.RequestID, req.RequesterID, existing.Worker)
+			return nil
+		}
+		//Passengers at the same floor in the same direction share the car
+		order := *existing
+		order.Destinations = mergeFloors(existing.Destinations, req.Destinations)
+		c.assign(&order, orders, req.Version)
+		//Send new order to network when available
+		go utilities.SendMessage(ctx, sendOrder, order)
+		logger.With(logging.FieldOrderID, order.OrderID).Infof("Destinations %v added to %s order at floor %d assigned to %d", req.Destinations, order.Dir, order.Floor, order.Worker)
+		return nil
+	}
+	worker, err := selectDestinationWorker(workers, req.Order, req.Destinations, c.traffic)
+	if err != nil {
+		return err
+	}
+	order := createOrder(req.Floor, req.Dir, worker, c.clock.Now())
+	order.Destinations = req.Destinations
+	c.assign(order, orders, req.Version)
+	//Send new order to network when available
+	go utilities.SendMessage(ctx, sendOrder, *order)
+	if released {
+		logger.With(logging.FieldOrderID, order.OrderID).Infof("%s order at floor %d released by %d assigned to %d", order.Dir, order.Floor, req.RequesterID, worker)
+		return nil
+	}
+	logger.With(logging.FieldOrderID, order.OrderID).Infof("New %s order at floor %d requested by %d assigned to %d", order.Dir, order.Floor, req.RequesterID, worker)
+	return nil
+}
+
+//withoutWorker returns a copy of the workers without the elevator with the given id
+func withoutWorker(workers map[int]*common.OrderCosts, id int) map[int]*common.OrderCosts {
+	others := make(map[int]*common.OrderCosts, len(workers))
+	for k, v := range workers {
+		if k != id {
+			others[k] = v
+		}
+	}
+	return others
+}
+
+//getHallOrder returns the hall order at the floor and direction of order, or nil
+func getHallOrder(orders *schedOrders, order common.Order) *SchedulableOrder {
+	if order.Floor < 0 || order.Floor >= len(orders.HallUp) {
+		return nil
+	}
+	switch order.Dir {
+	case common.UpDir:
+		return orders.HallUp[order.Floor]
+	case common.DownDir:
+		return orders.HallDown[order.Floor]
+	}
+	return nil
+}
+
+//hallOrderActive returns true if the hall slot of the order has an active order which is not completed
+func hallOrderActive(orders *schedOrders, order common.Order) bool {
+	existing := getHallOrder(orders, order)
+	return existing != nil && existing.completed == nil
+}
+
+//resendStale sends pending requests again if they have not been assigned within the timeout.
+//The coordinator answers requests for floors with an active order by publishing the order again,
+//so every request is answered with an assignment.
+func (c *coordinator) resendStale(ctx context.Context, timeout time.Duration, send chan<- HallRequest, logger *logging.Logger) {
+	for order, p := range c.pending {
+		if time.Since(p.sent) > timeout {
+			c.request(ctx, order, p.version, p.destinations, send, logger)
+		}
+	}
+}
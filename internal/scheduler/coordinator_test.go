@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+func TestCoordinatorResendStale(t *testing.T) {
+	up := common.Order{Floor: 1, Dir: common.UpDir}
+	down := common.Order{Floor: 2, Dir: common.DownDir}
+	tests := []struct {
+		name    string
+		pending map[common.Order]pendingRequest
+		//observed are assignments received before resending
+		observed []SchedulableOrder
+		resent   []common.Order
+	}{
+		{"no pending requests", nil, nil, nil},
+		{"recent request", map[common.Order]pendingRequest{up: {sent: time.Now()}}, nil, nil},
+		{"stale request", map[common.Order]pendingRequest{up: {sent: time.Now().Add(-3 * time.Second)}}, nil, []common.Order{up}},
+		{
+			"only stale requests",
+			map[common.Order]pendingRequest{up: {sent: time.Now().Add(-3 * time.Second)}, down: {sent: time.Now()}},
+			nil,
+			[]common.Order{up},
+		},
+		{
+			"assigned request",
+			map[common.Order]pendingRequest{up: {sent: time.Now().Add(-3 * time.Second)}, down: {sent: time.Now().Add(-3 * time.Second)}},
+			[]SchedulableOrder{{Order: up, Worker: 2}},
+			[]common.Order{down},
+		},
+		{
+			"assignment without the destinations",
+			map[common.Order]pendingRequest{up: {sent: time.Now().Add(-3 * time.Second), version: 4, destinations: []int{3}}},
+			[]SchedulableOrder{{Order: up, Worker: 2, Destinations: []int{2}}},
+			[]common.Order{up},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := newCoordinator(1, nil)
+			for order, p := range test.pending {
+				c.pending[order] = p
+			}
+			for _, order := range test.observed {
+				c.observe(order)
+			}
+			send := make(chan HallRequest, 4)
+			c.resendStale(ctx, hallRequestTimeout, send, nil)
+
+			var resent []common.Order
+			for range test.resent {
+				select {
+				case req := <-send:
+					p := test.pending[req.Order]
+					if req.RequesterID != 1 || req.Version != p.version || !reflect.DeepEqual(req.Destinations, mergeFloors(nil, p.destinations)) {
+						t.Errorf("got request %+v for pending request %+v", req, p)
+					}
+					if time.Since(c.pending[req.Order].sent) > time.Second {
+						t.Errorf("sent time of %+v not updated", req.Order)
+					}
+					resent = append(resent, req.Order)
+				case <-time.After(time.Second):
+					t.Fatalf("got %d requests, want %d", len(resent), len(test.resent))
+				}
+			}
+			select {
+			case req := <-send:
+				t.Errorf("got unexpected request %+v", req)
+			case <-time.After(50 * time.Millisecond):
+			}
+			sort.Slice(resent, func(i, j int) bool { return resent[i].Floor < resent[j].Floor })
+			if !reflect.DeepEqual(resent, test.resent) {
+				t.Errorf("resent %v, want %v", resent, test.resent)
+			}
+		})
+	}
+}
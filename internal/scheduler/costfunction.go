@@ -6,14 +6,40 @@ import (
 	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
 )
 
-func createElevatorCost(status common.ElevatorStatus, orders *schedOrders, id int) common.OrderCosts {
+//costFunction calculates the cost of every order for an elevator
+type costFunction func(status common.ElevatorStatus, orders *schedOrders, id int, cabPenalty float64) common.OrderCosts
+
+//DefaultCostFunction is the name of the cost function used if none is configured
+const DefaultCostFunction = "sweep"
+
+//costFunctions contains all cost functions by name
+var costFunctions = map[string]costFunction{
+	"sweep":    createElevatorCost,
+	"distance": createDistanceCost,
+}
+
+//ValidCostFunction returns true if a cost function with the given name exists
+func ValidCostFunction(name string) bool {
+	_, ok := costFunctions[name]
+	return ok
+}
+
+//getCostFunction returns the cost function with the given name, or the default cost function
+func getCostFunction(name string) costFunction {
+	if f, ok := costFunctions[name]; ok {
+		return f
+	}
+	return costFunctions[DefaultCostFunction]
+}
+
+//createElevatorCost simulates the elevator sweeping in its current direction before turning around
+func createElevatorCost(status common.ElevatorStatus, orders *schedOrders, id int, cabPenalty float64) common.OrderCosts {
 
 	//Count orders
 	orderCount := countOrdersWithID(orders, id)
 
-	//Add a small penalty to cab call so that hall orders are prioritized at the same floor
+	//A small penalty is added to cab calls so that hall orders are prioritized at the same floor
 	//Hall orders can clear cab orders, but not the other way around.
-	cabPenalty := 0.5
 	extraPenalty := 1.0
 	//Create new cost table
 	newCost := common.OrderCosts{
@@ -115,6 +141,30 @@ func createElevatorCost(status common.ElevatorStatus, orders *schedOrders, id in
 	return newCost
 }
 
+//createDistanceCost uses the distance to the floor in addition to the number of orders already assigned
+func createDistanceCost(status common.ElevatorStatus, orders *schedOrders, id int, cabPenalty float64) common.OrderCosts {
+	orderCount := countOrdersWithID(orders, id)
+	extraPenalty := 1.0
+	if status.Error {
+		extraPenalty *= 1000
+	}
+
+	newCost := common.OrderCosts{
+		ID:         id,
+		OrderCount: orderCount,
+		Cab:        make([]float64, len(orders.Cab)),
+		HallUp:     make([]float64, len(orders.HallUp)),
+		HallDown:   make([]float64, len(orders.HallDown)),
+	}
+	for i := 0; i < len(orders.Cab); i++ {
+		cost := (math.Abs(float64(i-status.Floor)) + float64(orderCount)) * extraPenalty
+		newCost.Cab[i] = cost + cabPenalty
+		newCost.HallUp[i] = cost
+		newCost.HallDown[i] = cost
+	}
+	return newCost
+}
+
 func countOrdersWithID(orders *schedOrders, id int) int {
 	orderCount := 0
 
@@ -0,0 +1,171 @@
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/internal/elevatordriver"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
+)
+
+//noCar is shown on a keypad when no car is assigned
+const noCar = -1
+
+//destinationStopCost is added to the cost of a car for every destination it does not already stop at
+const destinationStopCost = 1.0
+
+//validDestinationCall returns an error if the floors of a destination call are invalid
+func validDestinationCall(call common.DestinationCall, numFloors int) error {
+	if call.Origin < 0 || call.Origin >= numFloors || call.Destination < 0 || call.Destination >= numFloors {
+		return fmt.Errorf("floors out of range")
+	}
+	if call.Origin == call.Destination {
+		return fmt.Errorf("the destination is the origin")
+	}
+	return nil
+}
+
+//containsFloors returns true if all floors are in the list
+func containsFloors(list []int, floors []int) bool {
+	for _, floor := range floors {
+		found := false
+		for _, f := range list {
+			if f == floor {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//mergeFloors returns a new sorted list with the floors of both lists
+func mergeFloors(a []int, b []int) []int {
+	merged := append([]int{}, a...)
+	for _, floor := range b {
+		if !containsFloors(merged, []int{floor}) {
+			merged = append(merged, floor)
+		}
+	}
+	sort.Ints(merged)
+	return merged
+}
+
+//destinationStops returns the floors the elevator will stop at to let passengers off,
+//from its cab orders and the destinations of its hall orders
+func destinationStops(orders *schedOrders, id int) []int {
+	stops := []int{}
+	for floor, order := range orders.Cab {
+		if order != nil {
+			stops = append(stops, floor)
+		}
+	}
+	for _, order := range append(append([]*SchedulableOrder{}, orders.HallUp...), orders.HallDown...) {
+		if order != nil && order.Worker == id && order.completed == nil {
+			stops = mergeFloors(stops, order.Destinations)
+		}
+	}
+	sort.Ints(stops)
+	return stops
+}
+
+//destinationCost extends the cost of a hall order with the extra stops needed for the destinations,
+//so passengers with the same destinations are grouped in the same car.
+//The cost is infinite if the elevator does not serve the origin or a destination.
+func destinationCost(costs *common.OrderCosts, order common.Order, destinations []int) float64 {
+	if !costs.Serves(order.Floor) {
+		return math.Inf(1)
+	}
+	cost := costs.HallUp[order.Floor]
+	if order.Dir == common.DownDir {
+		cost = costs.HallDown[order.Floor]
+	}
+	for _, floor := range destinations {
+		if !costs.Serves(floor) {
+			return math.Inf(1)
+		}
+		if !containsFloors(costs.Stops, []int{floor}) {
+			cost += destinationStopCost
+		}
+	}
+	return cost
+}
+
+//selectDestinationWorker selects the elevator with the lowest destination cost.
+//Hall orders without destinations are selected by selectWorker.
+//Returns errNoAvailableWorker if no elevator is available and serves all the floors.
+func selectDestinationWorker(workers map[int]*common.OrderCosts, order common.Order, destinations []int, traffic trafficPolicy) (int, error) {
+	if len(destinations) == 0 {
+		return selectWorker(workers, order.Floor, order.Dir, traffic)
+	}
+	minCost := math.Inf(1)
+	worker := -1
+	for _, v := range workers {
+		if v.Unavailable {
+			continue
+		}
+		if cost := destinationCost(v, order, destinations) * traffic.weight(v, order); cost < minCost || (cost == minCost && v.ID < worker) {
+			worker = v.ID
+			minCost = cost
+		}
+	}
+	if worker == -1 {
+		return -1, errNoAvailableWorker
+	}
+	return worker, nil
+}
+
+//handleDestinationCall requests a hall order for a destination call from the coordinator.
+//The hall order is at the origin in the direction of the destination, and is replicated and reassigned like any other.
+//If a car is already assigned to the origin and direction with the destination, it is announced at once.
+func handleDestinationCall(ctx context.Context, call common.DestinationCall, orders *schedOrders, coord *coordinator, conf Config) error {
+	if err := validDestinationCall(call, conf.NumFloors); err != nil {
+		return err
+	}
+	order := call.Order()
+	destinations := []int{call.Destination}
+	if existing := getHallOrder(orders, order); existing != nil && existing.completed == nil && containsFloors(existing.Destinations, destinations) {
+		announceCar(ctx, *existing, conf)
+		return nil
+	}
+	coord.request(ctx, order, slotVersion(orders, order), destinations, conf.HallRequestSend, conf.Logger)
+	return nil
+}
+
+//announceCar shows the car assigned to a hall order with destinations on the keypad at the origin
+func announceCar(ctx context.Context, order SchedulableOrder, conf Config) {
+	if len(order.Destinations) == 0 || conf.KeypadDisplay == nil {
+		return
+	}
+	//Send to the driver when available
+	go utilities.SendMessage(ctx, conf.KeypadDisplay, elevatordriver.KeypadDisplay{Floor: order.Floor, Car: order.Worker})
+}
+
+//boardPassengers adds the destinations of a hall order picked up by this elevator as cab orders.
+//Passengers waiting at the same floor in the same direction share the order and its destinations.
+func boardPassengers(orders *schedOrders, order *SchedulableOrder, conf Config) {
+	for _, floor := range order.Destinations {
+		if floor < 0 || floor >= len(orders.Cab) || orders.Cab[floor] != nil {
+			continue
+		}
+		orders.Cab[floor] = createOrder(floor, common.NoDir, conf.ElevatorID, conf.Clock.Now())
+		conf.Logger.With(logging.FieldOrderID, order.OrderID).Infof("Passengers from floor %d boarded to floor %d", order.Floor, floor)
+	}
+}
+
+//clearKeypad removes the car from the keypad at the origin when a hall order with destinations is completed
+func clearKeypad(ctx context.Context, order SchedulableOrder, conf Config) {
+	if len(order.Destinations) == 0 || conf.KeypadDisplay == nil {
+		return
+	}
+	//Send to the driver when available
+	go utilities.SendMessage(ctx, conf.KeypadDisplay, elevatordriver.KeypadDisplay{Floor: order.Floor, Car: noCar})
+}
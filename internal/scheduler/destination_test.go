@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+func TestSelectDestinationWorker(t *testing.T) {
+	up := common.Order{Floor: 1, Dir: common.UpDir}
+	tests := []struct {
+		name         string
+		workers      map[int]*common.OrderCosts
+		destinations []int
+		worker       int
+		err          error
+	}{
+		{
+			name: "cheapest without destinations",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 1, 2, 0}, Stops: []int{3}},
+				2: {ID: 2, HallUp: []float64{0, 0.5, 2, 0}},
+			},
+			worker: 2,
+		},
+		{
+			name: "grouped with the same destination",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 1, 2, 0}, Stops: []int{3}},
+				2: {ID: 2, HallUp: []float64{0, 0.5, 2, 0}},
+			},
+			destinations: []int{3},
+			worker:       1,
+		},
+		{
+			name: "extra stop cheaper than the origin cost",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 1, 2, 0}, Stops: []int{3}},
+				2: {ID: 2, HallUp: []float64{0, 0.5, 2, 0}},
+			},
+			destinations: []int{2},
+			worker:       2,
+		},
+		{
+			name: "equal costs select the lowest id",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 0.5, 2, 0}},
+				2: {ID: 2, HallUp: []float64{0, 0.5, 2, 0}},
+				3: {ID: 3, HallUp: []float64{0, 0.5, 2, 0}},
+			},
+			destinations: []int{3},
+			worker:       1,
+		},
+		{
+			name: "destination not served",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 0, 2, 0}, Unserved: []int{2}},
+				2: {ID: 2, HallUp: []float64{0, 3, 2, 0}},
+			},
+			destinations: []int{2},
+			worker:       2,
+		},
+		{
+			name: "unavailable elevator",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 0, 2, 0}, Stops: []int{3}, Unavailable: true},
+				2: {ID: 2, HallUp: []float64{0, 3, 2, 0}},
+			},
+			destinations: []int{3},
+			worker:       2,
+		},
+		{
+			name: "no elevator serves the destination",
+			workers: map[int]*common.OrderCosts{
+				1: {ID: 1, HallUp: []float64{0, 0, 2, 0}, Unserved: []int{3}},
+				2: {ID: 2, HallUp: []float64{0, 0, 2, 0}, Unavailable: true},
+			},
+			destinations: []int{3},
+			worker:       -1,
+			err:          errNoAvailableWorker,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			worker, err := selectDestinationWorker(test.workers, up, test.destinations, trafficPolicy{mode: TrafficNormal})
+			if worker != test.worker || err != test.err {
+				t.Errorf("got elevator %d and error %v, want %d and %v", worker, err, test.worker, test.err)
+			}
+		})
+	}
+}
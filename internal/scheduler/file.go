@@ -2,11 +2,14 @@ package scheduler
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
 	"os"
 )
 
+//errCorruptOrdersFile is returned if the order file can be read, but does not contain valid orders
+var errCorruptOrdersFile = errors.New("corrupt orders file")
+
 //Turning an array of orders into json format before saving to a file. Saves to temporary file before
 //overwriting to make sure no data is lost if an error occurs
 func saveToOrdersFile(filePath string, currentOrders *schedOrders) error {
@@ -28,7 +31,8 @@ func saveToOrdersFile(filePath string, currentOrders *schedOrders) error {
 }
 
 //Reads orders from a file and turn them back into an array of Order type from json format
-func readFromOrdersFile(filePath string) (*schedOrders, error) {
+//Returns errCorruptOrdersFile if the content is invalid
+func readFromOrdersFile(filePath string, numFloors int) (*schedOrders, error) {
 	//Opens the json file and saves it to the variable jsonOrders
 	jsonOrders, err := os.Open(filePath)
 	if err != nil {
@@ -47,21 +51,33 @@ func readFromOrdersFile(filePath string) (*schedOrders, error) {
 	//If successfully read from the file, the content of the jsonContent variable is unmarshalled and put back into original form in the orderList
 	err = json.Unmarshal(jsonContent, &orderlist)
 	if err != nil {
-		return nil, err
+		return nil, errCorruptOrdersFile
+	}
+
+	//Orders are indexed by floor - the file must match the number of floors
+	if len(orderlist.HallUp) != numFloors || len(orderlist.HallDown) != numFloors || len(orderlist.Cab) != numFloors {
+		return nil, errCorruptOrdersFile
+	}
+	//Files from older versions have no completed orders
+	if orderlist.HallUpDone == nil && orderlist.HallDownDone == nil {
+		orderlist.HallUpDone = make([]*SchedulableOrder, numFloors)
+		orderlist.HallDownDone = make([]*SchedulableOrder, numFloors)
+	}
+	if len(orderlist.HallUpDone) != numFloors || len(orderlist.HallDownDone) != numFloors {
+		return nil, errCorruptOrdersFile
 	}
 	return &orderlist, nil
 }
 
 //Checks if the file of orders exists
-func fileExists(filePath string) bool {
+func fileExists(filePath string) (bool, error) {
 	if _, err := os.Stat(filePath); err == nil {
-		return true
+		return true, nil
 	} else if os.IsNotExist(err) {
-		return false
+		return false, nil
 	} else {
-		log.Panicf("Unknown error: %s\n", err)
+		return false, err
 	}
-	return false
 }
 
 //Deletes orders from the filepath
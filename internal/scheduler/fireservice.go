@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
+
+	"github.com/TTK4145/driver-go/elevio"
+)
+
+var errNotRecalled = errors.New("phase II requires the elevators to be recalled")
+var errNotAtRecallFloor = errors.New("the elevator must stand still at the recall floor")
+var errNotPhaseII = errors.New("the doors are only operated manually in phase II")
+
+//FireRecall is the fire service Phase I state of the building, sent on the fire recall topic.
+//It is replicated as a last-writer-wins register ordered by the hybrid logical clock.
+type FireRecall struct {
+	Active bool `json:"active"`
+	//Floor is the floor the elevators are recalled to
+	Floor    int `json:"floor"`
+	SenderID int `json:"sender_id"`
+	//Timestamp is the hybrid logical clock time the recall was started or reset
+	Timestamp network.Timestamp `json:"timestamp"`
+}
+
+//newer returns true if the recall state r replaces the state other
+func (r FireRecall) newer(other FireRecall) bool {
+	if r.Timestamp != other.Timestamp {
+		return other.Timestamp.Before(r.Timestamp)
+	}
+	return r.SenderID > other.SenderID
+}
+
+//fireRecallActive returns true if the elevators are recalled
+func fireRecallActive(orders *schedOrders) bool {
+	return orders.FireRecall != nil && orders.FireRecall.Active
+}
+
+//inFireService returns true if the elevators are recalled or this elevator is operated by a firefighter
+func inFireService(orders *schedOrders) bool {
+	return fireRecallActive(orders) || orders.FirePhaseII
+}
+
+//mergeFireRecall merges a recall state into the orders.
+//Returns true if the state changed, and false if the current state is the same or newer.
+func mergeFireRecall(orders *schedOrders, recall FireRecall) (bool, error) {
+	if recall.Floor < 0 || recall.Floor >= len(orders.Cab) {
+		return false, fmt.Errorf("invalid recall floor %d", recall.Floor)
+	}
+	if orders.FireRecall != nil && !recall.newer(*orders.FireRecall) {
+		return false, nil
+	}
+	orders.FireRecall = &recall
+	return true, nil
+}
+
+//applyFireRecall merges a recall state and logs when the recall is started or reset
+func applyFireRecall(orders *schedOrders, recall FireRecall, logger *logging.Logger) error {
+	wasActive := fireRecallActive(orders)
+	changed, err := mergeFireRecall(orders, recall)
+	if err != nil || !changed {
+		return err
+	}
+	if active := fireRecallActive(orders); active && !wasActive {
+		logger.Warnf("Fire service phase I started by %d, recalling to floor %d", recall.SenderID, recall.Floor)
+	} else if !active && wasActive {
+		logger.Infof("Fire service phase I reset by %d", recall.SenderID)
+	}
+	return nil
+}
+
+//startFireRecall starts or resets the recall from the admin interface, and sends it to the other nodes
+func startFireRecall(ctx context.Context, orders *schedOrders, cmd FireRecallCommand, conf Config) error {
+	floor := conf.RecallFloor
+	if cmd.Floor != nil {
+		floor = *cmd.Floor
+	}
+	recall := FireRecall{
+		Active:    cmd.Active,
+		Floor:     floor,
+		SenderID:  conf.ElevatorID,
+		Timestamp: conf.Clock.Now(),
+	}
+	if err := applyFireRecall(orders, recall, conf.Logger); err != nil {
+		return err
+	}
+	//Send recall to network when available
+	go utilities.SendMessage(ctx, conf.FireRecallSend, recall)
+	return nil
+}
+
+//setFirePhaseII starts or ends Phase II. Phase II is only started while recalled,
+//and is only changed when the elevator stands at the recall floor.
+func setFirePhaseII(orders *schedOrders, active bool, status common.ElevatorStatus, logger *logging.Logger) error {
+	if active == orders.FirePhaseII {
+		return nil
+	}
+	if active && !fireRecallActive(orders) {
+		return errNotRecalled
+	}
+	if orders.FireRecall == nil || status.Moving || status.Floor != orders.FireRecall.Floor {
+		return errNotAtRecallFloor
+	}
+	orders.FirePhaseII = active
+	if active {
+		logger.Warnf("Fire service phase II started")
+	} else {
+		logger.Infof("Fire service phase II ended")
+	}
+	return nil
+}
+
+//operateFireDoors sends a door command from the firefighter to the elevator
+func operateFireDoors(ctx context.Context, orders *schedOrders, open bool, conf Config) error {
+	if !orders.FirePhaseII {
+		return errNotPhaseII
+	}
+	cmd := common.CloseDoors
+	if open {
+		cmd = common.OpenDoors
+	}
+	go utilities.SendMessage(ctx, conf.ElevDoorCommand, cmd)
+	return nil
+}
+
+//cancelOrdersForFireService cancels the orders not served in fire service.
+//Hall orders are completed while the elevators are recalled, so they are removed on all nodes,
+//and pending hall requests are dropped. Cab calls are cancelled unless in Phase II.
+func cancelOrdersForFireService(ctx context.Context, orders *schedOrders, coord *coordinator, conf Config) {
+	if !fireRecallActive(orders) {
+		return
+	}
+	coord.cancelPending()
+	completedTime := time.Now()
+	for _, order := range append(append([]*SchedulableOrder{}, orders.HallUp...), orders.HallDown...) {
+		if order == nil || order.completed != nil {
+			continue
+		}
+		completion := *order
+		completion.CompletedAt = conf.Clock.Now()
+		//Send order completed event to network when available
+		go utilities.SendMessage(ctx, conf.OrderCompletedSend, completion)
+		order.completed = &completedTime
+		conf.Logger.With(logging.FieldOrderID, order.OrderID).Infof("Cancelled %s order at floor %d for fire service", order.Dir, order.Floor)
+	}
+	if orders.FirePhaseII {
+		return
+	}
+	for floor, order := range orders.Cab {
+		if order != nil {
+			orders.Cab[floor] = nil
+			conf.Logger.With(logging.FieldOrderID, order.OrderID).Infof("Cancelled cab order at floor %d for fire service", floor)
+		}
+	}
+}
+
+//fireServiceAccepts returns false if presses on the button are ignored in fire service.
+//Hall buttons do not work while the elevators are recalled, and cab buttons only work in Phase II.
+func fireServiceAccepts(orders *schedOrders, button elevio.ButtonType) bool {
+	if button == elevio.BT_Cab {
+		return !fireRecallActive(orders) || orders.FirePhaseII
+	}
+	return !fireRecallActive(orders)
+}
+
+//fireServiceOrder returns the next order in fire service.
+//In Phase II the cheapest cab call is served, otherwise the elevator goes to the recall floor.
+func fireServiceOrder(orders *schedOrders, cost *common.OrderCosts, id int) *SchedulableOrder {
+	if orders.FirePhaseII {
+		return getCheapestCabOrder(orders, cost, id)
+	}
+	return &SchedulableOrder{
+		Order:  common.Order{Floor: orders.FireRecall.Floor, Dir: common.NoDir},
+		Worker: id,
+	}
+}
+
+//fireServiceDoorMode returns how the doors are operated.
+//Recalled elevators hold the doors open once they stand at the recall floor, and operate them automatically on the way.
+func fireServiceDoorMode(orders *schedOrders, status common.ElevatorStatus) common.DoorMode {
+	if orders.FirePhaseII {
+		return common.DoorManual
+	}
+	if fireRecallActive(orders) && status.Floor == orders.FireRecall.Floor && !status.Moving {
+		return common.DoorHoldOpen
+	}
+	return common.DoorAutomatic
+}
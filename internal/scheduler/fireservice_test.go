@@ -0,0 +1,32 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+func TestFireServiceDoorMode(t *testing.T) {
+	recall := &FireRecall{Active: true, Floor: 1}
+	tests := []struct {
+		name   string
+		orders schedOrders
+		status common.ElevatorStatus
+		mode   common.DoorMode
+	}{
+		{"normal operation", schedOrders{}, common.ElevatorStatus{Floor: 1}, common.DoorAutomatic},
+		{"reset recall", schedOrders{FireRecall: &FireRecall{Floor: 1}}, common.ElevatorStatus{Floor: 1}, common.DoorAutomatic},
+		{"recalled at another floor", schedOrders{FireRecall: recall}, common.ElevatorStatus{Floor: 3}, common.DoorAutomatic},
+		{"recalled passing the recall floor", schedOrders{FireRecall: recall}, common.ElevatorStatus{Floor: 1, Moving: true}, common.DoorAutomatic},
+		{"recalled at the recall floor", schedOrders{FireRecall: recall}, common.ElevatorStatus{Floor: 1}, common.DoorHoldOpen},
+		{"phase II", schedOrders{FirePhaseII: true}, common.ElevatorStatus{Floor: 3}, common.DoorManual},
+		{"phase II while recalled", schedOrders{FireRecall: recall, FirePhaseII: true}, common.ElevatorStatus{Floor: 1}, common.DoorManual},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if mode := fireServiceDoorMode(&test.orders, test.status); mode != test.mode {
+				t.Errorf("got door mode %s, want %s", mode, test.mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//newerState returns true if the state a is ordered after the state b.
+//States are ordered by leader term, version, completions before assignments, clock time and order id.
+func newerState(a SchedulableOrder, aCompleted bool, b SchedulableOrder, bCompleted bool) bool {
+	if a.Term != b.Term {
+		return a.Term > b.Term
+	}
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	if aCompleted != bCompleted {
+		return aCompleted
+	}
+	aStamp, bStamp := a.Timestamp, b.Timestamp
+	if aCompleted {
+		aStamp, bStamp = a.CompletedAt, b.CompletedAt
+	}
+	if aStamp != bStamp {
+		return bStamp.Before(aStamp)
+	}
+	return a.OrderID > b.OrderID
+}
+
+//hallSlots returns the slices of active and completed orders for a direction
+func hallSlots(orders *schedOrders, dir common.Direction) ([]*SchedulableOrder, []*SchedulableOrder, error) {
+	switch dir {
+	case common.UpDir:
+		return orders.HallUp, orders.HallUpDone, nil
+	case common.DownDir:
+		return orders.HallDown, orders.HallDownDone, nil
+	}
+	return nil, nil, fmt.Errorf("no hall slot for direction %s", dir)
+}
+
+//slotVersion returns the newest version of a hall slot
+func slotVersion(orders *schedOrders, order common.Order) uint64 {
+	active, done, err := hallSlots(orders, order.Dir)
+	if err != nil || order.Floor < 0 || order.Floor >= len(active) {
+		return 0
+	}
+	var version uint64
+	if active[order.Floor] != nil {
+		version = active[order.Floor].Version
+	}
+	if done[order.Floor] != nil && done[order.Floor].Version > version {
+		version = done[order.Floor].Version
+	}
+	return version
+}
+
+//mergeHallOrder merges an assignment or a completion into its slot, which keeps the newest completion
+//as a tombstone and the newest assignment if it is newer than the tombstone.
+//Returns true if the slot changed, and false if the slot already has the same or a newer state.
+func mergeHallOrder(orders *schedOrders, order SchedulableOrder, completed bool) (bool, error) {
+	active, done, err := hallSlots(orders, order.Dir)
+	if err != nil {
+		return false, err
+	}
+	if order.Floor < 0 || order.Floor >= len(active) {
+		return false, fmt.Errorf("invalid floor %d", order.Floor)
+	}
+	if d := done[order.Floor]; d != nil && !newerState(order, completed, *d, true) {
+		return false, nil
+	}
+	if completed {
+		done[order.Floor] = &order
+		//The active assignment is kept if it is newer than the completion
+		if a := active[order.Floor]; a != nil && !newerState(*a, false, order, true) {
+			active[order.Floor] = nil
+		}
+		return true, nil
+	}
+	if a := active[order.Floor]; a != nil && !newerState(order, false, *a, false) {
+		return false, nil
+	}
+	active[order.Floor] = &order
+	return true, nil
+}
@@ -0,0 +1,184 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+)
+
+//hallUpdate is an assignment or a completion received from the network
+type hallUpdate struct {
+	order     SchedulableOrder
+	completed bool
+}
+
+func assignment(floor int, dir common.Direction, version uint64, wall int64, worker int, id string) hallUpdate {
+	return hallUpdate{order: SchedulableOrder{
+		Order:     common.Order{Floor: floor, Dir: dir},
+		Worker:    worker,
+		Timestamp: network.Timestamp{Wall: wall},
+		OrderID:   id,
+		Version:   version,
+	}}
+}
+
+func completion(a hallUpdate, wall int64) hallUpdate {
+	a.order.CompletedAt = network.Timestamp{Wall: wall}
+	a.completed = true
+	return a
+}
+
+func withTerm(u hallUpdate, term uint64) hallUpdate {
+	u.order.Term = term
+	return u
+}
+
+//permutations returns every order of the updates
+func permutations(updates []hallUpdate) [][]hallUpdate {
+	if len(updates) <= 1 {
+		return [][]hallUpdate{updates}
+	}
+	var result [][]hallUpdate
+	for i := range updates {
+		rest := make([]hallUpdate, 0, len(updates)-1)
+		rest = append(rest, updates[:i]...)
+		rest = append(rest, updates[i+1:]...)
+		for _, p := range permutations(rest) {
+			result = append(result, append([]hallUpdate{updates[i]}, p...))
+		}
+	}
+	return result
+}
+
+//mergeAll merges the updates into empty hall slots
+func mergeAll(t *testing.T, updates []hallUpdate) schedOrders {
+	t.Helper()
+	const floors = 4
+	orders := schedOrders{
+		HallUp:       make([]*SchedulableOrder, floors),
+		HallDown:     make([]*SchedulableOrder, floors),
+		HallUpDone:   make([]*SchedulableOrder, floors),
+		HallDownDone: make([]*SchedulableOrder, floors),
+	}
+	for _, u := range updates {
+		if _, err := mergeHallOrder(&orders, u.order, u.completed); err != nil {
+			t.Fatalf("merge %+v: %s", u, err)
+		}
+	}
+	return orders
+}
+
+func TestMergeHallOrderConverges(t *testing.T) {
+	first := assignment(1, common.UpDir, 1, 100, 1, "a")
+	second := assignment(1, common.UpDir, 2, 300, 2, "c")
+	//The leader of term 2 assigns the slot while the deposed leader of term 1 keeps assigning it
+	newLeader := withTerm(assignment(1, common.UpDir, 1, 150, 2, "b"), 2)
+	deposed := withTerm(assignment(1, common.UpDir, 2, 200, 1, "d"), 1)
+	tests := []struct {
+		name    string
+		updates []hallUpdate
+		//active and done are the expected states of the up slot at floor 1
+		active *hallUpdate
+		done   *hallUpdate
+	}{
+		{
+			name:    "assignment and completion",
+			updates: []hallUpdate{first, completion(first, 200)},
+			done:    &hallUpdate{completion(first, 200).order, true},
+		},
+		{
+			name:    "equal versions with different owners",
+			updates: []hallUpdate{first, assignment(1, common.UpDir, 1, 150, 2, "b")},
+			active:  &hallUpdate{assignment(1, common.UpDir, 1, 150, 2, "b").order, false},
+		},
+		{
+			name:    "equal versions and times with different owners",
+			updates: []hallUpdate{first, assignment(1, common.UpDir, 1, 100, 2, "b")},
+			active:  &hallUpdate{assignment(1, common.UpDir, 1, 100, 2, "b").order, false},
+		},
+		{
+			name:    "completions of equal versions from different owners",
+			updates: []hallUpdate{first, assignment(1, common.UpDir, 1, 150, 2, "b"), completion(first, 200), completion(assignment(1, common.UpDir, 1, 150, 2, "b"), 250)},
+			done:    &hallUpdate{completion(assignment(1, common.UpDir, 1, 150, 2, "b"), 250).order, true},
+		},
+		{
+			name:    "completion against a newer assignment",
+			updates: []hallUpdate{first, completion(first, 200), second},
+			active:  &second,
+			done:    &hallUpdate{completion(first, 200).order, true},
+		},
+		{
+			name:    "assignments from different terms",
+			updates: []hallUpdate{withTerm(first, 1), newLeader, deposed},
+			active:  &newLeader,
+		},
+		{
+			name:    "completion from a deposed leader",
+			updates: []hallUpdate{withTerm(first, 1), newLeader, deposed, completion(deposed, 250)},
+			active:  &newLeader,
+			done:    &hallUpdate{completion(deposed, 250).order, true},
+		},
+		{
+			name:    "completion from a newer term",
+			updates: []hallUpdate{deposed, newLeader, completion(newLeader, 400), completion(deposed, 250)},
+			done:    &hallUpdate{completion(newLeader, 400).order, true},
+		},
+		{
+			name:    "completion of both assignments",
+			updates: []hallUpdate{first, completion(first, 200), second, completion(second, 400)},
+			done:    &hallUpdate{completion(second, 400).order, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//Orders at other slots are merged as well, and must not be affected
+			other := assignment(1, common.DownDir, 1, 100, 3, "z")
+			updates := append([]hallUpdate{other}, test.updates...)
+			var want *schedOrders
+			for _, p := range permutations(updates) {
+				//Every update is received twice, also after the others
+				got := mergeAll(t, append(p, p...))
+				if want == nil {
+					want = &got
+					continue
+				}
+				if !reflect.DeepEqual(got, *want) {
+					t.Fatalf("merging %+v gives %+v, but another order gives %+v", p, got, *want)
+				}
+			}
+			checkSlot(t, "other", want.HallDown[1], &other)
+			checkSlot(t, "active", want.HallUp[1], test.active)
+			checkSlot(t, "completed", want.HallUpDone[1], test.done)
+		})
+	}
+}
+
+func checkSlot(t *testing.T, name string, got *SchedulableOrder, want *hallUpdate) {
+	t.Helper()
+	switch {
+	case want == nil && got != nil:
+		t.Errorf("got %s order %+v, want none", name, *got)
+	case want != nil && got == nil:
+		t.Errorf("got no %s order, want %+v", name, want.order)
+	case want != nil && !reflect.DeepEqual(*got, want.order):
+		t.Errorf("got %s order %+v, want %+v", name, *got, want.order)
+	}
+}
+
+func TestMergeHallOrderStale(t *testing.T) {
+	orders := mergeAll(t, []hallUpdate{assignment(2, common.DownDir, 3, 100, 1, "a")})
+	if changed, err := mergeHallOrder(&orders, assignment(2, common.DownDir, 2, 500, 2, "b").order, false); err != nil || changed {
+		t.Errorf("older version changed the slot: %t, %v", changed, err)
+	}
+	if changed, err := mergeHallOrder(&orders, assignment(2, common.DownDir, 3, 100, 1, "a").order, false); err != nil || changed {
+		t.Errorf("duplicate changed the slot: %t, %v", changed, err)
+	}
+	if _, err := mergeHallOrder(&orders, assignment(4, common.DownDir, 1, 100, 1, "c").order, false); err == nil {
+		t.Error("no error for an invalid floor")
+	}
+	if _, err := mergeHallOrder(&orders, assignment(1, common.NoDir, 1, 100, 1, "d").order, false); err == nil {
+		t.Error("no error for an order without a direction")
+	}
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+//errNoAvailableWorker is returned if hall orders can not be assigned because all elevators are unavailable
+var errNoAvailableWorker = errors.New("no available elevator")
+
+//availableForHallOrders returns true if hall orders can be assigned to this elevator
+func availableForHallOrders(orders *schedOrders) bool {
+	return !orders.IndependentService && !inFireService(orders)
+}
+
+//setIndependentService switches independent service on or off.
+//In independent service the elevator only serves its cab calls, and is unavailable for hall orders.
+func setIndependentService(orders *schedOrders, active bool, logger *logging.Logger) {
+	if active == orders.IndependentService {
+		return
+	}
+	orders.IndependentService = active
+	if active {
+		logger.Warnf("Independent service started, hall orders are released to other elevators")
+	} else {
+		logger.Infof("Independent service ended, rejoining the group")
+	}
+}
+
+//releaseHallOrders asks the coordinator to reassign the hall orders assigned to this elevator,
+//so they are not delayed until the order timeout when the elevator becomes unavailable
+func releaseHallOrders(ctx context.Context, orders *schedOrders, coord *coordinator, conf Config) {
+	for _, slots := range [][]*SchedulableOrder{orders.HallUp, orders.HallDown} {
+		for _, order := range slots {
+			if order != nil && order.completed == nil && order.Worker == conf.ElevatorID {
+				coord.release(ctx, *order, conf.HallRequestSend, conf.Logger)
+			}
+		}
+	}
+}
+
+//heldHallOrder returns true if the order sent to the elevatorcontroller is a hall order the elevator can no longer serve
+func heldHallOrder(orders *schedOrders, order SchedulableOrder) bool {
+	return order.OrderID != "" && order.Dir != common.NoDir && !availableForHallOrders(orders)
+}
@@ -0,0 +1,30 @@
+package scheduler
+
+import (
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//fullLoadPenalty multiplies the hall order costs of a full car, so hall orders are assigned to other elevators unless all are full
+const fullLoadPenalty = 100.0
+
+//applyLoadPenalty gives a full car high costs for hall orders.
+//A car is full when its load is above the bypass threshold of the elevatorcontroller.
+func applyLoadPenalty(costs *common.OrderCosts, status common.ElevatorStatus) {
+	costs.Full = status.Full
+	if !status.Full {
+		return
+	}
+	for floor := range costs.HallUp {
+		costs.HallUp[floor] *= fullLoadPenalty
+	}
+	for floor := range costs.HallDown {
+		costs.HallDown[floor] *= fullLoadPenalty
+	}
+}
+
+//workerFull returns true if the elevator with the given id is known to be full.
+//The coordinator reassigns the hall orders of a full car.
+func workerFull(workers map[int]*common.OrderCosts, id int) bool {
+	worker, ok := workers[id]
+	return ok && worker.Full
+}
@@ -0,0 +1,58 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+//nuisanceDetector keeps the number of empty stops reported by the elevatorcontroller when cab calls were last cancelled,
+//so only the empty stops after the cancellation are counted
+type nuisanceDetector struct {
+	baseline int
+}
+
+//check cancels all cab calls if they are suspected to be nuisance calls, e.g. from a child pressing every cab button.
+//With load weighing, they are suspected after NuisanceStops empty stops in a row, or if there are more than
+//CallsPerPassenger cab calls for every passenger. Each check is disabled if its limit is 0.
+//Cab calls are not cancelled when the car is operated by a firefighter or an attendant.
+func (n *nuisanceDetector) check(orders *schedOrders, status common.ElevatorStatus, conf Config) {
+	//The elevatorcontroller resets the count when passengers enter or leave, or when restarted
+	if status.EmptyStops < n.baseline {
+		n.baseline = 0
+	}
+	if !conf.LoadWeighing || orders.FirePhaseII || orders.IndependentService {
+		return
+	}
+	calls := 0
+	for _, order := range orders.Cab {
+		if order != nil {
+			calls++
+		}
+	}
+	if calls == 0 {
+		return
+	}
+	passengers := status.Passengers
+	if passengers < 1 {
+		passengers = 1
+	}
+	var reason string
+	if emptyStops := status.EmptyStops - n.baseline; conf.NuisanceStops > 0 && emptyStops >= conf.NuisanceStops {
+		reason = fmt.Sprintf("%d stops without passengers entering or leaving", emptyStops)
+	} else if conf.CallsPerPassenger > 0 && calls > conf.CallsPerPassenger*passengers {
+		reason = fmt.Sprintf("%d cab calls for %d passengers with %d%% load", calls, status.Passengers, status.Load)
+	}
+	if reason == "" {
+		return
+	}
+	conf.Logger.Warnf("Suspected nuisance cab calls after %s, cancelling all cab calls", reason)
+	for floor, order := range orders.Cab {
+		if order != nil {
+			orders.Cab[floor] = nil
+			conf.Logger.With(logging.FieldOrderID, order.OrderID).Infof("Cancelled cab order at floor %d as a nuisance call", floor)
+		}
+	}
+	n.baseline = status.EmptyStops
+}
@@ -0,0 +1,60 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+func TestNuisanceDetectorCheck(t *testing.T) {
+	enabled := Config{LoadWeighing: true, NuisanceStops: 3, CallsPerPassenger: 2}
+	tests := []struct {
+		name        string
+		conf        Config
+		independent bool
+		firePhaseII bool
+		calls       []int
+		status      common.ElevatorStatus
+		baseline    int
+		cancelled   bool
+		//after is the baseline after the check
+		after int
+	}{
+		{"no load weighing", Config{NuisanceStops: 3, CallsPerPassenger: 2}, false, false, []int{1, 2, 3}, common.ElevatorStatus{EmptyStops: 5}, 0, false, 0},
+		{"few empty stops", enabled, false, false, []int{1}, common.ElevatorStatus{EmptyStops: 2, Passengers: 1}, 0, false, 0},
+		{"empty stops", enabled, false, false, []int{1}, common.ElevatorStatus{EmptyStops: 3, Passengers: 1}, 0, true, 3},
+		{"empty stops since the cancellation", enabled, false, false, []int{1}, common.ElevatorStatus{EmptyStops: 5, Passengers: 1}, 3, false, 3},
+		{"empty stops after a reset", enabled, false, false, []int{1}, common.ElevatorStatus{EmptyStops: 1, Passengers: 1}, 3, false, 0},
+		{"empty stops disabled", Config{LoadWeighing: true, CallsPerPassenger: 2}, false, false, []int{1}, common.ElevatorStatus{EmptyStops: 10, Passengers: 1}, 0, false, 0},
+		{"too many calls", enabled, false, false, []int{1, 2, 3}, common.ElevatorStatus{Passengers: 1}, 0, true, 0},
+		{"calls for every passenger", enabled, false, false, []int{0, 1, 2, 3}, common.ElevatorStatus{Passengers: 2}, 0, false, 0},
+		{"empty car counts as a passenger", enabled, false, false, []int{1, 2}, common.ElevatorStatus{}, 0, false, 0},
+		{"too many calls in an empty car", enabled, false, false, []int{1, 2, 3}, common.ElevatorStatus{}, 0, true, 0},
+		{"calls per passenger disabled", Config{LoadWeighing: true, NuisanceStops: 3}, false, false, []int{0, 1, 2, 3}, common.ElevatorStatus{Passengers: 1}, 0, false, 0},
+		{"no cab calls", enabled, false, false, nil, common.ElevatorStatus{EmptyStops: 5}, 0, false, 0},
+		{"fire service phase II", enabled, false, true, []int{1, 2, 3}, common.ElevatorStatus{EmptyStops: 5}, 0, false, 0},
+		{"independent service", enabled, true, false, []int{1, 2, 3}, common.ElevatorStatus{EmptyStops: 5}, 0, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orders := schedOrders{Cab: make([]*SchedulableOrder, 4), IndependentService: test.independent, FirePhaseII: test.firePhaseII}
+			for _, floor := range test.calls {
+				orders.Cab[floor] = createOrder(floor, common.NoDir, 1, test.conf.Clock.Now())
+			}
+			n := nuisanceDetector{baseline: test.baseline}
+			n.check(&orders, test.status, test.conf)
+			remaining := 0
+			for _, order := range orders.Cab {
+				if order != nil {
+					remaining++
+				}
+			}
+			if cancelled := remaining == 0 && len(test.calls) > 0; cancelled != test.cancelled || (!cancelled && remaining != len(test.calls)) {
+				t.Errorf("%d of %d cab calls left, want cancelled %t", remaining, len(test.calls), test.cancelled)
+			}
+			if n.baseline != test.after {
+				t.Errorf("got baseline %d, want %d", n.baseline, test.after)
+			}
+		})
+	}
+}
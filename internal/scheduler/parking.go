@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//Parking policies
+const (
+	//ParkingNone leaves idle elevators where they stopped
+	ParkingNone = "none"
+	//ParkingLobby returns idle elevators to the lobby floor
+	ParkingLobby = "lobby"
+	//ParkingSpread divides the floors into one zone per available elevator, and parks each elevator in the middle of its zone
+	ParkingSpread = "spread"
+	//ParkingBusy parks the elevators at the floors with the most hall orders recently
+	ParkingBusy = "busy"
+	//ParkingTop returns idle elevators to the top floor
+	ParkingTop = "top"
+)
+
+//DefaultParking is the parking policy used if none is configured
+const DefaultParking = ParkingNone
+
+//demandHalfLife is the time for the recorded hall orders at a floor to count half
+const demandHalfLife = 15 * time.Minute
+
+//ValidParkingPolicy returns true if a parking policy with the given name exists
+func ValidParkingPolicy(name string) bool {
+	switch name {
+	case ParkingNone, ParkingLobby, ParkingSpread, ParkingBusy, ParkingTop:
+		return true
+	}
+	return false
+}
+
+//parker keeps track of how long the elevator has been idle, and of the recent hall orders at every floor
+type parker struct {
+	idleSince time.Time
+	//demand is the number of hall orders at each floor, decaying with demandHalfLife
+	demand  []float64
+	decayed time.Time
+}
+
+//newParker creates a parker for a building with the given number of floors
+func newParker(numFloors int) *parker {
+	return &parker{
+		idleSince: time.Now(),
+		demand:    make([]float64, numFloors),
+		decayed:   time.Now(),
+	}
+}
+
+//recordDemand records a new hall order at a floor
+func (p *parker) recordDemand(floor int) {
+	if floor < 0 || floor >= len(p.demand) {
+		return
+	}
+	p.decay()
+	p.demand[floor]++
+}
+
+//decay reduces the recorded demand by the time passed since the last decay
+func (p *parker) decay() {
+	factor := math.Pow(0.5, float64(time.Since(p.decayed))/float64(demandHalfLife))
+	for i := range p.demand {
+		p.demand[i] *= factor
+	}
+	p.decayed = time.Now()
+}
+
+//busy marks the elevator as busy, so it is not parked until it has been idle for the parking delay
+func (p *parker) busy() {
+	p.idleSince = time.Now()
+}
+
+//order returns the parking move for an idle elevator with the given policy, or nil if it should stay where it is
+func (p *parker) order(policy string, status common.ElevatorStatus, workers map[int]*common.OrderCosts, conf Config) *SchedulableOrder {
+	if policy == ParkingNone || time.Since(p.idleSince) < conf.ParkingDelay || status.Error {
+		return nil
+	}
+	//Unavailable elevators are not parked, and do not take part in the spreading
+	ids := []int{}
+	for id, costs := range workers {
+		if !costs.Unavailable {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	rank := sort.SearchInts(ids, conf.ElevatorID)
+	if rank == len(ids) || ids[rank] != conf.ElevatorID {
+		return nil
+	}
+
+	//Elevators are parked at the closest floor they serve
+	floor := nearestServedFloor(p.floor(policy, rank, len(ids), conf), workers[conf.ElevatorID], conf.NumFloors)
+	if floor == status.Floor && !status.Moving {
+		return nil
+	}
+	return &SchedulableOrder{
+		Order:  common.Order{Floor: floor, Dir: common.NoDir, Park: true},
+		Worker: conf.ElevatorID,
+	}
+}
+
+//floor returns the parking floor of the elevator with the given rank among the available elevators.
+//Every node ranks the elevators from the same costs, so the elevators spread out without coordinating.
+func (p *parker) floor(policy string, rank int, available int, conf Config) int {
+	switch policy {
+	case ParkingLobby:
+		return conf.LobbyFloor
+	case ParkingTop:
+		return conf.NumFloors - 1
+	case ParkingBusy:
+		p.decay()
+		floors := make([]int, 0, len(p.demand))
+		for floor, demand := range p.demand {
+			//Demand below a single order is forgotten
+			if demand >= 0.5 {
+				floors = append(floors, floor)
+			}
+		}
+		if len(floors) > 0 {
+			sort.SliceStable(floors, func(i, j int) bool {
+				return p.demand[floors[i]] > p.demand[floors[j]]
+			})
+			return floors[rank%len(floors)]
+		}
+	}
+	//Spread the elevators, also used by the busy policy until hall orders are recorded
+	return (2*rank + 1) * conf.NumFloors / (2 * available)
+}
@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParkerFloor(t *testing.T) {
+	conf := Config{NumFloors: 8, LobbyFloor: 2}
+	tests := []struct {
+		name      string
+		policy    string
+		demand    []float64
+		rank      int
+		available int
+		floor     int
+	}{
+		{"lobby", ParkingLobby, nil, 1, 2, 2},
+		{"top", ParkingTop, nil, 0, 2, 7},
+		{"spread single elevator", ParkingSpread, nil, 0, 1, 4},
+		{"spread first of two", ParkingSpread, nil, 0, 2, 2},
+		{"spread second of two", ParkingSpread, nil, 1, 2, 6},
+		{"spread last of three", ParkingSpread, nil, 2, 3, 6},
+		{"busy without demand spreads", ParkingBusy, nil, 1, 2, 6},
+		{"busy below a single order spreads", ParkingBusy, []float64{0, 0.4, 0, 0, 0, 0, 0, 0}, 0, 2, 2},
+		{"busy floor", ParkingBusy, []float64{0, 0, 0, 3, 0, 5, 0, 0}, 0, 3, 5},
+		{"second busiest floor", ParkingBusy, []float64{0, 0, 0, 3, 0, 5, 0, 0}, 1, 3, 3},
+		{"more elevators than busy floors", ParkingBusy, []float64{0, 0, 0, 3, 0, 5, 0, 0}, 2, 3, 5},
+		{"equal demand prefers the lower floor", ParkingBusy, []float64{0, 2, 0, 0, 2, 0, 0, 0}, 0, 2, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newParker(conf.NumFloors)
+			if test.demand != nil {
+				copy(p.demand, test.demand)
+			}
+			p.decayed = time.Now()
+			if floor := p.floor(test.policy, test.rank, test.available, conf); floor != test.floor {
+				t.Errorf("got floor %d, want %d", floor, test.floor)
+			}
+		})
+	}
+}
@@ -3,16 +3,17 @@ package scheduler
 import (
 	"errors"
 	"fmt"
-	"log"
 	"math"
+	"os"
 	"reflect"
-	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/HaavardM/TTK4145-Elevator/internal/elevatordriver"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
 	"github.com/rs/xid"
 
@@ -24,9 +25,18 @@ import (
 //SchedulableOrder is an order with a priority and cost
 type SchedulableOrder struct {
 	common.Order `json:"order"`
-	Worker       int       `json:"assignee"`
-	Timestamp    time.Time `json:"timestamp"`
-	OrderID      string    `json:"order_id"`
+	Worker       int `json:"assignee"`
+	//Timestamp is the hybrid logical clock time when the order was created
+	Timestamp network.Timestamp `json:"timestamp"`
+	OrderID   string            `json:"order_id"`
+	//CompletedAt is the hybrid logical clock time when the order was completed
+	CompletedAt network.Timestamp `json:"completed_at"`
+	//Term is the leader term of the coordinator assigning the order
+	Term uint64 `json:"term"`
+	//Version orders the assignments and completions of a hall slot
+	Version uint64 `json:"version"`
+	//Destinations are the floors entered by the passengers of a hall order in destination dispatch
+	Destinations []int `json:"destinations,omitempty"`
 	completed    *time.Time
 }
 
@@ -39,15 +49,98 @@ type Config struct {
 	ElevCompletedOrder <-chan common.Order
 	ElevExecuteOrder   chan<- common.Order
 	ElevStatus         <-chan common.ElevatorStatus
+	//ElevDoorMode sets how the elevator operates the doors
+	ElevDoorMode chan<- common.DoorMode
+	//ElevDoorCommand sends door commands from the firefighter in fire service Phase II
+	ElevDoorCommand chan<- common.DoorCommand
+	//ElevDestinationCall receives destinations entered at the destination dispatch keypads
+	ElevDestinationCall <-chan common.DestinationCall
+	//KeypadDisplay shows the cars assigned to destination calls. Disabled if nil.
+	KeypadDisplay chan<- elevatordriver.KeypadDisplay
+	//ElevCredential receives credentials presented at the card reader of the car
+	ElevCredential <-chan common.Credential
 	//Sets light state - assumed non-blocking
 	Lights             chan<- elevatordriver.LightState
 	NewOrderSend       chan<- SchedulableOrder
 	NewOrderRecv       <-chan SchedulableOrder
 	OrderCompletedSend chan<- SchedulableOrder
 	OrderCompletedRecv <-chan SchedulableOrder
-	CostsSend          chan<- common.OrderCosts
-	CostsRecv          <-chan common.OrderCosts
-	WorkerLost         <-chan int
+	HallRequestSend    chan<- HallRequest
+	HallRequestRecv    <-chan HallRequest
+	SyncSend           chan<- SyncMessage
+	SyncRecv           <-chan SyncMessage
+	//FireRecallSend and FireRecallRecv share the fire service recall with the other nodes
+	FireRecallSend chan<- FireRecall
+	FireRecallRecv <-chan FireRecall
+	//RecallFloor is the floor the elevators are recalled to in fire service, unless another floor is requested
+	RecallFloor int
+	//TrafficSend and TrafficRecv share the manual traffic mode override with the other nodes
+	TrafficSend chan<- TrafficOverride
+	TrafficRecv <-chan TrafficOverride
+	//Admin receives commands from the admin interface
+	Admin <-chan AdminRequest
+	//Unicast is used to request snapshots from other nodes when starting, and to answer them
+	Unicast    *network.Unicast
+	CostsSend  chan<- common.OrderCosts
+	CostsRecv  <-chan common.OrderCosts
+	WorkerLost <-chan int
+	//Leadership receives the elected leader, which coordinates hall orders
+	Leadership <-chan network.Leadership
+	//Clock is the hybrid logical clock shared with the network, used to stamp orders
+	Clock *network.Clock
+	//OrderTimeout is the time before an order is reassigned
+	OrderTimeout time.Duration
+	//CabPenalty is added to the cost of cab calls
+	CabPenalty float64
+	//CostFunction is the name of the cost function
+	CostFunction string
+	//Parking is the name of the parking policy for idle elevators
+	Parking string
+	//LobbyFloor is the parking floor of the lobby parking policy
+	LobbyFloor int
+	//ParkingDelay is the time an elevator is idle before it is parked
+	ParkingDelay time.Duration
+	//TrafficMode is the traffic mode used outside the periods of the traffic schedule, or TrafficAuto
+	TrafficMode string
+	//TrafficSchedule contains the traffic modes for periods of the day
+	TrafficSchedule []TrafficPeriod
+	//ServedFloors are the floors served by the elevator. All floors are served if empty.
+	ServedFloors []int
+	//SecuredFloors are the floors only reachable with a credential, and when they are secured
+	SecuredFloors []SecuredFloor
+	//AuthorizedCards are the cards accepted as credentials. All cards are accepted if empty.
+	AuthorizedCards []int
+	//AccessWindow is the time a credential gives access to the secured floors
+	AccessWindow time.Duration
+	//LoadWeighing is set if the elevatorcontroller reports the load, which is required to detect nuisance cab calls
+	LoadWeighing bool
+	//NuisanceStops is the number of stops in a row for cab calls without passengers entering or leaving
+	//before all cab calls are cancelled. Disabled if 0.
+	NuisanceStops int
+	//CallsPerPassenger is the highest number of cab calls for every passenger before all cab calls are cancelled.
+	//Disabled if 0.
+	CallsPerPassenger int
+	//Reload receives new values for the runtime configuration
+	Reload <-chan RuntimeConfig
+	Logger *logging.Logger
+}
+
+//RuntimeConfig contains configuration values that can be changed while running
+type RuntimeConfig struct {
+	OrderTimeout      time.Duration
+	CabPenalty        float64
+	CostFunction      string
+	Parking           string
+	LobbyFloor        int
+	ParkingDelay      time.Duration
+	TrafficMode       string
+	TrafficSchedule   []TrafficPeriod
+	ServedFloors      []int
+	SecuredFloors     []SecuredFloor
+	AuthorizedCards   []int
+	AccessWindow      time.Duration
+	NuisanceStops     int
+	CallsPerPassenger int
 }
 
 //Struct containing orders in the different directions
@@ -55,6 +148,17 @@ type schedOrders struct {
 	HallUp   []*SchedulableOrder `json:"orders_up"`
 	HallDown []*SchedulableOrder `json:"orders_down"`
 	Cab      []*SchedulableOrder `json:"orders_cab"`
+	//Completed hall orders are kept as tombstones to reject older assignments and completions
+	HallUpDone   []*SchedulableOrder `json:"completed_up"`
+	HallDownDone []*SchedulableOrder `json:"completed_down"`
+	//FireRecall is the fire service recall of the building, replicated like the hall orders
+	FireRecall *FireRecall `json:"fire_recall,omitempty"`
+	//FirePhaseII is set while this elevator is operated by a firefighter
+	FirePhaseII bool `json:"fire_phase_ii,omitempty"`
+	//IndependentService is set while this elevator is taken out of the group and only serves cab calls
+	IndependentService bool `json:"independent_service,omitempty"`
+	//TrafficOverride is the traffic mode set manually for the building, replicated like the fire recall
+	TrafficOverride *TrafficOverride `json:"traffic_override,omitempty"`
 }
 
 //If for some reason the scheduler generates orders faster than the elevatorcontroller
@@ -81,17 +185,40 @@ func runSendLatestOrder(ctx context.Context, sendChan chan<- common.Order, order
 	}
 }
 
+//runSendLatestDoorMode sends the latest door mode when the elevatorcontroller is ready
+func runSendLatestDoorMode(ctx context.Context, sendChan chan<- common.DoorMode, modeToSend <-chan common.DoorMode) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case mode := <-modeToSend:
+			select {
+			case <-ctx.Done():
+				return
+			case sendChan <- mode:
+			case mode = <-modeToSend:
+			}
+		}
+	}
+}
+
 //Run is the startingpoint for the scheduler module
 //The ctx context is used to stop the gorotine if the context expires.
-func Run(ctx context.Context, waitGroup *sync.WaitGroup, conf Config) {
-	//Used to make sure main routine waits for this goroutine to finish
-	defer waitGroup.Done()
+//Returns an error if the scheduler fails. All orders are stored in the order file,
+//so the scheduler can be restarted without losing orders.
+func Run(ctx context.Context, conf Config) error {
+	//Stop helper goroutines on exit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	//Contains orders for all floors and directions
 	orders := schedOrders{
 		HallUp:   make([]*SchedulableOrder, conf.NumFloors),
 		HallDown: make([]*SchedulableOrder, conf.NumFloors),
 		Cab:      make([]*SchedulableOrder, conf.NumFloors),
+
+		HallUpDone:   make([]*SchedulableOrder, conf.NumFloors),
+		HallDownDone: make([]*SchedulableOrder, conf.NumFloors),
 	}
 	//Contains the cost for orders to all floor by all elevators
 	workers := map[int]*common.OrderCosts{
@@ -103,8 +230,21 @@ func Run(ctx context.Context, waitGroup *sync.WaitGroup, conf Config) {
 		},
 	}
 
-	orderTimeout := 20 * time.Second
+	//Hall orders are assigned by a single coordinator
+	coord := newCoordinator(conf.ElevatorID, conf.Clock)
+	//Idle elevators are parked
+	parking := newParker(conf.NumFloors)
+	//The traffic mode is chosen from the schedule or the recent hall orders
+	traffic := &trafficDetector{}
+	//Cab calls to secured floors require a credential
+	access := &accessControl{}
+	//Cab calls are cancelled by pressing the lit button twice
+	presses := newPressDetector(conf.NumFloors)
+	//Nuisance cab calls are cancelled
+	nuisance := &nuisanceDetector{}
+
 	orderTimeoutTicker := time.NewTicker(time.Second)
+	defer orderTimeoutTicker.Stop()
 	//Channel used to avoid select blocking when neccessary
 	skipSelect := make(chan struct{}, 1)
 
@@ -113,15 +253,26 @@ func Run(ctx context.Context, waitGroup *sync.WaitGroup, conf Config) {
 	//the elevatorcontroller is ready
 	orderToElevator := make(chan common.Order)
 	go runSendLatestOrder(ctx, conf.ElevExecuteOrder, orderToElevator)
+	doorModeToElevator := make(chan common.DoorMode)
+	go runSendLatestDoorMode(ctx, conf.ElevDoorMode, doorModeToElevator)
 
 	//Load orders if file exists
-	if fileExists(conf.FilePath) {
-		fileOrders, err := readFromOrdersFile(conf.FilePath)
+	exists, err := fileExists(conf.FilePath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		fileOrders, err := readFromOrdersFile(conf.FilePath, conf.NumFloors)
+		if err == errCorruptOrdersFile {
+			//Move the file out of the way so that a restarted scheduler can start without it
+			if renameErr := os.Rename(conf.FilePath, conf.FilePath+".corrupt"); renameErr != nil {
+				return renameErr
+			}
+		}
 		if err != nil {
-			log.Panicf("Error reading from file: %s\n", err)
+			return fmt.Errorf("error reading from file: %s", err)
 		}
-		spew.Dump(fileOrders)
-		publishAllHallOrders(ctx, fileOrders, conf.NewOrderSend)
+		conf.Logger.Debugf("Loaded orders from file\n%s", spew.Sdump(fileOrders))
 		//Replace orders with orders from file
 		orders = *fileOrders
 
@@ -129,34 +280,139 @@ func Run(ctx context.Context, waitGroup *sync.WaitGroup, conf Config) {
 		skipSelect <- struct{}{}
 	}
 
+	//Synchronize with the other nodes before accepting assignments
+	syncer := newSynchronizer(conf.ElevatorID)
+	defer syncer.timer.Stop()
+	snapshots := make(chan snapshotResult)
+	snapshotQueries := make(chan snapshotQuery)
+	if conf.Unicast != nil {
+		conf.Unicast.Handle(snapshotService, snapshotHandler(snapshotQueries))
+	}
+	finishSync := func() {
+		deferredOrders, deferredRequests := syncer.finish(ctx, &orders, coord, conf.HallRequestSend, conf.Logger)
+		for _, order := range deferredOrders {
+			applyNewOrder(&orders, order, coord, conf.Logger)
+		}
+		for _, req := range deferredRequests {
+			applyHallRequest(ctx, &orders, req, workers, coord, conf)
+		}
+	}
+
 	var prevOrder SchedulableOrder
 	var elevatorStatus common.ElevatorStatus
+	var prevDoorMode common.DoorMode
+	var prevFull bool
+	var prevIndependent bool
 
 	for {
 		//All blocking operations handled in select!
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case <-skipSelect:
 			//Continue after select
 		case id := <-conf.WorkerLost:
 			delete(workers, id)
-			reassignInvalidOrders(ctx, &orders, orderTimeout, workers, conf.NewOrderSend)
+			if err := reassignInvalidOrders(ctx, &orders, conf.OrderTimeout, workers, coord, conf.Clock, conf.NewOrderSend, conf.Logger); err != nil {
+				return err
+			}
 		case <-orderTimeoutTicker.C:
-			reassignInvalidOrders(ctx, &orders, orderTimeout, workers, conf.NewOrderSend)
+			if err := reassignInvalidOrders(ctx, &orders, conf.OrderTimeout, workers, coord, conf.Clock, conf.NewOrderSend, conf.Logger); err != nil {
+				return err
+			}
+			//Requests may be lost if sent while the nodes disagree on the coordinator
+			coord.resendStale(ctx, hallRequestTimeout, conf.HallRequestSend, conf.Logger)
+			//Republish own cost regularly in case the receiver has been restarted
+			if cost, ok := workers[conf.ElevatorID]; ok {
+				go sendOrderCosts(ctx, conf.CostsSend, cost)
+			}
+			//The elevatorcontroller starts with automatic doors if restarted
+			doorModeToElevator <- prevDoorMode
 		case elevatorStatus = <-conf.ElevStatus:
 			//Updates elevator stauts
+		case r := <-conf.Reload:
+			conf.OrderTimeout = r.OrderTimeout
+			conf.CabPenalty = r.CabPenalty
+			conf.CostFunction = r.CostFunction
+			conf.Parking = r.Parking
+			conf.LobbyFloor = r.LobbyFloor
+			conf.ParkingDelay = r.ParkingDelay
+			conf.TrafficMode = r.TrafficMode
+			conf.TrafficSchedule = r.TrafficSchedule
+			conf.ServedFloors = r.ServedFloors
+			conf.SecuredFloors = r.SecuredFloors
+			conf.AuthorizedCards = r.AuthorizedCards
+			conf.AccessWindow = r.AccessWindow
+			conf.NuisanceStops = r.NuisanceStops
+			conf.CallsPerPassenger = r.CallsPerPassenger
 		case costs := <-conf.CostsRecv:
-			//If a new elevator connects - share all orders
+			//If a new elevator connects - share the cab order backup.
+			//The new elevator requests the hall orders itself
 			if _, ok := workers[costs.ID]; !ok {
-				publishAllHallOrders(ctx, &orders, conf.NewOrderSend)
+				if syncer.synced {
+					syncer.publishCabBackup(ctx, orders.Cab, true, conf.SyncSend)
+				} else {
+					syncer.requestSnapshot(ctx, conf.Unicast, costs.ID, snapshots, conf.Logger)
+				}
 			}
 			workers[costs.ID] = &costs
+		case l := <-conf.Leadership:
+			if coord.update(l) {
+				conf.Logger.Infof("Coordinator changed to %d in term %d", l.LeaderID, l.Term)
+				coord.resendPending(ctx, conf.HallRequestSend, conf.Logger)
+			}
+		case <-syncer.timer.C:
+			conf.Logger.Infof("No snapshot from the leader within %s", syncTimeout)
+			finishSync()
+		case msg := <-conf.SyncRecv:
+			syncer.handleSyncMessage(msg)
+		case result := <-snapshots:
+			if syncer.handleSnapshot(&orders, result, coord.current.LeaderID, conf.Logger) {
+				finishSync()
+			}
+		case query := <-snapshotQueries:
+			syncer.handleSnapshotQuery(&orders, query)
+		case req := <-conf.HallRequestRecv:
+			if !syncer.synced {
+				syncer.deferredRequests = append(syncer.deferredRequests, req)
+			} else {
+				applyHallRequest(ctx, &orders, req, workers, coord, conf)
+			}
 		case order := <-conf.NewOrderRecv:
-			handleNewOrder(&orders, order)
+			if !syncer.synced {
+				syncer.deferredOrders = append(syncer.deferredOrders, order)
+			} else {
+				//Renewals and merged assignments of an active slot are not new demand
+				fresh := order.Dir != common.NoDir && !hallOrderActive(&orders, order.Order)
+				if applyNewOrder(&orders, order, coord, conf.Logger) && order.Dir != common.NoDir {
+					if fresh {
+						parking.recordDemand(order.Floor)
+						traffic.recordOrder(order.Order)
+					}
+					announceCar(ctx, order, conf)
+				}
+			}
 		case order := <-conf.OrderCompletedRecv:
-			handleOrderCompleted(&orders, order, conf)
+			if handleOrderCompleted(&orders, order, conf) {
+				clearKeypad(ctx, order, conf)
+			}
+		case recall := <-conf.FireRecallRecv:
+			if err := applyFireRecall(&orders, recall, conf.Logger); err != nil {
+				conf.Logger.Errorf("Invalid fire recall from %d: %s", recall.SenderID, err)
+			}
+		case override := <-conf.TrafficRecv:
+			if err := applyTrafficOverride(&orders, override, conf.Logger); err != nil {
+				conf.Logger.Errorf("Invalid traffic mode override from %d: %s", override.SenderID, err)
+			}
+		case req := <-conf.Admin:
+			handleAdminRequest(ctx, req, &orders, elevatorStatus, coord, traffic, access, conf)
 		case order := <-conf.ElevCompletedOrder:
+			//Parking moves are not orders
+			if order.Park {
+				break
+			}
+			//The completed order is no longer executed
+			prevOrder = SchedulableOrder{}
 			//Save previous order
 			orders.Cab[order.Floor] = nil
 			completedTime := time.Now()
@@ -164,65 +420,149 @@ func Run(ctx context.Context, waitGroup *sync.WaitGroup, conf Config) {
 			case common.DownDir:
 				schedOrder := orders.HallDown[order.Floor]
 				if schedOrder != nil {
+					completion := *schedOrder
+					completion.CompletedAt = conf.Clock.Now()
 					//Send order completed event to network when available
-					go utilities.SendMessage(ctx, conf.OrderCompletedSend, *schedOrder)
+					go utilities.SendMessage(ctx, conf.OrderCompletedSend, completion)
 					//Completed but not (yet) acked by network. Do not send it to the elevator again
 					schedOrder.completed = &completedTime
+					boardPassengers(&orders, schedOrder, conf)
 				} else {
-					log.Println("Unexpected order completed")
+					conf.Logger.Warnf("Unexpected order completed %+v", order)
 				}
 			case common.UpDir:
 				schedOrder := orders.HallUp[order.Floor]
 				if schedOrder != nil {
+					completion := *schedOrder
+					completion.CompletedAt = conf.Clock.Now()
 					//Send order completed event to network when available
-					go utilities.SendMessage(ctx, conf.OrderCompletedSend, *schedOrder)
+					go utilities.SendMessage(ctx, conf.OrderCompletedSend, completion)
 					//Completed but not (yet) acked by network. Do not send it to the elevator again
 					schedOrder.completed = &completedTime
+					boardPassengers(&orders, schedOrder, conf)
 				} else {
-					log.Println("Unexpected order completed")
+					conf.Logger.Warnf("Unexpected order completed %+v", order)
 				}
 			case common.NoDir:
 				//Already handled before switch
 			default:
-				log.Panicln("Unexpected direction")
+				return fmt.Errorf("unexpected direction %s", order.Dir)
 			}
 
 		case btn := <-conf.ElevButtonPressed:
-			if btn.Button == elevio.BT_Cab {
-				if orders.Cab[btn.Floor] == nil {
-					orders.Cab[btn.Floor] = createOrder(btn.Floor, common.NoDir, conf.ElevatorID)
+			if !fireServiceAccepts(&orders, btn.Button) {
+				conf.Logger.Debugf("Ignoring button press %+v in fire service", btn)
+			} else if btn.Button == elevio.BT_Cab && !serves(conf.ServedFloors, btn.Floor) {
+				conf.Logger.Debugf("Ignoring cab button for floor %d, the floor is not served", btn.Floor)
+			} else if btn.Button == elevio.BT_Cab && orders.Cab[btn.Floor] != nil {
+				if presses.doublePress(btn.Floor, time.Now()) {
+					cancelCabOrder(&orders, btn.Floor, "double press", conf)
+				}
+			} else if btn.Button == elevio.BT_Cab {
+				//Firefighters reach all floors
+				if orders.FirePhaseII || access.allows(btn.Floor, "cab call", time.Now(), conf) {
+					orders.Cab[btn.Floor] = createOrder(btn.Floor, common.NoDir, conf.ElevatorID, conf.Clock.Now())
 				}
 			} else {
-				handleElevHallBtnPressed(ctx, btn, workers, conf.NewOrderSend)
+				if err := handleElevHallBtnPressed(ctx, btn, &orders, coord, conf.HallRequestSend, conf.Logger); err != nil {
+					conf.Logger.Errorf("Failed to handle button press %+v: %s", btn, err)
+				}
 			}
+		case call := <-conf.ElevDestinationCall:
+			if !fireServiceAccepts(&orders, elevio.BT_HallUp) {
+				conf.Logger.Debugf("Ignoring destination call %+v in fire service", call)
+			} else if access.allows(call.Destination, "destination call", time.Now(), conf) {
+				if err := handleDestinationCall(ctx, call, &orders, coord, conf); err != nil {
+					conf.Logger.Errorf("Failed to handle destination call %+v: %s", call, err)
+				}
+			}
+		case credential := <-conf.ElevCredential:
+			//Rejected credentials are logged
+			access.grant(credential, time.Now(), conf)
 		}
 
+		//Cancel orders not served in fire service
+		cancelOrdersForFireService(ctx, &orders, coord, conf)
+		cancelUnservedCabOrders(&orders, conf)
+		nuisance.check(&orders, elevatorStatus, conf)
+
 		//Update elevators cost
+		mode := traffic.mode(&orders, time.Now(), conf)
+		coord.traffic = trafficPolicy{mode: mode, lobby: conf.LobbyFloor, top: conf.NumFloors - 1}
 		if cost, ok := workers[conf.ElevatorID]; ok {
-			newCost := createElevatorCost(elevatorStatus, &orders, conf.ElevatorID)
+			newCost := getCostFunction(conf.CostFunction)(elevatorStatus, &orders, conf.ElevatorID, conf.CabPenalty)
+			applyTrafficWeights(&newCost, mode, conf.LobbyFloor)
+			applyLoadPenalty(&newCost, elevatorStatus)
+			newCost.Stops = destinationStops(&orders, conf.ElevatorID)
+			newCost.Unserved = unservedFloors(conf.ServedFloors, conf.NumFloors)
+			newCost.Unavailable = !availableForHallOrders(&orders)
+			newCost.Floor = elevatorStatus.Floor
+			newCost.Moving = elevatorStatus.Moving
 			if !reflect.DeepEqual(*cost, newCost) {
 				*cost = newCost
 				//Send cost using deep copy
 				//Not critical if multiple of these are sent in wrong order
-				go sendOrderCosts(conf.CostsSend, cost)
+				go sendOrderCosts(ctx, conf.CostsSend, cost)
 			}
 		} else {
-			log.Panicf("Missing elevator cost in costmap")
+			return errors.New("missing elevator cost in costmap")
 		}
 
 		//Save orders to file
 		err := saveToOrdersFile(conf.FilePath, &orders)
 		if err != nil {
-			log.Panic(err)
+			return fmt.Errorf("error saving orders to file: %s", err)
 		} else {
 			//Lights is only set if the order is saved to file without issues.
 			//Update status lights based on updated orders
 			setLightsFromOrders(orders, conf.Lights, conf.NumFloors)
+			conf.Lights <- elevatordriver.LightState{Type: elevatordriver.FireServiceLight, State: inFireService(&orders)}
 
 		}
 
+		//Back up cab orders on the other nodes
+		if syncer.synced {
+			syncer.publishCabBackup(ctx, orders.Cab, false, conf.SyncSend)
+		}
+
+		//Operate the doors for fire service, and send the current order again when changed
+		if doorMode := fireServiceDoorMode(&orders, elevatorStatus); doorMode != prevDoorMode {
+			doorModeToElevator <- doorMode
+			prevDoorMode = doorMode
+			prevOrder = SchedulableOrder{}
+		}
+
+		//Hall orders passed by while full are sent again when the car is no longer full
+		if elevatorStatus.Full != prevFull {
+			prevFull = elevatorStatus.Full
+			prevOrder = SchedulableOrder{}
+		}
+
+		//Hall orders are released at once when independent service starts
+		if orders.IndependentService != prevIndependent {
+			prevIndependent = orders.IndependentService
+			if prevIndependent {
+				releaseHallOrders(ctx, &orders, coord, conf)
+			}
+		}
+
 		//Find next order and send to elevatorcontroller
 		order := getCheapestActiveOrder(&orders, workers[conf.ElevatorID], conf.ElevatorID)
+		if inFireService(&orders) {
+			order = fireServiceOrder(&orders, workers[conf.ElevatorID], conf.ElevatorID)
+		} else if orders.IndependentService || elevatorStatus.Full {
+			order = getCheapestCabOrder(&orders, workers[conf.ElevatorID], conf.ElevatorID)
+		}
+		//Stop the elevator if the order it is executing is cancelled, or is a hall order it can no longer serve
+		if order == nil && prevOrder.OrderID != "" && (!activeOrder(&orders, prevOrder) || heldHallOrder(&orders, prevOrder)) {
+			order = stopOrder(prevOrder, elevatorStatus, workers[conf.ElevatorID], conf)
+		}
+		//Park the elevator when idle
+		if order != nil {
+			parking.busy()
+		} else if availableForHallOrders(&orders) {
+			order = parking.order(trafficParking(mode, conf.Parking), elevatorStatus, workers, conf)
+		}
 		//Only send new order if not deeply equal to the last one and not nil
 		if order != nil && !reflect.DeepEqual(*order, prevOrder) {
 			//Guranteed to not block by the receiver runSkipOldOrders
@@ -259,10 +599,20 @@ func setLightsFromOrders(orders schedOrders, lights chan<- elevatordriver.LightS
 }
 
 //Reassigns orders that have timed out as if it was a new order
-func reassignInvalidOrders(ctx context.Context, orders *schedOrders, timeout time.Duration, workers map[int]*common.OrderCosts, sendOrder chan<- SchedulableOrder) {
+//Hall orders are only reassigned by the coordinator
+//The age of an order is measured with the hybrid logical clock, so clock skew between nodes does not cause spurious renewals
+//Returns an error if a new worker could not be selected
+func reassignInvalidOrders(ctx context.Context, orders *schedOrders, timeout time.Duration, workers map[int]*common.OrderCosts, coord *coordinator, clock *network.Clock, sendOrder chan<- SchedulableOrder, logger *logging.Logger) error {
+	//Hall orders are cancelled while the elevators are recalled
+	if fireRecallActive(orders) {
+		return nil
+	}
+	now := clock.Now()
 	hallOrders := make([]*SchedulableOrder, 0, len(orders.HallDown)+len(orders.HallUp))
-	hallOrders = append(hallOrders, orders.HallDown...)
-	hallOrders = append(hallOrders, orders.HallUp...)
+	if coord.isCoordinator() {
+		hallOrders = append(hallOrders, orders.HallDown...)
+		hallOrders = append(hallOrders, orders.HallUp...)
+	}
 	//Check for timeout or invalid assignee
 	for _, order := range hallOrders {
 		renewOrder := false
@@ -271,7 +621,7 @@ func reassignInvalidOrders(ctx context.Context, orders *schedOrders, timeout tim
 		}
 
 		//Check if timeout have passed
-		if time.Now().Sub(order.Timestamp) > timeout {
+		if now.Sub(order.Timestamp) > timeout {
 			renewOrder = true
 		}
 
@@ -280,17 +630,40 @@ func reassignInvalidOrders(ctx context.Context, orders *schedOrders, timeout tim
 			renewOrder = true
 		}
 
-		//If assignee (elevator id) does not exist
-		if _, ok := workers[order.Worker]; !ok {
+		//If assignee (elevator id) does not exist, is unavailable or does not serve the floor
+		if worker, ok := workers[order.Worker]; !ok || worker.Unavailable || !worker.Serves(order.Floor) {
+			renewOrder = true
+		}
+
+		//If assignee is full and another elevator is not
+		onlyFull := !renewOrder && order.completed == nil && workerFull(workers, order.Worker)
+		if onlyFull {
 			renewOrder = true
 		}
 
 		if renewOrder {
-			worker := selectWorker(workers, order.Floor, order.Dir)
-			newOrder := createOrder(order.Floor, order.Dir, worker)
+			//Destinations of passengers not yet picked up are kept
+			var destinations []int
+			if order.completed == nil {
+				destinations = order.Destinations
+			}
+			worker, err := selectDestinationWorker(workers, order.Order, destinations, coord.traffic)
+			if err == errNoAvailableWorker {
+				//Renewed when an elevator becomes available
+				logger.With(logging.FieldOrderID, order.OrderID).Debugf("No elevator available for order %+v", order.Order)
+				continue
+			} else if err != nil {
+				return err
+			}
+			if onlyFull && workerFull(workers, worker) {
+				continue
+			}
+			newOrder := createOrder(order.Floor, order.Dir, worker, now)
+			newOrder.Destinations = destinations
+			coord.assign(newOrder, orders, 0)
 			//Send new order event to network when available
 			go utilities.SendMessage(ctx, sendOrder, *newOrder)
-			log.Printf("Renewing order %+v\n ", newOrder)
+			logger.With(logging.FieldOrderID, newOrder.OrderID).Infof("Renewing order %s (%+v) assigned to %d", order.OrderID, newOrder.Order, worker)
 		}
 	}
 
@@ -299,65 +672,82 @@ func reassignInvalidOrders(ctx context.Context, orders *schedOrders, timeout tim
 			continue
 		}
 
-		if time.Now().Sub(order.Timestamp) > timeout {
-			order.Timestamp = time.Now()
+		if now.Sub(order.Timestamp) > timeout {
+			order.Timestamp = now
 		}
 	}
+	return nil
 }
 
-//Sends all current hall orders on the network
-func publishAllHallOrders(ctx context.Context, orders *schedOrders, send chan<- SchedulableOrder) {
-	//Get hall orders
-	hallOrders := make([]*SchedulableOrder, 0, len(orders.HallDown)+len(orders.HallUp))
-	hallOrders = append(hallOrders, orders.HallDown...)
-	hallOrders = append(hallOrders, orders.HallUp...)
+//Merges an assignment received from the network into the orders
+//Returns true if the assignment is applied
+func applyNewOrder(orders *schedOrders, order SchedulableOrder, coord *coordinator, logger *logging.Logger) bool {
+	err := handleNewOrder(orders, order, coord)
+	if err == errStaleAssignment {
+		logger.With(logging.FieldOrderID, order.OrderID).Debugf("Ignoring assignment with term %d and version %d: %s", order.Term, order.Version, err)
+	} else if err != nil {
+		logger.With(logging.FieldOrderID, order.OrderID).Errorf("Error adding order: %s", err)
+	}
+	return err == nil
+}
 
-	for _, order := range hallOrders {
-		if order != nil {
-			//Send order to network when available
-			go utilities.SendMessage(ctx, send, *order)
-		}
+//Assigns a hall request if this node is the coordinator
+func applyHallRequest(ctx context.Context, orders *schedOrders, req HallRequest, workers map[int]*common.OrderCosts, coord *coordinator, conf Config) {
+	if fireRecallActive(orders) {
+		conf.Logger.Debugf("Ignoring hall request %s from %d in fire service", req.RequestID, req.RequesterID)
+		return
+	}
+	if err := coord.handleHallRequest(ctx, orders, req, workers, conf.NewOrderSend, conf.Logger); err != nil {
+		conf.Logger.Errorf("Failed to handle hall request %s from %d: %s", req.RequestID, req.RequesterID, err)
 	}
 }
 
-//Handles events related to a hall button pressed such as creating an order and assigning an elevator
-func handleElevHallBtnPressed(ctx context.Context, btn elevio.ButtonEvent, costMap map[int]*common.OrderCosts, sendOrder chan<- SchedulableOrder) {
+//Handles a hall button pressed by requesting an order from the coordinator
+//Presses are ignored if an order is already active at the floor
+func handleElevHallBtnPressed(ctx context.Context, btn elevio.ButtonEvent, orders *schedOrders, coord *coordinator, send chan<- HallRequest, logger *logging.Logger) error {
+	order := common.Order{Floor: btn.Floor}
 	switch btn.Button {
 	case elevio.BT_HallDown:
-		worker := selectWorker(costMap, btn.Floor, common.DownDir)
-		order := createOrder(btn.Floor, common.DownDir, worker)
-		//Send new order to network when available
-		go utilities.SendMessage(ctx, sendOrder, *order)
-		log.Println("New HallDown order assigned to ", worker)
+		order.Dir = common.DownDir
 	case elevio.BT_HallUp:
-		worker := selectWorker(costMap, btn.Floor, common.UpDir)
-		order := createOrder(btn.Floor, common.UpDir, worker)
-		//Send new order to network when available
-		go utilities.SendMessage(ctx, sendOrder, *order)
-		log.Println("New HallUp order assigned to ", worker)
+		order.Dir = common.UpDir
 	default:
-		log.Panic("Invalid button type")
+		return fmt.Errorf("invalid button type %d", btn.Button)
 	}
+	if hallOrderActive(orders, order) {
+		return nil
+	}
+	coord.request(ctx, order, slotVersion(orders, order), nil, send, logger)
+	return nil
 }
 
 //Sends the cost of specific orders for the elevators
-func sendOrderCosts(c chan<- common.OrderCosts, costs *common.OrderCosts) {
+func sendOrderCosts(ctx context.Context, c chan<- common.OrderCosts, costs *common.OrderCosts) {
 	//DeepCopy slices
 	msg := common.OrderCosts{
-		ID:         costs.ID,
-		OrderCount: costs.OrderCount,
-		HallDown:   append(make([]float64, 0, len(costs.HallDown)), costs.HallDown...),
-		HallUp:     append(make([]float64, 0, len(costs.HallUp)), costs.HallUp...),
-		Cab:        append(make([]float64, 0, len(costs.Cab)), costs.Cab...),
+		ID:          costs.ID,
+		OrderCount:  costs.OrderCount,
+		HallDown:    append(make([]float64, 0, len(costs.HallDown)), costs.HallDown...),
+		HallUp:      append(make([]float64, 0, len(costs.HallUp)), costs.HallUp...),
+		Cab:         append(make([]float64, 0, len(costs.Cab)), costs.Cab...),
+		Unavailable: costs.Unavailable,
+		Full:        costs.Full,
+		Stops:       append([]int{}, costs.Stops...),
+		Unserved:    append([]int{}, costs.Unserved...),
 	}
-	c <- msg
+	utilities.SendMessage(ctx, c, msg)
 }
 
 //Selects an elevator based on which elevator is the cheapest for that specific order(direction and floor)
-func selectWorker(workers map[int]*common.OrderCosts, floor int, dir common.Direction) int {
+//Unavailable elevators and elevators not serving the floor are skipped.
+//Returns errNoAvailableWorker if no elevator is available, or an error if the direction is unknown
+func selectWorker(workers map[int]*common.OrderCosts, floor int, dir common.Direction, traffic trafficPolicy) (int, error) {
 	minCost := math.Inf(1)
 	worker := -1
 	for _, v := range workers {
+		if v.Unavailable || !v.Serves(floor) {
+			continue
+		}
 		switch dir {
 		case common.NoDir:
 			if cost := v.Cab[floor]; cost < minCost {
@@ -365,20 +755,23 @@ func selectWorker(workers map[int]*common.OrderCosts, floor int, dir common.Dire
 				minCost = cost
 			}
 		case common.UpDir:
-			if cost := v.HallUp[floor]; cost < minCost {
+			if cost := v.HallUp[floor] * traffic.weight(v, common.Order{Floor: floor, Dir: dir}); cost < minCost {
 				worker = v.ID
 				minCost = cost
 			}
 		case common.DownDir:
-			if cost := v.HallDown[floor]; cost < minCost {
+			if cost := v.HallDown[floor] * traffic.weight(v, common.Order{Floor: floor, Dir: dir}); cost < minCost {
 				worker = v.ID
 				minCost = cost
 			}
 		default:
-			log.Panicln("Unknown direction")
+			return -1, fmt.Errorf("unknown direction %s", dir)
 		}
 	}
-	return worker
+	if worker == -1 {
+		return -1, errNoAvailableWorker
+	}
+	return worker, nil
 }
 
 //Chooses the cheapest order as the next order to be executed
@@ -388,7 +781,7 @@ func getCheapestActiveOrder(orders *schedOrders, cost *common.OrderCosts, id int
 
 	//Check down hall orders
 	for _, order := range orders.HallDown {
-		if order == nil || order.Worker != id || order.completed != nil {
+		if order == nil || order.Worker != id || order.completed != nil || !cost.Serves(order.Floor) {
 			continue
 		}
 		orderCost := cost.HallDown[order.Floor]
@@ -400,7 +793,7 @@ func getCheapestActiveOrder(orders *schedOrders, cost *common.OrderCosts, id int
 
 	//Check up hall orders
 	for _, order := range orders.HallUp {
-		if order == nil || order.Worker != id || order.completed != nil {
+		if order == nil || order.Worker != id || order.completed != nil || !cost.Serves(order.Floor) {
 			continue
 		}
 		orderCost := cost.HallUp[order.Floor]
@@ -424,29 +817,37 @@ func getCheapestActiveOrder(orders *schedOrders, cost *common.OrderCosts, id int
 	return currOrder
 }
 
+//Chooses the cheapest cab call, used when the elevator does not serve hall orders
+func getCheapestCabOrder(orders *schedOrders, cost *common.OrderCosts, id int) *SchedulableOrder {
+	return getCheapestActiveOrder(&schedOrders{Cab: orders.Cab}, cost, id)
+}
+
 //Creates and order marked with assigned elevator and a timestamp
-func createOrder(floor int, dir common.Direction, assignee int) *SchedulableOrder {
+func createOrder(floor int, dir common.Direction, assignee int, timestamp network.Timestamp) *SchedulableOrder {
 	return &SchedulableOrder{
 		Order: common.Order{
 			Floor: floor,
 			Dir:   dir,
 		},
 		Worker:    assignee,
-		Timestamp: time.Now(),
+		Timestamp: timestamp,
 		OrderID:   xid.New().String(),
 	}
 }
 
 //Handles orders that have already been created and tries to add them to a slice of same types of orders
-func handleNewOrder(orders *schedOrders, order SchedulableOrder) error {
+//Hall orders are merged into the replicated hall state.
+//Returns errStaleAssignment if the slot already has the same or a newer state
+func handleNewOrder(orders *schedOrders, order SchedulableOrder, coord *coordinator) error {
 	switch order.Dir {
-	case common.UpDir:
-		if err := tryAddOrderToSlice(orders.HallUp, order.Floor, order); err != nil {
+	case common.UpDir, common.DownDir:
+		coord.observe(order)
+		changed, err := mergeHallOrder(orders, order, false)
+		if err != nil {
 			return err
 		}
-	case common.DownDir:
-		if err := tryAddOrderToSlice(orders.HallDown, order.Floor, order); err != nil {
-			return err
+		if !changed {
+			return errStaleAssignment
 		}
 	case common.NoDir:
 		if err := tryAddOrderToSlice(orders.Cab, order.Floor, order); err != nil {
@@ -459,17 +860,18 @@ func handleNewOrder(orders *schedOrders, order SchedulableOrder) error {
 }
 
 //Handles upcoming events once notice of an order being finished comes in
-func handleOrderCompleted(orders *schedOrders, order SchedulableOrder, conf Config) {
-	switch order.Dir {
-	case common.UpDir:
-		if err := tryRemoveOrderFromSlice(orders.HallUp, order.Floor); err != nil {
-			log.Println("Error removing order: ", err)
-		}
-	case common.DownDir:
-		if err := tryRemoveOrderFromSlice(orders.HallDown, order.Floor); err != nil {
-			log.Println("Error removing order: ", err)
-		}
+//The completion is merged into the replicated hall state, so a completion of an
+//older order does not remove a newer order
+//Returns true if the order is removed
+func handleOrderCompleted(orders *schedOrders, order SchedulableOrder, conf Config) bool {
+	logger := conf.Logger.With(logging.FieldOrderID, order.OrderID)
+	changed, err := mergeHallOrder(orders, order, true)
+	if err != nil {
+		logger.Errorf("Error removing order: %s", err)
+	} else if !changed {
+		logger.Debugf("Ignoring completion of order with version %d", order.Version)
 	}
+	return err == nil && changed && getHallOrder(orders, order.Order) == nil
 }
 
 //Adds an order to a slice of scheduled orders
@@ -480,12 +882,3 @@ func tryAddOrderToSlice(slice []*SchedulableOrder, pos int, order SchedulableOrd
 	}
 	return errors.New("Invalid index")
 }
-
-//Removed orders from slice scheduled orders
-func tryRemoveOrderFromSlice(slice []*SchedulableOrder, pos int) error {
-	if pos >= 0 && pos < len(slice) {
-		slice[pos] = nil
-		return nil
-	}
-	return errors.New("Invalid index")
-}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//SecuredFloor is a floor only reachable with a credential, e.g. after hours. Secured floors are a policy of the node, and are not replicated.
+//From and To are the times since midnight of the period the floor is secured, which passes midnight if To is before From.
+//The floor is always secured if From equals To.
+type SecuredFloor struct {
+	Floor int
+	From  time.Duration
+	To    time.Duration
+}
+
+//accessControl keeps the access granted by the latest accepted credential
+type accessControl struct {
+	card         int
+	grantedUntil time.Time
+}
+
+//securedFloors returns the floors secured at the time
+func securedFloors(now time.Time, conf Config) []int {
+	floors := []int{}
+	for _, s := range conf.SecuredFloors {
+		if s.From == s.To || periodContains(s.From, s.To, timeOfDay(now)) {
+			floors = mergeFloors(floors, []int{s.Floor})
+		}
+	}
+	return floors
+}
+
+//grant gives access to the secured floors for the access window if the card is authorized, or if no cards are configured.
+//Returns an error if the card is rejected.
+func (a *accessControl) grant(credential common.Credential, now time.Time, conf Config) error {
+	if len(conf.AuthorizedCards) > 0 && !containsCard(conf.AuthorizedCards, credential.Card) {
+		conf.Logger.With("card", credential.Card).Warnf("Rejected credential, the card is not authorized")
+		return fmt.Errorf("card %d is not authorized", credential.Card)
+	}
+	a.card = credential.Card
+	a.grantedUntil = now.Add(conf.AccessWindow)
+	conf.Logger.With("card", credential.Card).Infof("Access to secured floors granted for %s", conf.AccessWindow)
+	return nil
+}
+
+//containsCard returns true if the card is in the list
+func containsCard(cards []int, card int) bool {
+	for _, c := range cards {
+		if c == card {
+			return true
+		}
+	}
+	return false
+}
+
+//granted returns true if a credential has been accepted within the access window
+func (a *accessControl) granted(now time.Time) bool {
+	return now.Before(a.grantedUntil)
+}
+
+//allows returns true if a call to the floor is allowed. Rejected calls are logged.
+func (a *accessControl) allows(floor int, call string, now time.Time, conf Config) bool {
+	if !containsFloors(securedFloors(now, conf), []int{floor}) {
+		return true
+	}
+	if a.granted(now) {
+		conf.Logger.With("card", a.card).Infof("Authorized %s to secured floor %d", call, floor)
+		return true
+	}
+	conf.Logger.Warnf("Rejected %s to secured floor %d without a credential", call, floor)
+	return false
+}
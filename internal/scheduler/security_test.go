@@ -0,0 +1,67 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeriodContains(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  time.Duration
+		timeOfDay time.Duration
+		contains  bool
+	}{
+		{"inside", 8 * time.Hour, 17 * time.Hour, 12 * time.Hour, true},
+		{"start is included", 8 * time.Hour, 17 * time.Hour, 8 * time.Hour, true},
+		{"end is excluded", 8 * time.Hour, 17 * time.Hour, 17 * time.Hour, false},
+		{"before", 8 * time.Hour, 17 * time.Hour, 7 * time.Hour, false},
+		{"after midnight", 22 * time.Hour, 6 * time.Hour, 3 * time.Hour, true},
+		{"before midnight", 22 * time.Hour, 6 * time.Hour, 23 * time.Hour, true},
+		{"midnight", 22 * time.Hour, 6 * time.Hour, 0, true},
+		{"outside a period passing midnight", 22 * time.Hour, 6 * time.Hour, 12 * time.Hour, false},
+		{"empty period", 8 * time.Hour, 8 * time.Hour, 8 * time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if contains := periodContains(test.from, test.to, test.timeOfDay); contains != test.contains {
+				t.Errorf("got %t, want %t", contains, test.contains)
+			}
+		})
+	}
+}
+
+func TestSecuredFloors(t *testing.T) {
+	conf := Config{SecuredFloors: []SecuredFloor{
+		{Floor: 5},
+		{Floor: 3, From: 22 * time.Hour, To: 6 * time.Hour},
+		{Floor: 1, From: 8 * time.Hour, To: 17 * time.Hour},
+		{Floor: 3, From: 12 * time.Hour, To: 13 * time.Hour},
+	}}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 10, 19, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		now    time.Time
+		floors []int
+	}{
+		{"night", at(3, 0), []int{3, 5}},
+		{"end of the night", at(6, 0), []int{5}},
+		{"start of the day", at(8, 0), []int{1, 5}},
+		{"overlapping periods", at(12, 30), []int{1, 3, 5}},
+		{"evening", at(18, 0), []int{5}},
+		{"start of the night", at(22, 0), []int{3, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if floors := securedFloors(test.now, conf); !reflect.DeepEqual(floors, test.floors) {
+				t.Errorf("got floors %v, want %v", floors, test.floors)
+			}
+		})
+	}
+	if floors := securedFloors(at(12, 0), Config{}); len(floors) != 0 {
+		t.Errorf("got floors %v without secured floors", floors)
+	}
+}
@@ -0,0 +1,268 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
+)
+
+//syncTimeout is the maximum time spent waiting for snapshots when starting
+const syncTimeout = 2 * time.Second
+
+//snapshotService is the unicast service used to request snapshots
+const snapshotService = "scheduler.snapshot"
+
+//errNotSynchronized is returned when a snapshot is requested from a node that is not synchronized itself
+var errNotSynchronized = errors.New("not synchronized")
+
+//SyncKind is the type of a sync message
+type SyncKind int
+
+const (
+	//SyncCabBackup contains the cab orders of the sender, backed up by the other nodes
+	SyncCabBackup SyncKind = iota + 1
+)
+
+//SyncMessage is broadcast to synchronize state between nodes
+type SyncMessage struct {
+	Kind     SyncKind `json:"kind"`
+	SenderID int      `json:"sender_id"`
+	//Cab contains the cab orders of the sender
+	Cab []*SchedulableOrder `json:"cab,omitempty"`
+}
+
+//Snapshot is the state of a node, sent to a starting node
+type Snapshot struct {
+	//Hall contains the hall orders and completed hall orders
+	Hall *schedOrders `json:"hall"`
+	//Cab is the backup of the cab orders of the starting node
+	Cab []*SchedulableOrder `json:"cab,omitempty"`
+}
+
+//snapshotResult is a snapshot received from another node
+type snapshotResult struct {
+	from     int
+	snapshot Snapshot
+}
+
+//snapshotQuery is a snapshot request from another node, answered by the scheduler.
+//The reply channel is closed if the scheduler is not synchronized.
+type snapshotQuery struct {
+	from  int
+	reply chan<- Snapshot
+}
+
+//synchronizer handles the sync handshake when the scheduler starts, and the cab order backups.
+//A starting node requests a snapshot from every other node and merges them with the orders from
+//the order file. Assignments and hall requests are deferred until the node is synchronized.
+type synchronizer struct {
+	id     int
+	synced bool
+	timer  *time.Timer
+	//requested contains the nodes a snapshot has been requested from
+	requested map[int]bool
+	//confirmed contains the hall slots where a snapshot has the same or a newer state than this node
+	confirmed map[common.Order]bool
+	//snapshotFromLeader is set when a snapshot from the leader is received
+	snapshotFromLeader bool
+	//deferredOrders and deferredRequests are received before the node is synchronized
+	deferredOrders   []SchedulableOrder
+	deferredRequests []HallRequest
+	//backups contains the latest cab orders of the other nodes
+	backups map[int][]*SchedulableOrder
+	//publishedCab is the last cab backup sent
+	publishedCab []*SchedulableOrder
+}
+
+//newSynchronizer creates a synchronizer for a starting node
+func newSynchronizer(id int) *synchronizer {
+	return &synchronizer{
+		id:        id,
+		timer:     time.NewTimer(syncTimeout),
+		requested: make(map[int]bool),
+		confirmed: make(map[common.Order]bool),
+		backups:   make(map[int][]*SchedulableOrder),
+	}
+}
+
+//requestSnapshot requests a snapshot from a node, unless already requested.
+//The snapshot is sent on results.
+func (s *synchronizer) requestSnapshot(ctx context.Context, unicast *network.Unicast, id int, results chan<- snapshotResult, logger *logging.Logger) {
+	if s.synced || s.requested[id] || id == s.id || unicast == nil {
+		return
+	}
+	s.requested[id] = true
+	go func() {
+		var snapshot Snapshot
+		if err := unicast.Request(ctx, id, snapshotService, struct{}{}, &snapshot); err != nil {
+			logger.Infof("No snapshot from %d: %s", id, err)
+			return
+		}
+		utilities.SendMessage(ctx, results, snapshotResult{from: id, snapshot: snapshot})
+	}()
+}
+
+//handleSnapshot merges a snapshot from another node.
+//Returns true if the snapshot is from the leader, and the synchronization can be finished.
+func (s *synchronizer) handleSnapshot(orders *schedOrders, result snapshotResult, leaderID int, logger *logging.Logger) bool {
+	if s.synced || result.snapshot.Hall == nil {
+		return false
+	}
+	s.mergeSnapshot(orders, result.from, result.snapshot, logger)
+	if result.from == leaderID {
+		s.snapshotFromLeader = true
+	}
+	return s.snapshotFromLeader
+}
+
+//handleSnapshotQuery answers a snapshot request from another node.
+//Only a synchronized node answers, so the snapshot is consistent.
+func (s *synchronizer) handleSnapshotQuery(orders *schedOrders, query snapshotQuery) {
+	if !s.synced {
+		close(query.reply)
+		return
+	}
+	//The reply channel is buffered
+	query.reply <- Snapshot{
+		Hall: &schedOrders{
+			HallUp:       copyOrders(orders.HallUp),
+			HallDown:     copyOrders(orders.HallDown),
+			HallUpDone:   copyOrders(orders.HallUpDone),
+			HallDownDone: copyOrders(orders.HallDownDone),
+			FireRecall:   orders.FireRecall,
+			//The traffic mode override is shared with the hall orders
+			TrafficOverride: orders.TrafficOverride,
+		},
+		Cab: copyOrders(s.backups[query.from]),
+	}
+}
+
+//handleSyncMessage handles broadcast sync messages from other nodes
+func (s *synchronizer) handleSyncMessage(msg SyncMessage) {
+	//AtLeastOnce returns own messages to the sender
+	if msg.SenderID == s.id {
+		return
+	}
+	switch msg.Kind {
+	case SyncCabBackup:
+		s.backups[msg.SenderID] = msg.Cab
+	}
+}
+
+//snapshotHandler returns the unicast handler for snapshot requests, which forwards the requests to the scheduler
+func snapshotHandler(queries chan<- snapshotQuery) network.Handler {
+	return func(ctx context.Context, from int, request json.RawMessage) (interface{}, error) {
+		reply := make(chan Snapshot, 1)
+		timeout := time.After(syncTimeout)
+		select {
+		case queries <- snapshotQuery{from: from, reply: reply}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, errNotSynchronized
+		}
+		snapshot, ok := <-reply
+		if !ok {
+			return nil, errNotSynchronized
+		}
+		return snapshot, nil
+	}
+}
+
+//mergeSnapshot merges the hall orders and the cab backup of a snapshot into the orders
+func (s *synchronizer) mergeSnapshot(orders *schedOrders, from int, snapshot Snapshot, logger *logging.Logger) {
+	states := []struct {
+		slots     []*SchedulableOrder
+		completed bool
+	}{
+		{snapshot.Hall.HallUp, false},
+		{snapshot.Hall.HallDown, false},
+		{snapshot.Hall.HallUpDone, true},
+		{snapshot.Hall.HallDownDone, true},
+	}
+	for _, state := range states {
+		for _, order := range state.slots {
+			if order == nil {
+				continue
+			}
+			if order.Version >= slotVersion(orders, order.Order) {
+				s.confirmed[order.Order] = true
+			}
+			if _, err := mergeHallOrder(orders, *order, state.completed); err != nil {
+				logger.With(logging.FieldOrderID, order.OrderID).Warnf("Invalid order in snapshot from %d: %s", from, err)
+			}
+		}
+	}
+	if snapshot.Hall.FireRecall != nil {
+		if err := applyFireRecall(orders, *snapshot.Hall.FireRecall, logger); err != nil {
+			logger.Warnf("Invalid fire recall in snapshot from %d: %s", from, err)
+		}
+	}
+	if snapshot.Hall.TrafficOverride != nil {
+		if err := applyTrafficOverride(orders, *snapshot.Hall.TrafficOverride, logger); err != nil {
+			logger.Warnf("Invalid traffic mode override in snapshot from %d: %s", from, err)
+		}
+	}
+	//Cab orders can only be completed by this node, so the backup is added to the orders from file
+	for _, order := range snapshot.Cab {
+		if order != nil && order.Floor >= 0 && order.Floor < len(orders.Cab) && orders.Cab[order.Floor] == nil {
+			cabOrder := *order
+			orders.Cab[order.Floor] = &cabOrder
+			logger.Infof("Restored cab order at floor %d from backup by %d", order.Floor, from)
+		}
+	}
+	logger.Infof("Merged snapshot from %d", from)
+}
+
+//finish ends the synchronization. Hall orders not known by any other node are requested from the coordinator,
+//and the deferred assignments and requests are returned.
+func (s *synchronizer) finish(ctx context.Context, orders *schedOrders, coord *coordinator, send chan<- HallRequest, logger *logging.Logger) ([]SchedulableOrder, []HallRequest) {
+	s.synced = true
+	s.timer.Stop()
+	for _, order := range append(append([]*SchedulableOrder{}, orders.HallUp...), orders.HallDown...) {
+		if order != nil && !s.confirmed[order.Order] {
+			coord.request(ctx, order.Order, slotVersion(orders, order.Order), order.Destinations, send, logger)
+		}
+	}
+	deferredOrders, deferredRequests := s.deferredOrders, s.deferredRequests
+	s.deferredOrders, s.deferredRequests = nil, nil
+	logger.Infof("Synchronized with %d deferred assignments and %d deferred requests", len(deferredOrders), len(deferredRequests))
+	return deferredOrders, deferredRequests
+}
+
+//publishCabBackup sends the cab orders to the other nodes if they have changed, or if force is set
+func (s *synchronizer) publishCabBackup(ctx context.Context, cab []*SchedulableOrder, force bool, send chan<- SyncMessage) {
+	if !force && reflect.DeepEqual(cab, s.publishedCab) {
+		return
+	}
+	s.publishedCab = copyOrders(cab)
+	//Send backup to network when available
+	go utilities.SendMessage(ctx, send, SyncMessage{
+		Kind:     SyncCabBackup,
+		SenderID: s.id,
+		Cab:      copyOrders(cab),
+	})
+}
+
+//copyOrders returns a deep copy of a slice of orders
+func copyOrders(orders []*SchedulableOrder) []*SchedulableOrder {
+	if orders == nil {
+		return nil
+	}
+	copied := make([]*SchedulableOrder, len(orders))
+	for i, order := range orders {
+		if order != nil {
+			o := *order
+			copied[i] = &o
+		}
+	}
+	return copied
+}
@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//emptyOrders returns orders without any orders for a building with four floors
+func emptyOrders() schedOrders {
+	const floors = 4
+	return schedOrders{
+		HallUp:       make([]*SchedulableOrder, floors),
+		HallDown:     make([]*SchedulableOrder, floors),
+		Cab:          make([]*SchedulableOrder, floors),
+		HallUpDone:   make([]*SchedulableOrder, floors),
+		HallDownDone: make([]*SchedulableOrder, floors),
+	}
+}
+
+func TestSynchronizerMergeSnapshot(t *testing.T) {
+	local := assignment(1, common.UpDir, 2, 100, 1, "local")
+	older := assignment(1, common.UpDir, 1, 50, 2, "older")
+	newer := assignment(1, common.UpDir, 3, 200, 2, "newer")
+	unknown := assignment(2, common.DownDir, 1, 100, 1, "unknown")
+	cab := func(floor int, id string) *SchedulableOrder {
+		return &SchedulableOrder{Order: common.Order{Floor: floor, Dir: common.NoDir}, Worker: 1, OrderID: id}
+	}
+	tests := []struct {
+		name string
+		//local are the hall orders from the order file
+		local    []hallUpdate
+		localCab []*SchedulableOrder
+		//snapshot are the hall orders of the other node
+		snapshot    []hallUpdate
+		snapshotCab []*SchedulableOrder
+		//active is the up order at floor 1 after merging
+		active *hallUpdate
+		//requested are the orders requested from the coordinator when the synchronization finishes
+		requested []common.Order
+		cab       []*SchedulableOrder
+	}{
+		{
+			name:     "newer assignment in the snapshot",
+			local:    []hallUpdate{local},
+			snapshot: []hallUpdate{newer},
+			active:   &newer,
+		},
+		{
+			name:      "older assignment in the snapshot",
+			local:     []hallUpdate{local},
+			snapshot:  []hallUpdate{older},
+			active:    &local,
+			requested: []common.Order{local.order.Order},
+		},
+		{
+			name:     "same assignment in the snapshot",
+			local:    []hallUpdate{local},
+			snapshot: []hallUpdate{local},
+			active:   &local,
+		},
+		{
+			name:     "completion in the snapshot",
+			local:    []hallUpdate{local},
+			snapshot: []hallUpdate{completion(local, 300)},
+		},
+		{
+			name:      "order unknown to the other node",
+			local:     []hallUpdate{local, unknown},
+			snapshot:  []hallUpdate{local},
+			active:    &local,
+			requested: []common.Order{unknown.order.Order},
+		},
+		{
+			name:     "order unknown to this node",
+			snapshot: []hallUpdate{newer},
+			active:   &newer,
+		},
+		{
+			name:        "cab backup",
+			localCab:    []*SchedulableOrder{nil, cab(1, "file"), nil, nil},
+			snapshotCab: []*SchedulableOrder{cab(0, "backup"), cab(1, "old backup"), nil, nil},
+			cab:         []*SchedulableOrder{cab(0, "backup"), cab(1, "file"), nil, nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			orders := emptyOrders()
+			snapshot := emptyOrders()
+			for _, u := range test.local {
+				if _, err := mergeHallOrder(&orders, u.order, u.completed); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, u := range test.snapshot {
+				if _, err := mergeHallOrder(&snapshot, u.order, u.completed); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.localCab != nil {
+				orders.Cab = test.localCab
+			}
+
+			s := newSynchronizer(1)
+			if !s.handleSnapshot(&orders, snapshotResult{from: 2, snapshot: Snapshot{Hall: &snapshot, Cab: test.snapshotCab}}, 2, nil) {
+				t.Error("snapshot from the leader does not finish the synchronization")
+			}
+			checkSlot(t, "active", orders.HallUp[1], test.active)
+			if test.cab != nil && !reflect.DeepEqual(orders.Cab, test.cab) {
+				t.Errorf("got cab orders %+v, want %+v", orders.Cab, test.cab)
+			}
+
+			send := make(chan HallRequest, 4)
+			s.finish(ctx, &orders, newCoordinator(1, nil), send, nil)
+			var requested []common.Order
+			for range test.requested {
+				select {
+				case req := <-send:
+					requested = append(requested, req.Order)
+				case <-time.After(time.Second):
+					t.Fatalf("got %d requests, want %d", len(requested), len(test.requested))
+				}
+			}
+			select {
+			case req := <-send:
+				t.Errorf("got unexpected request %+v", req)
+			case <-time.After(50 * time.Millisecond):
+			}
+			sort.Slice(requested, func(i, j int) bool { return requested[i].Floor < requested[j].Floor })
+			if !reflect.DeepEqual(requested, test.requested) {
+				t.Errorf("requested %v, want %v", requested, test.requested)
+			}
+		})
+	}
+}
+
+func TestSynchronizerHandleSnapshot(t *testing.T) {
+	orders := emptyOrders()
+	s := newSynchronizer(1)
+	if s.handleSnapshot(&orders, snapshotResult{from: 3, snapshot: Snapshot{Hall: &schedOrders{}}}, 2, nil) {
+		t.Error("snapshot from another node than the leader finishes the synchronization")
+	}
+	if s.handleSnapshot(&orders, snapshotResult{from: 2}, 2, nil) {
+		t.Error("empty snapshot from the leader finishes the synchronization")
+	}
+	if !s.handleSnapshot(&orders, snapshotResult{from: 2, snapshot: Snapshot{Hall: &schedOrders{}}}, 2, nil) {
+		t.Error("snapshot from the leader does not finish the synchronization")
+	}
+	s.finish(context.Background(), &orders, newCoordinator(1, nil), make(chan HallRequest, 1), nil)
+	if s.handleSnapshot(&orders, snapshotResult{from: 2, snapshot: Snapshot{Hall: &schedOrders{}}}, 2, nil) {
+		t.Error("snapshot merged after the synchronization finished")
+	}
+}
@@ -0,0 +1,290 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
+)
+
+//Traffic modes
+const (
+	//TrafficNormal uses the configured parking policy and no weights
+	TrafficNormal = "normal"
+	//TrafficUpPeak is used when most passengers travel up from the lobby, e.g. in the morning.
+	//Up orders, and especially up orders at the lobby floor, are served first, and idle elevators return to the lobby.
+	TrafficUpPeak = "up_peak"
+	//TrafficDownPeak is used when most passengers travel down to the lobby, e.g. in the evening.
+	//Down orders are served first, and idle elevators park at the top floor to sweep down.
+	TrafficDownPeak = "down_peak"
+	//TrafficAuto detects the mode from the hall orders in the last trafficWindow
+	TrafficAuto = "auto"
+)
+
+//DefaultTrafficMode is the traffic mode used if none is configured
+const DefaultTrafficMode = TrafficNormal
+
+//trafficWindow is the period of hall orders used to detect the traffic mode
+const trafficWindow = 5 * time.Minute
+
+//trafficMinOrders is the number of hall orders in the window required to detect a peak
+const trafficMinOrders = 10
+
+//trafficPeakShare is the share of the hall orders in the window that must be in the peak direction
+const trafficPeakShare = 0.6
+
+//trafficMode contains the weights and parking of a traffic mode
+type trafficMode struct {
+	//upWeight and downWeight multiply the cost of hall orders in each direction
+	upWeight, downWeight float64
+	//lobbyWeight multiplies the cost of up orders at the lobby floor
+	lobbyWeight float64
+	//parking replaces the parking policy if set
+	parking string
+	//reserveWeight multiplies the cost of other hall orders for an elevator standing at the peak floor
+	reserveWeight float64
+}
+
+//trafficModes contains all traffic modes by name
+var trafficModes = map[string]trafficMode{
+	TrafficNormal:   {upWeight: 1, downWeight: 1, lobbyWeight: 1, reserveWeight: 1},
+	TrafficUpPeak:   {upWeight: 0.8, downWeight: 1.25, lobbyWeight: 0.5, parking: ParkingLobby, reserveWeight: 3},
+	TrafficDownPeak: {upWeight: 1.25, downWeight: 0.8, lobbyWeight: 1, parking: ParkingTop, reserveWeight: 3},
+}
+
+//ValidTrafficMode returns true if a traffic mode with the given name exists.
+//TrafficAuto is only valid if auto is set.
+func ValidTrafficMode(name string, auto bool) bool {
+	_, ok := trafficModes[name]
+	return ok || (auto && name == TrafficAuto)
+}
+
+//TrafficPeriod is a period of the day with a traffic mode.
+//From and To are the times since midnight, and the period passes midnight if To is before From.
+type TrafficPeriod struct {
+	From time.Duration
+	To   time.Duration
+	Mode string
+}
+
+//contains returns true if the time of day is in the period
+func (p TrafficPeriod) contains(timeOfDay time.Duration) bool {
+	return periodContains(p.From, p.To, timeOfDay)
+}
+
+//periodContains returns true if the time of day is in the period from and to, which passes midnight if to is before from
+func periodContains(from time.Duration, to time.Duration, timeOfDay time.Duration) bool {
+	if from <= to {
+		return timeOfDay >= from && timeOfDay < to
+	}
+	return timeOfDay >= from || timeOfDay < to
+}
+
+//timeOfDay returns the time since midnight in the local time of now
+func timeOfDay(now time.Time) time.Duration {
+	year, month, day := now.Date()
+	return now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+}
+
+//TrafficOverride is a traffic mode set manually for the whole building, sent on the traffic mode topic.
+//An empty mode removes the override.
+type TrafficOverride struct {
+	Mode     string `json:"mode"`
+	SenderID int    `json:"sender_id"`
+	//Timestamp is the hybrid logical clock time the override was set
+	Timestamp network.Timestamp `json:"timestamp"`
+}
+
+//newer returns true if the override o replaces the override other
+func (o TrafficOverride) newer(other TrafficOverride) bool {
+	if o.Timestamp != other.Timestamp {
+		return other.Timestamp.Before(o.Timestamp)
+	}
+	return o.SenderID > other.SenderID
+}
+
+//mergeTrafficOverride merges an override into the orders.
+//Returns true if the override changed, and false if the current override is the same or newer.
+func mergeTrafficOverride(orders *schedOrders, override TrafficOverride) (bool, error) {
+	if override.Mode != "" && !ValidTrafficMode(override.Mode, true) {
+		return false, fmt.Errorf("unknown traffic mode %q", override.Mode)
+	}
+	if orders.TrafficOverride != nil && !override.newer(*orders.TrafficOverride) {
+		return false, nil
+	}
+	orders.TrafficOverride = &override
+	return true, nil
+}
+
+//hallOrderRecord is a hall order used to detect the traffic mode
+type hallOrderRecord struct {
+	time  time.Time
+	order common.Order
+}
+
+//trafficDetector chooses the traffic mode, and records the recent hall orders
+type trafficDetector struct {
+	recent  []hallOrderRecord
+	current string
+}
+
+//recordOrder records a new hall order, and forgets the orders older than the window
+func (t *trafficDetector) recordOrder(order common.Order) {
+	t.prune()
+	t.recent = append(t.recent, hallOrderRecord{time: time.Now(), order: order})
+}
+
+//prune removes the hall orders older than the window
+func (t *trafficDetector) prune() {
+	for len(t.recent) > 0 && time.Since(t.recent[0].time) > trafficWindow {
+		t.recent = t.recent[1:]
+	}
+}
+
+//detect returns the traffic mode matching the hall orders in the window.
+//It is a peak if most orders are up orders at the lobby, or down orders to the lobby.
+func (t *trafficDetector) detect(lobby int) string {
+	t.prune()
+	if len(t.recent) < trafficMinOrders {
+		return TrafficNormal
+	}
+	up, down := 0, 0
+	for _, r := range t.recent {
+		if r.order.Dir == common.UpDir && r.order.Floor == lobby {
+			up++
+		} else if r.order.Dir == common.DownDir && r.order.Floor > lobby {
+			down++
+		}
+	}
+	total := float64(len(t.recent))
+	if float64(up) >= trafficPeakShare*total {
+		return TrafficUpPeak
+	} else if float64(down) >= trafficPeakShare*total {
+		return TrafficDownPeak
+	}
+	return TrafficNormal
+}
+
+//mode returns the current traffic mode, and logs when it changes.
+//An override is used before the schedule, and the schedule before the configured mode.
+func (t *trafficDetector) mode(orders *schedOrders, now time.Time, conf Config) string {
+	mode, source := conf.TrafficMode, "configuration"
+	for _, p := range conf.TrafficSchedule {
+		if p.contains(timeOfDay(now)) {
+			mode, source = p.Mode, "schedule"
+			break
+		}
+	}
+	if orders.TrafficOverride != nil && orders.TrafficOverride.Mode != "" {
+		mode, source = orders.TrafficOverride.Mode, "override"
+	}
+	if mode == TrafficAuto {
+		mode, source = t.detect(conf.LobbyFloor), "hall orders"
+	}
+	if _, ok := trafficModes[mode]; !ok {
+		mode = TrafficNormal
+	}
+	if mode != t.current {
+		if t.current != "" {
+			conf.Logger.With("source", source).Infof("Traffic mode changed from %s to %s", t.current, mode)
+		}
+		t.current = mode
+	}
+	return mode
+}
+
+//applyTrafficWeights weights the hall order costs of the traffic mode, so the elevator serves its orders
+//in the peak direction first. The weights are the same for all elevators, see trafficPolicy for the selection.
+func applyTrafficWeights(costs *common.OrderCosts, mode string, lobby int) {
+	m := trafficModes[mode]
+	for floor := range costs.HallUp {
+		costs.HallUp[floor] *= m.upWeight
+		if floor == lobby {
+			costs.HallUp[floor] *= m.lobbyWeight
+		}
+	}
+	for floor := range costs.HallDown {
+		costs.HallDown[floor] *= m.downWeight
+	}
+}
+
+//trafficPolicy is the traffic mode used by the coordinator to select elevators for hall orders
+type trafficPolicy struct {
+	mode  string
+	lobby int
+	top   int
+}
+
+//peakFloor returns the floor elevators are kept at for the peak. Returns false if the mode has no peak.
+func (p trafficPolicy) peakFloor() (int, bool) {
+	switch p.mode {
+	case TrafficUpPeak:
+		return p.lobby, true
+	case TrafficDownPeak:
+		return p.top, true
+	}
+	return 0, false
+}
+
+//peakOrder returns true for up orders at the lobby in up peak, and for down orders in down peak
+func (p trafficPolicy) peakOrder(order common.Order) bool {
+	switch p.mode {
+	case TrafficUpPeak:
+		return order.Dir == common.UpDir && order.Floor == p.lobby
+	case TrafficDownPeak:
+		return order.Dir == common.DownDir
+	}
+	return false
+}
+
+//weight returns the factor multiplying the cost of an elevator for a hall order.
+//An elevator standing at the peak floor is kept for the orders in the peak.
+func (p trafficPolicy) weight(costs *common.OrderCosts, order common.Order) float64 {
+	floor, ok := p.peakFloor()
+	if !ok || costs.Moving || costs.Floor != floor || p.peakOrder(order) {
+		return 1
+	}
+	return trafficModes[p.mode].reserveWeight
+}
+
+//trafficParking returns the parking policy in the traffic mode
+func trafficParking(mode string, configured string) string {
+	if p := trafficModes[mode].parking; p != "" {
+		return p
+	}
+	return configured
+}
+
+//applyTrafficOverride merges an override and logs it
+func applyTrafficOverride(orders *schedOrders, override TrafficOverride, logger *logging.Logger) error {
+	changed, err := mergeTrafficOverride(orders, override)
+	if err != nil || !changed {
+		return err
+	}
+	if override.Mode == "" {
+		logger.Infof("Traffic mode override removed by %d", override.SenderID)
+	} else {
+		logger.Infof("Traffic mode set to %s by %d", override.Mode, override.SenderID)
+	}
+	return nil
+}
+
+//setTrafficOverride sets or removes the override from the admin interface, and sends it to the other nodes
+func setTrafficOverride(ctx context.Context, orders *schedOrders, mode string, conf Config) error {
+	override := TrafficOverride{
+		Mode:      mode,
+		SenderID:  conf.ElevatorID,
+		Timestamp: conf.Clock.Now(),
+	}
+	if err := applyTrafficOverride(orders, override, conf.Logger); err != nil {
+		return err
+	}
+	//Send override to network when available
+	go utilities.SendMessage(ctx, conf.TrafficSend, override)
+	return nil
+}
@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+)
+
+//records returns n hall orders received age ago
+func records(n int, order common.Order, age time.Duration) []hallOrderRecord {
+	recent := make([]hallOrderRecord, n)
+	for i := range recent {
+		recent[i] = hallOrderRecord{time: time.Now().Add(-age), order: order}
+	}
+	return recent
+}
+
+func TestTrafficDetectorDetect(t *testing.T) {
+	lobbyUp := common.Order{Floor: 0, Dir: common.UpDir}
+	upperDown := common.Order{Floor: 3, Dir: common.DownDir}
+	upperUp := common.Order{Floor: 2, Dir: common.UpDir}
+	tests := []struct {
+		name   string
+		recent [][]hallOrderRecord
+		mode   string
+	}{
+		{"no orders", nil, TrafficNormal},
+		{"too few orders", [][]hallOrderRecord{records(trafficMinOrders-1, lobbyUp, 0)}, TrafficNormal},
+		{"up peak", [][]hallOrderRecord{records(trafficMinOrders, lobbyUp, 0)}, TrafficUpPeak},
+		{"up peak share", [][]hallOrderRecord{records(6, lobbyUp, 0), records(4, upperDown, 0)}, TrafficUpPeak},
+		{"below the peak share", [][]hallOrderRecord{records(5, lobbyUp, 0), records(5, upperDown, 0)}, TrafficNormal},
+		{"up orders above the lobby", [][]hallOrderRecord{records(trafficMinOrders, upperUp, 0)}, TrafficNormal},
+		{"down peak", [][]hallOrderRecord{records(2, lobbyUp, 0), records(8, upperDown, 0)}, TrafficDownPeak},
+		{"orders older than the window", [][]hallOrderRecord{records(trafficMinOrders, lobbyUp, trafficWindow+time.Minute)}, TrafficNormal},
+		{"old orders are forgotten", [][]hallOrderRecord{records(20, upperDown, trafficWindow+time.Minute), records(trafficMinOrders, lobbyUp, 0)}, TrafficUpPeak},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := &trafficDetector{}
+			for _, r := range test.recent {
+				detector.recent = append(detector.recent, r...)
+			}
+			if mode := detector.detect(0); mode != test.mode {
+				t.Errorf("got mode %s, want %s", mode, test.mode)
+			}
+		})
+	}
+}
+
+func TestApplyTrafficWeights(t *testing.T) {
+	tests := []struct {
+		mode     string
+		hallUp   []float64
+		hallDown []float64
+	}{
+		{TrafficNormal, []float64{1, 2, 4, 0}, []float64{0, 2, 4, 8}},
+		{TrafficUpPeak, []float64{0.4, 1.6, 3.2, 0}, []float64{0, 2.5, 5, 10}},
+		{TrafficDownPeak, []float64{1.25, 2.5, 5, 0}, []float64{0, 1.6, 3.2, 6.4}},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			costs := common.OrderCosts{HallUp: []float64{1, 2, 4, 0}, HallDown: []float64{0, 2, 4, 8}, Cab: []float64{1, 2, 4, 8}}
+			applyTrafficWeights(&costs, test.mode, 0)
+			if !reflect.DeepEqual(costs.HallUp, test.hallUp) || !reflect.DeepEqual(costs.HallDown, test.hallDown) {
+				t.Errorf("got up costs %v and down costs %v, want %v and %v", costs.HallUp, costs.HallDown, test.hallUp, test.hallDown)
+			}
+			if !reflect.DeepEqual(costs.Cab, []float64{1, 2, 4, 8}) {
+				t.Errorf("cab costs changed to %v", costs.Cab)
+			}
+		})
+	}
+}
+
+func TestSelectWorkerTraffic(t *testing.T) {
+	//Elevator 1 stands at the lobby, and elevator 2 stands at the top floor
+	workers := func() map[int]*common.OrderCosts {
+		return map[int]*common.OrderCosts{
+			1: {ID: 1, Floor: 0, HallUp: []float64{0.5, 1, 2, 0}, HallDown: []float64{0, 1, 2, 3}},
+			2: {ID: 2, Floor: 3, HallUp: []float64{3, 2, 1, 0}, HallDown: []float64{3, 2, 1, 0.5}},
+		}
+	}
+	tests := []struct {
+		name   string
+		mode   string
+		moving bool
+		order  common.Order
+		worker int
+	}{
+		{"normal selects the cheapest", TrafficNormal, false, common.Order{Floor: 1, Dir: common.UpDir}, 1},
+		{"up peak keeps the lobby elevator", TrafficUpPeak, false, common.Order{Floor: 1, Dir: common.UpDir}, 2},
+		{"up peak order at the lobby", TrafficUpPeak, false, common.Order{Floor: 0, Dir: common.UpDir}, 1},
+		{"up peak with a moving elevator", TrafficUpPeak, true, common.Order{Floor: 1, Dir: common.UpDir}, 1},
+		{"down peak keeps the top elevator", TrafficDownPeak, false, common.Order{Floor: 2, Dir: common.UpDir}, 1},
+		{"down peak down order", TrafficDownPeak, false, common.Order{Floor: 2, Dir: common.DownDir}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := workers()
+			w[1].Moving = test.moving
+			w[2].Moving = test.moving
+			traffic := trafficPolicy{mode: test.mode, lobby: 0, top: 3}
+			worker, err := selectWorker(w, test.order.Floor, test.order.Dir, traffic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if worker != test.worker {
+				t.Errorf("got elevator %d, want %d", worker, test.worker)
+			}
+			if worker, err := selectDestinationWorker(w, test.order, nil, traffic); err != nil || worker != test.worker {
+				t.Errorf("destination selection got elevator %d (%v), want %d", worker, err, test.worker)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+//serves returns true if the floor is one of the served floors. All floors are served if none are configured.
+func serves(served []int, floor int) bool {
+	return len(served) == 0 || containsFloors(served, []int{floor})
+}
+
+//unservedFloors returns the floors of the building that are not served, or nil if all floors are served.
+//They are advertised in the costs of the elevator, so hall orders are only assigned to elevators serving the floor.
+func unservedFloors(served []int, numFloors int) []int {
+	var unserved []int
+	for floor := 0; floor < numFloors; floor++ {
+		if !serves(served, floor) {
+			unserved = append(unserved, floor)
+		}
+	}
+	return unserved
+}
+
+//nearestServedFloor returns the served floor closest to floor, preferring the lower floor if two are equally close
+func nearestServedFloor(floor int, costs *common.OrderCosts, numFloors int) int {
+	for distance := 0; distance < numFloors; distance++ {
+		if below := floor - distance; below >= 0 && costs.Serves(below) {
+			return below
+		}
+		if above := floor + distance; above < numFloors && costs.Serves(above) {
+			return above
+		}
+	}
+	return floor
+}
+
+//cancelUnservedCabOrders removes cab orders for floors the elevator does not serve, e.g. after a reload
+func cancelUnservedCabOrders(orders *schedOrders, conf Config) {
+	for floor, order := range orders.Cab {
+		if order != nil && !serves(conf.ServedFloors, floor) {
+			orders.Cab[floor] = nil
+			conf.Logger.With(logging.FieldOrderID, order.OrderID).Infof("Cancelled cab order at floor %d, the floor is not served", floor)
+		}
+	}
+}
@@ -2,30 +2,42 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/HaavardM/TTK4145-Elevator/internal/admin"
 	"github.com/HaavardM/TTK4145-Elevator/internal/configuration"
 	"github.com/HaavardM/TTK4145-Elevator/internal/elevatorcontroller"
 	"github.com/HaavardM/TTK4145-Elevator/internal/elevatordriver"
 	"github.com/HaavardM/TTK4145-Elevator/internal/scheduler"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/supervisor"
 
 	"github.com/TTK4145/driver-go/elevio"
 )
 
+//Topics sent on the shared transport
 const (
 	//TopicNewOrder is a AtLeastOnceTopic used to send new orders
-	TopicNewOrder int = iota + 1
+	TopicNewOrder = "new_order"
 	//TopicOrderComplete is an AtLeastOnceTopic used to send order complete msgs
-	TopicOrderComplete
+	TopicOrderComplete = "order_complete"
 	//TopicHeartbeat is used to detect other nodes
-	TopicHeartbeat
+	TopicHeartbeat = "heartbeat"
+	//TopicHallRequest is an AtLeastOnceTopic used to request hall orders from the coordinator
+	TopicHallRequest = "hall_request"
+	//TopicSync is an AtLeastOnceTopic used to synchronize state when a node starts, and to back up cab orders
+	TopicSync = "sync"
+	//TopicFireRecall is an AtLeastOnceTopic used to start and reset fire service recall in the building
+	TopicFireRecall = "fire_recall"
+	//TopicTrafficMode is an AtLeastOnceTopic used to set the traffic mode of the building manually
+	TopicTrafficMode = "traffic_mode"
 )
 
 func main() {
@@ -34,7 +46,15 @@ func main() {
 	waitGroup := sync.WaitGroup{}
 
 	//Get configration
-	conf := configuration.GetConfig()
+	conf, err := configuration.GetConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	//Root logger - each module logs as its own component
+	logger := logging.New(os.Stdout, conf.ElevatorID, conf.LogLevels)
+	networkLogger := logger.Component("network")
 
 	//Create neccessary channels for the elevator
 	arrivedAtFloor := make(chan int)
@@ -42,12 +62,23 @@ func main() {
 	onButtonPress := make(chan elevio.ButtonEvent)
 	lightState := make(chan elevatordriver.LightState)
 	orderCompleted := make(chan common.Order)
+	destinationCall := make(chan common.DestinationCall)
+	carLoad := make(chan int)
+	credential := make(chan common.Credential)
+	//The keypads are only used in destination dispatch
+	var keypadDisplay chan elevatordriver.KeypadDisplay
+	if conf.DestinationDispatch {
+		keypadDisplay = make(chan elevatordriver.KeypadDisplay)
+	}
 
 	//Make these buffered to avoid blocking on send
 	//We do not require the scheduler and elevatorcontroller to be in perfect sync,
 	//but the order of the messages sent on these channels must be correct
 	order := make(chan common.Order, 1)
 	elevatorInfo := make(chan common.ElevatorStatus, 1)
+	doorMode := make(chan common.DoorMode, 1)
+	doorCommand := make(chan common.DoorCommand)
+	adminRequests := make(chan scheduler.AdminRequest)
 
 	topicNewOrderSend := make(chan scheduler.SchedulableOrder)
 	topicNewOrderRecv := make(chan scheduler.SchedulableOrder)
@@ -55,101 +86,351 @@ func main() {
 	topicOrderCompleteSend := make(chan scheduler.SchedulableOrder)
 	topicOrderCompleteRecv := make(chan scheduler.SchedulableOrder)
 	topicOrderCompleteExpectedAcks := make(chan []int)
+	topicHallRequestSend := make(chan scheduler.HallRequest)
+	topicHallRequestRecv := make(chan scheduler.HallRequest)
+	topicHallRequestExpectedAcks := make(chan []int)
+	topicSyncSend := make(chan scheduler.SyncMessage)
+	topicSyncRecv := make(chan scheduler.SyncMessage)
+	topicSyncExpectedAcks := make(chan []int)
+	topicFireRecallSend := make(chan scheduler.FireRecall)
+	topicFireRecallRecv := make(chan scheduler.FireRecall)
+	topicFireRecallExpectedAcks := make(chan []int)
+	topicTrafficModeSend := make(chan scheduler.TrafficOverride)
+	topicTrafficModeRecv := make(chan scheduler.TrafficOverride)
+	topicTrafficModeExpectedAcks := make(chan []int)
 
 	costSend := make(chan common.OrderCosts, 1)
 	costRecv := make(chan common.OrderCosts, 1)
 	workerLost := make(chan int, 1)
+	leadership := make(chan network.Leadership)
+
+	//Hybrid logical clock shared by all network modules and the scheduler
+	clock := network.NewClock()
+	//Addresses of the other nodes, learned from heartbeats
+	addresses := network.NewAddressBook()
+
+	//All topics are broadcast on one socket at the base port
+	//The codec is validated with the configuration
+	codec, _ := network.LookupCodec(conf.Network.Codec)
+	transport := network.NewTransport(network.Config{
+		ID:        conf.ElevatorID,
+		Port:      conf.BasePort,
+		Codec:     codec,
+		Key:       []byte(conf.Network.Key),
+		Clock:     clock,
+		Addresses: addresses,
+		Logger:    networkLogger.With("topic", "transport"),
+	})
+
+	//Point-to-point requests between nodes
+	unicast, err := network.NewUnicast(network.UnicastConfig{
+		Config: network.Config{
+			ID:        conf.ElevatorID,
+			Port:      conf.Network.UnicastPort,
+			Key:       []byte(conf.Network.Key),
+			Clock:     clock,
+			Addresses: addresses,
+			Logger:    networkLogger.With("topic", "unicast"),
+		},
+	})
+	if err != nil {
+		logger.Errorf("Unable to start unicast service: %s", err)
+		os.Exit(1)
+	}
+
+	//Runtime configuration updates - buffered so that only the latest update is kept
+	configReloaded := make(chan configuration.Config)
+	controllerReload := make(chan elevatorcontroller.RuntimeConfig, 1)
+	schedulerReload := make(chan scheduler.RuntimeConfig, 1)
+	heartbeatReload := make(chan network.HeartbeatTiming, 1)
+	configStore := configuration.NewStore(conf)
 
 	//Create elevator configuration
 	elevatorConf := elevatordriver.Config{
-		Address:        fmt.Sprintf("localhost:%d", conf.ElevatorPort),
-		NumberOfFloors: conf.Floors,
-		ArrivedAtFloor: arrivedAtFloor,
-		Commands:       elevatorCommand,
-		OnButtonPress:  onButtonPress,
-		SetStatusLight: lightState,
+		Address:           fmt.Sprintf("localhost:%d", conf.ElevatorPort),
+		NumberOfFloors:    conf.Floors,
+		ArrivedAtFloor:    arrivedAtFloor,
+		Commands:          elevatorCommand,
+		OnButtonPress:     onButtonPress,
+		SetStatusLight:    lightState,
+		Keypad:            conf.DestinationDispatch,
+		OnDestinationCall: destinationCall,
+		KeypadDisplay:     keypadDisplay,
+		LoadWeighing:      conf.LoadWeighing,
+		OnLoadChanged:     carLoad,
+		CardReader:        conf.CardReader,
+		OnCredential:      credential,
+		Logger:            logger.Component("elevatordriver"),
 	}
 
 	//Create elevator controller configuration
 	controllerConf := elevatorcontroller.Config{
-		ElevatorCommand: elevatorCommand,
-		Order:           order,
-		ArrivedAtFloor:  arrivedAtFloor,
-		NumberOfFloors:  conf.Floors,
-		OrderCompleted:  orderCompleted,
-		ElevatorStatus:  elevatorInfo,
+		ElevatorCommand:   elevatorCommand,
+		Order:             order,
+		ArrivedAtFloor:    arrivedAtFloor,
+		NumberOfFloors:    conf.Floors,
+		OrderCompleted:    orderCompleted,
+		ElevatorStatus:    elevatorInfo,
+		DoorOpenDuration:  conf.Controller.DoorOpenDuration.Duration,
+		MotorStallTimeout: conf.Controller.MotorStallTimeout.Duration,
+		Reload:            controllerReload,
+		DoorMode:          doorMode,
+		DoorCommand:       doorCommand,
+		Load:              carLoad,
+		BypassLoad:        conf.Controller.BypassLoad,
+		PassengerLoad:     conf.Controller.PassengerLoad,
+		Logger:            logger.Component("elevatorcontroller"),
 	}
 
 	topicNewOrderConf := network.AtLeastOnceConfig{
 		Config: network.Config{
-			Port: conf.BasePort + TopicNewOrder,
-			ID:   conf.ElevatorID,
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicNewOrder,
+			Logger:    networkLogger.With("topic", TopicNewOrder),
 		},
-		Send:        topicNewOrderSend,
-		Receive:     topicNewOrderRecv,
-		NodesOnline: topicNewOrderExpectedAcks,
+		Send:           topicNewOrderSend,
+		Receive:        topicNewOrderRecv,
+		NodesOnline:    topicNewOrderExpectedAcks,
+		ResendInterval: conf.Network.ResendInterval.Duration,
 	}
 
 	topicOrderCompletedConf := network.AtLeastOnceConfig{
 		Config: network.Config{
-			Port: conf.BasePort + TopicOrderComplete,
-			ID:   conf.ElevatorID,
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicOrderComplete,
+			Logger:    networkLogger.With("topic", TopicOrderComplete),
+		},
+		Send:           topicOrderCompleteSend,
+		Receive:        topicOrderCompleteRecv,
+		NodesOnline:    topicOrderCompleteExpectedAcks,
+		ResendInterval: conf.Network.ResendInterval.Duration,
+	}
+
+	topicHallRequestConf := network.AtLeastOnceConfig{
+		Config: network.Config{
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicHallRequest,
+			Logger:    networkLogger.With("topic", TopicHallRequest),
 		},
-		Send:        topicOrderCompleteSend,
-		Receive:     topicOrderCompleteRecv,
-		NodesOnline: topicOrderCompleteExpectedAcks,
+		Send:           topicHallRequestSend,
+		Receive:        topicHallRequestRecv,
+		NodesOnline:    topicHallRequestExpectedAcks,
+		ResendInterval: conf.Network.ResendInterval.Duration,
+	}
+
+	topicSyncConf := network.AtLeastOnceConfig{
+		Config: network.Config{
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicSync,
+			Logger:    networkLogger.With("topic", TopicSync),
+		},
+		Send:           topicSyncSend,
+		Receive:        topicSyncRecv,
+		NodesOnline:    topicSyncExpectedAcks,
+		ResendInterval: conf.Network.ResendInterval.Duration,
+	}
+
+	topicFireRecallConf := network.AtLeastOnceConfig{
+		Config: network.Config{
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicFireRecall,
+			Logger:    networkLogger.With("topic", TopicFireRecall),
+		},
+		Send:           topicFireRecallSend,
+		Receive:        topicFireRecallRecv,
+		NodesOnline:    topicFireRecallExpectedAcks,
+		ResendInterval: conf.Network.ResendInterval.Duration,
+	}
+
+	topicTrafficModeConf := network.AtLeastOnceConfig{
+		Config: network.Config{
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicTrafficMode,
+			Logger:    networkLogger.With("topic", TopicTrafficMode),
+		},
+		Send:           topicTrafficModeSend,
+		Receive:        topicTrafficModeRecv,
+		NodesOnline:    topicTrafficModeExpectedAcks,
+		ResendInterval: conf.Network.ResendInterval.Duration,
 	}
 
 	heartbeatConf := network.HeartbeatConfig{
 		Config: network.Config{
-			ID:   conf.ElevatorID,
-			Port: conf.BasePort + TopicHeartbeat,
+			ID:        conf.ElevatorID,
+			Transport: transport,
+			Topic:     TopicHeartbeat,
+			Addresses: addresses,
+			Logger:    networkLogger.With("topic", TopicHeartbeat),
 		},
+		UnicastPort:   unicast.Port(),
 		CostIn:        costSend,
 		CostOut:       costRecv,
 		LostElevators: workerLost,
+		Leadership:    leadership,
+		Interval:      conf.Network.HeartbeatInterval.Duration,
+		Timeout:       conf.Network.HeartbeatTimeout.Duration,
+		Reload:        heartbeatReload,
+	}
+	//Membership changes are only published to the admin interface
+	var membership chan []network.Member
+	if conf.AdminAddress != "" {
+		membership = make(chan []network.Member)
+		heartbeatConf.Membership = membership
 	}
 
 	schedulerConf := scheduler.Config{
-		NumFloors:          conf.Floors,
-		NewOrderRecv:       topicNewOrderRecv,
-		NewOrderSend:       topicNewOrderSend,
-		OrderCompletedRecv: topicOrderCompleteRecv,
-		OrderCompletedSend: topicOrderCompleteSend,
-		ElevStatus:         elevatorInfo,
-		ElevatorID:         conf.ElevatorID,
-		ElevButtonPressed:  onButtonPress,
-		ElevCompletedOrder: orderCompleted,
-		Lights:             lightState,
-		CostsSend:          costSend,
-		CostsRecv:          costRecv,
-		ElevExecuteOrder:   order,
-		FilePath:           conf.FilePath,
-		WorkerLost:         workerLost,
+		NumFloors:           conf.Floors,
+		NewOrderRecv:        topicNewOrderRecv,
+		NewOrderSend:        topicNewOrderSend,
+		OrderCompletedRecv:  topicOrderCompleteRecv,
+		OrderCompletedSend:  topicOrderCompleteSend,
+		HallRequestSend:     topicHallRequestSend,
+		HallRequestRecv:     topicHallRequestRecv,
+		SyncSend:            topicSyncSend,
+		SyncRecv:            topicSyncRecv,
+		FireRecallSend:      topicFireRecallSend,
+		FireRecallRecv:      topicFireRecallRecv,
+		TrafficSend:         topicTrafficModeSend,
+		TrafficRecv:         topicTrafficModeRecv,
+		RecallFloor:         conf.Fire.RecallFloor,
+		Admin:               adminRequests,
+		ElevStatus:          elevatorInfo,
+		ElevDoorMode:        doorMode,
+		ElevDoorCommand:     doorCommand,
+		ElevatorID:          conf.ElevatorID,
+		ElevButtonPressed:   onButtonPress,
+		ElevDestinationCall: destinationCall,
+		KeypadDisplay:       keypadDisplay,
+		ElevCredential:      credential,
+		ElevCompletedOrder:  orderCompleted,
+		Lights:              lightState,
+		CostsSend:           costSend,
+		CostsRecv:           costRecv,
+		ElevExecuteOrder:    order,
+		FilePath:            conf.FilePath,
+		WorkerLost:          workerLost,
+		Leadership:          leadership,
+		Clock:               clock,
+		Unicast:             unicast,
+		OrderTimeout:        conf.Scheduler.OrderTimeout.Duration,
+		CabPenalty:          conf.Scheduler.CabPenalty,
+		CostFunction:        conf.Scheduler.CostFunction,
+		Parking:             conf.Scheduler.Parking,
+		LobbyFloor:          conf.Scheduler.LobbyFloor,
+		ParkingDelay:        conf.Scheduler.ParkingDelay.Duration,
+		TrafficMode:         conf.Scheduler.TrafficMode,
+		TrafficSchedule:     conf.Scheduler.SchedulerPeriods(),
+		ServedFloors:        conf.Scheduler.ServedFloors,
+		SecuredFloors:       conf.Scheduler.SchedulerSecuredFloors(),
+		AuthorizedCards:     conf.Scheduler.AuthorizedCards,
+		AccessWindow:        conf.Scheduler.AccessWindow.Duration,
+		LoadWeighing:        conf.LoadWeighing,
+		NuisanceStops:       conf.Scheduler.NuisanceStops,
+		CallsPerPassenger:   conf.Scheduler.CallsPerPassenger,
+		Reload:              schedulerReload,
+		Logger:              logger.Component("scheduler"),
 	}
 
+	//Each module is restarted by a supervisor if it fails,
+	//while the rest of the node keeps serving
+	supervisorConf := supervisor.DefaultConfig(logger.Component("supervisor"))
+
 	//Launch modules
-	go elevatordriver.Run(ctx, elevatorConf)
-	go elevatorcontroller.Run(ctx, controllerConf)
+	go supervisor.Run(ctx, supervisorConf, "elevatordriver", func(ctx context.Context) error {
+		return elevatordriver.Run(ctx, elevatorConf)
+	})
+	go supervisor.Run(ctx, supervisorConf, "elevatorcontroller", func(ctx context.Context) error {
+		//Use the latest runtime configuration if restarted after a reload
+		c := controllerConf
+		r := controllerRuntime(configStore.Get())
+		c.DoorOpenDuration, c.MotorStallTimeout, c.BypassLoad = r.DoorOpenDuration, r.MotorStallTimeout, r.BypassLoad
+		c.PassengerLoad = r.PassengerLoad
+		return elevatorcontroller.Run(ctx, c)
+	})
+
+	go supervisor.Run(ctx, supervisorConf, "transport", transport.Run)
 
-	//Create two AtLeastOnce topics
-	go network.RunAtLeastOnce(ctx, topicNewOrderConf)
-	go network.RunAtLeastOnce(ctx, topicOrderCompletedConf)
+	//Create AtLeastOnce topics
+	go supervisor.Run(ctx, supervisorConf, "topic_new_order", func(ctx context.Context) error {
+		return network.RunAtLeastOnce(ctx, topicNewOrderConf)
+	})
+	go supervisor.Run(ctx, supervisorConf, "topic_order_complete", func(ctx context.Context) error {
+		return network.RunAtLeastOnce(ctx, topicOrderCompletedConf)
+	})
+	go supervisor.Run(ctx, supervisorConf, "topic_hall_request", func(ctx context.Context) error {
+		return network.RunAtLeastOnce(ctx, topicHallRequestConf)
+	})
+	go supervisor.Run(ctx, supervisorConf, "topic_sync", func(ctx context.Context) error {
+		return network.RunAtLeastOnce(ctx, topicSyncConf)
+	})
+	go supervisor.Run(ctx, supervisorConf, "topic_fire_recall", func(ctx context.Context) error {
+		return network.RunAtLeastOnce(ctx, topicFireRecallConf)
+	})
+	go supervisor.Run(ctx, supervisorConf, "topic_traffic_mode", func(ctx context.Context) error {
+		return network.RunAtLeastOnce(ctx, topicTrafficModeConf)
+	})
+
+	go supervisor.Run(ctx, supervisorConf, "unicast", unicast.Run)
 
 	//Create heartbeat module
-	go network.RunHeartbeat(ctx, heartbeatConf, topicNewOrderExpectedAcks, topicOrderCompleteExpectedAcks)
+	go supervisor.Run(ctx, supervisorConf, "heartbeat", func(ctx context.Context) error {
+		c := heartbeatConf
+		r := heartbeatRuntime(configStore.Get())
+		c.Interval, c.Timeout = r.Interval, r.Timeout
+		return network.RunHeartbeat(ctx, c, topicNewOrderExpectedAcks, topicOrderCompleteExpectedAcks, topicHallRequestExpectedAcks, topicSyncExpectedAcks, topicFireRecallExpectedAcks, topicTrafficModeExpectedAcks)
+	})
+
+	//The admin interface is optional
+	if conf.AdminAddress != "" {
+		adminConf := admin.Config{
+			Address:    conf.AdminAddress,
+			Requests:   adminRequests,
+			Membership: membership,
+			Logger:     logger.Component("admin"),
+		}
+		go supervisor.Run(ctx, supervisorConf, "admin", func(ctx context.Context) error {
+			return admin.Run(ctx, adminConf)
+		})
+	}
 
 	//Wait for scheduler to complete
 	waitGroup.Add(1)
-	go scheduler.Run(ctx, &waitGroup, schedulerConf)
+	go func() {
+		defer waitGroup.Done()
+		supervisor.Run(ctx, supervisorConf, "scheduler", func(ctx context.Context) error {
+			c := schedulerConf
+			r := schedulerRuntime(configStore.Get())
+			c.OrderTimeout, c.CabPenalty, c.CostFunction = r.OrderTimeout, r.CabPenalty, r.CostFunction
+			c.Parking, c.LobbyFloor, c.ParkingDelay = r.Parking, r.LobbyFloor, r.ParkingDelay
+			c.TrafficMode, c.TrafficSchedule, c.ServedFloors = r.TrafficMode, r.TrafficSchedule, r.ServedFloors
+			c.SecuredFloors, c.AuthorizedCards, c.AccessWindow = r.SecuredFloors, r.AuthorizedCards, r.AccessWindow
+			c.NuisanceStops, c.CallsPerPassenger = r.NuisanceStops, r.CallsPerPassenger
+			return scheduler.Run(ctx, c)
+		})
+	}()
+
+	//Reload runtime configuration on SIGHUP or when the configuration file changes
+	go configuration.RunWatcher(ctx, configuration.WatcherConfig{
+		Current:      conf,
+		PollInterval: 2 * time.Second,
+		Reloaded:     configReloaded,
+		Logger:       logger.Component("configuration"),
+	})
+	go runForwardReloads(ctx, configStore, configReloaded, controllerReload, schedulerReload, heartbeatReload)
 
 	//Handle signals to get a graceful shutdown
-	sig := make(chan os.Signal)
-	go handleSignals(sig, cancel)
+	sig := make(chan os.Signal, 1)
+	go handleSignals(sig, cancel, logger)
 	signal.Notify(sig, os.Interrupt, os.Kill)
 
 	//Greeting
-	log.Println("Elevator ready with id ", conf.ElevatorID)
+	logger.Infof("Elevator ready with id %d", conf.ElevatorID)
 
 	//Wait for shutdown
 	<-ctx.Done()
@@ -159,9 +440,9 @@ func main() {
 	os.Exit(0)
 }
 
-func handleSignals(sig <-chan os.Signal, cancelCtx func()) {
+func handleSignals(sig <-chan os.Signal, cancelCtx func(), logger *logging.Logger) {
 	if cancelCtx == nil {
-		log.Panicln("Invalid cancel function")
+		logger.Panicf("Invalid cancel function")
 	}
 	<-sig
 	cancelCtx()
@@ -0,0 +1,6 @@
+package common
+
+//Credential is presented at the card reader of the car to reach secured floors
+type Credential struct {
+	Card int `json:"card"`
+}
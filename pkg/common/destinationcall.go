@@ -0,0 +1,17 @@
+package common
+
+//DestinationCall is a call from a destination dispatch keypad, where the passenger enters the
+//destination floor before boarding instead of pressing a hall button
+type DestinationCall struct {
+	Origin      int `json:"origin"`
+	Destination int `json:"destination"`
+}
+
+//Order returns the hall order at the origin in the direction of the destination
+func (c DestinationCall) Order() Order {
+	dir := UpDir
+	if c.Destination < c.Origin {
+		dir = DownDir
+	}
+	return Order{Floor: c.Origin, Dir: dir}
+}
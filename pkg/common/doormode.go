@@ -0,0 +1,38 @@
+package common
+
+//DoorMode specifies how the elevator operates the doors
+type DoorMode int
+
+const (
+	//DoorAutomatic opens the doors at the floor of an order and closes them after a while
+	DoorAutomatic DoorMode = iota
+	//DoorHoldOpen opens the doors at the floor of an order and keeps them open until another order is received.
+	//Used when recalled by the fire service.
+	DoorHoldOpen
+	//DoorManual only opens and closes the doors on commands from an operator.
+	//The elevator stops at the floor of an order with the doors closed.
+	DoorManual
+)
+
+//Returns a string representation of the door mode
+func (m DoorMode) String() string {
+	switch m {
+	case DoorAutomatic:
+		return "Automatic"
+	case DoorHoldOpen:
+		return "HoldOpen"
+	case DoorManual:
+		return "Manual"
+	}
+	return "Unknown"
+}
+
+//DoorCommand is a command from an operator when the doors are operated manually
+type DoorCommand int
+
+const (
+	//OpenDoors opens the doors if the elevator is standing still
+	OpenDoors DoorCommand = iota + 1
+	//CloseDoors closes the doors
+	CloseDoors
+)
@@ -6,4 +6,13 @@ type ElevatorStatus struct {
 	Moving   bool
 	Floor    int
 	Error    bool
+	//Load is the load of the car in percent of the capacity
+	Load int
+	//Full is set when the load is above the bypass threshold, so hall orders are passed by
+	Full bool
+	//Passengers is the number of passengers estimated from the load
+	Passengers int
+	//EmptyStops is the number of stops for cab orders in a row where no passengers entered or left the car.
+	//Only counted with load weighing.
+	EmptyStops int
 }
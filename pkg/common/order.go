@@ -4,4 +4,6 @@ package common
 type Order struct {
 	Dir   Direction `json:"direction"`
 	Floor int       `json:"floor"`
+	//Park is set when an idle elevator is sent to a parking floor. The elevator stops there with the doors closed.
+	Park bool `json:"park,omitempty"`
 }
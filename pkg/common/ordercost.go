@@ -1,10 +1,31 @@
 package common
 
 //OrderCosts contains ID of an elevator, number of orders the elevator has and its cost to the different floors.
+//Hall orders are not assigned to an unavailable elevator, e.g. in independent service.
 type OrderCosts struct {
-	ID         int       `json:"id"`
-	OrderCount int       `json:"order_count"`
-	HallUp     []float64 `json:"cost_up"`
-	HallDown   []float64 `json:"cost_down"`
-	Cab        []float64 `json:"cost_cab"`
+	ID          int       `json:"id"`
+	OrderCount  int       `json:"order_count"`
+	HallUp      []float64 `json:"cost_up"`
+	HallDown    []float64 `json:"cost_down"`
+	Cab         []float64 `json:"cost_cab"`
+	Unavailable bool      `json:"unavailable,omitempty"`
+	//Full is set when the car is full and passes hall orders by
+	Full bool `json:"full,omitempty"`
+	//Stops are the floors the elevator will stop at to let passengers off, used to group destination calls
+	Stops []int `json:"stops,omitempty"`
+	//Unserved are the floors the elevator does not serve, e.g. floors skipped by an express car
+	Unserved []int `json:"unserved,omitempty"`
+	//Floor is the last floor of the elevator, and Moving is set while it travels
+	Floor  int  `json:"floor"`
+	Moving bool `json:"moving,omitempty"`
+}
+
+//Serves returns true if the elevator serves the floor
+func (c *OrderCosts) Serves(floor int) bool {
+	for _, f := range c.Unserved {
+		if f == floor {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,236 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Level is the severity of a log entry
+type Level int
+
+const (
+	//DebugLevel is used for detailed information useful when debugging
+	DebugLevel Level = iota + 1
+	//InfoLevel is used for normal operational messages
+	InfoLevel
+	//WarnLevel is used for unexpected, but recoverable events
+	WarnLevel
+	//ErrorLevel is used for errors
+	ErrorLevel
+)
+
+const (
+	//FieldNodeID is the field containing the id of the node
+	FieldNodeID = "node_id"
+	//FieldComponent is the field containing the name of the component
+	FieldComponent = "component"
+	//FieldOrderID is the field containing the id of an order
+	FieldOrderID = "order_id"
+	//FieldMessageID is the field containing the id of a network message
+	FieldMessageID = "message_id"
+)
+
+//Returns a string representation of the level
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return fmt.Sprintf("%d", l)
+}
+
+//ParseLevel returns the level with the given name
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+//Levels contains the minimum level logged by each component
+type Levels struct {
+	//Default is used for components without their own level
+	Default Level
+	//Components maps component names to levels
+	Components map[string]Level
+}
+
+//ParseLevels parses a comma separated list of levels, e.g. "info,scheduler=debug,network=warn".
+//An entry without a component name sets the default level.
+func ParseLevels(s string) (Levels, error) {
+	levels := Levels{
+		Default:    InfoLevel,
+		Components: make(map[string]Level),
+	}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			l, err := ParseLevel(parts[0])
+			if err != nil {
+				return levels, err
+			}
+			levels.Default = l
+			continue
+		}
+		l, err := ParseLevel(parts[1])
+		if err != nil {
+			return levels, err
+		}
+		levels.Components[strings.TrimSpace(parts[0])] = l
+	}
+	return levels, nil
+}
+
+//level returns the minimum level for a component
+func (l Levels) level(component string) Level {
+	if level, ok := l.Components[component]; ok {
+		return level
+	}
+	if l.Default == 0 {
+		return InfoLevel
+	}
+	return l.Default
+}
+
+//output is shared by all loggers created from the same root to avoid interleaved lines
+type output struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+//field is a key-value pair added to every entry of a logger
+type field struct {
+	key   string
+	value interface{}
+}
+
+//Logger writes structured log entries as JSON lines.
+//A nil Logger discards all entries.
+type Logger struct {
+	out       *output
+	levels    Levels
+	nodeID    int
+	component string
+	fields    []field
+}
+
+//New creates a root logger writing to w
+func New(w io.Writer, nodeID int, levels Levels) *Logger {
+	if w == nil {
+		w = os.Stderr
+	}
+	return &Logger{
+		out:    &output{w: w},
+		levels: levels,
+		nodeID: nodeID,
+	}
+}
+
+//Component returns a logger for the named component
+func (l *Logger) Component(name string) *Logger {
+	if l == nil {
+		return nil
+	}
+	child := *l
+	child.component = name
+	return &child
+}
+
+//With returns a logger adding the field to every entry
+func (l *Logger) With(key string, value interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	child := *l
+	//Copy to avoid sharing the underlying array with siblings
+	child.fields = append(make([]field, 0, len(l.fields)+1), l.fields...)
+	child.fields = append(child.fields, field{key: key, value: value})
+	return &child
+}
+
+//Enabled returns true if entries at the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.levels.level(l.component)
+}
+
+//Debugf logs a formatted message at debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, format, args...)
+}
+
+//Infof logs a formatted message at info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, format, args...)
+}
+
+//Warnf logs a formatted message at warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(WarnLevel, format, args...)
+}
+
+//Errorf logs a formatted message at error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args...)
+}
+
+//Panicf logs a formatted message at error level and panics
+func (l *Logger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	l.log(ErrorLevel, "%s", msg)
+	panic(msg)
+}
+
+//log writes a single entry as a JSON line
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	entry := make(map[string]interface{}, len(l.fields)+5)
+	for _, f := range l.fields {
+		entry[f.key] = f.value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry[FieldNodeID] = l.nodeID
+	if l.component != "" {
+		entry[FieldComponent] = l.component
+	}
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		//Fall back to a message without the fields that failed to marshal
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":         entry["time"],
+			"level":        entry["level"],
+			FieldNodeID:    l.nodeID,
+			FieldComponent: l.component,
+			"msg":          entry["msg"],
+			"log_error":    err.Error(),
+		})
+	}
+	l.out.mtx.Lock()
+	defer l.out.mtx.Unlock()
+	l.out.w.Write(append(data, '\n'))
+}
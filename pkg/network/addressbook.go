@@ -0,0 +1,63 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+//ErrUnknownNode is returned when the address of a node is not known
+var ErrUnknownNode = errors.New("unknown node address")
+
+//AddressBook contains the unicast addresses of the other nodes.
+//The ip address is taken from received broadcasts, and the unicast port from heartbeats.
+//A nil *AddressBook is not updated, and knows no addresses.
+type AddressBook struct {
+	mtx   sync.Mutex
+	ips   map[int]net.IP
+	ports map[int]int
+}
+
+//NewAddressBook creates an empty address book
+func NewAddressBook() *AddressBook {
+	return &AddressBook{
+		ips:   make(map[int]net.IP),
+		ports: make(map[int]int),
+	}
+}
+
+//observeIP records the ip address a node sends from
+func (b *AddressBook) observeIP(id int, ip net.IP) {
+	if b == nil || ip == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.ips[id] = ip
+}
+
+//setPort records the unicast port advertised by a node
+func (b *AddressBook) setPort(id int, port int) {
+	if b == nil || port <= 0 {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.ports[id] = port
+}
+
+//Lookup returns the unicast address of a node.
+//Returns ErrUnknownNode if no heartbeat has been received from the node.
+func (b *AddressBook) Lookup(id int) (*net.UDPAddr, error) {
+	if b == nil {
+		return nil, ErrUnknownNode
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ip, ipOK := b.ips[id]
+	port, portOK := b.ports[id]
+	if !ipOK || !portOK {
+		return nil, ErrUnknownNode
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
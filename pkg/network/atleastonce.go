@@ -1,23 +1,22 @@
 package network
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"reflect"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
 	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
 	"github.com/rs/xid"
 )
 
 type atLeastOnceMsg struct {
-	Ack       bool        `json:"ack"`
-	SenderID  int         `json:"sender_id"`
-	MessageID string      `json:"message_id"`
-	Data      interface{} `json:"data"`
+	Ack       bool    `json:"ack"`
+	SenderID  int     `json:"sender_id"`
+	MessageID string  `json:"message_id"`
+	Data      Payload `json:"data"`
 }
 
 //IDSet is a set of ids (ints)
@@ -31,11 +30,24 @@ type AtLeastOnceConfig struct {
 	Send        interface{}
 	Receive     interface{}
 	NodesOnline <-chan []int
+	//ResendInterval is the time between resends of unacknowledged messages
+	ResendInterval time.Duration
 }
 
+//Used if no resend interval is configured
+const defaultResendInterval = 50 * time.Millisecond
+
 //RunAtLeastOnce runs at most once publishing at a certain port
 //Service is limited to one datatype per port
-func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
+//Returns an error if the underlying connection fails. Messages not yet acknowledged are lost.
+func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) error {
+	//Stop all publishers and the AtMostOnce service on exit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if conf.ResendInterval <= 0 {
+		conf.ResendInterval = defaultResendInterval
+	}
 
 	//Store received acks for current messages
 	acks := make(map[string]IDSet)
@@ -49,21 +61,17 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 	//Get type of data sent on input/output channel
 	T := reflect.TypeOf(conf.Send).Elem()
 	if reflect.TypeOf(conf.Receive).Elem() != T {
-		log.Panic("Datatypes for send and receive not consistent")
+		conf.Logger.Panicf("Datatypes for send and receive not consistent")
 	}
 
 	//Create channels
 	bSend := make(chan atLeastOnceMsg)
 	bRecv := make(chan atLeastOnceMsg)
 	ret := make(chan atLeastOnceMsg)
-	defer close(bSend)
-	defer close(bRecv)
-	defer close(ret)
 	//Get input channel as a type agnostic interface channel
 	atleastOnceInput, err := utilities.ReflectChan2InterfaceChan(ctx, reflect.ValueOf(conf.Send))
-	recvChan := reflect.ValueOf(conf.Receive)
 	if err != nil {
-		log.Panicln("Error starting atleastonce: ", err)
+		return err
 	}
 
 	//Start AtMostOnce service
@@ -72,13 +80,18 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 		Receive: bRecv,
 		Config:  conf.Config,
 	}
-	go RunAtMostOnce(ctx, c)
+	atMostOnceErr := make(chan error, 1)
+	go func() {
+		atMostOnceErr <- RunAtMostOnce(ctx, c)
+	}()
 
 	//Wait for new input
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
+		case err := <-atMostOnceErr:
+			return err
 		//When a new message is ready to send
 		case m := <-atleastOnceInput:
 			msgCounter++
@@ -86,14 +99,14 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 				Ack:       false,
 				SenderID:  conf.ID,
 				MessageID: fmt.Sprintf("%s:%d", xid.New().String(), msgCounter),
-				Data:      m,
+				Data:      NewPayload(m),
 			}
 			//Create child context - cancellable when all acks received
 			sendCtx, cancel := context.WithCancel(ctx)
 			publishers[msg.MessageID] = cancel
 			acks[msg.MessageID] = make(IDSet)
 			//Start a new goroutine to send same message at fixed interval
-			go sendUntilDone(sendCtx, msg, bSend, ret)
+			go sendUntilDone(ctx, sendCtx, msg, conf.ResendInterval, bSend, ret)
 		//When a send
 		case r := <-ret:
 			//Cleanup
@@ -101,16 +114,13 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 				delete(publishers, r.MessageID)
 			}
 
-			b, err := json.Marshal(r.Data)
-			if err != nil {
-				log.Println("Error receiving message: ", err)
-			}
+			//The data is only decoded here, when the type is known
 			v := reflect.New(T)
-			err = json.Unmarshal(b, v.Interface())
-			if err != nil {
-				log.Panicln("Failed unmarshal")
+			if err := r.Data.Decode(v.Interface()); err != nil {
+				conf.Logger.With(logging.FieldMessageID, r.MessageID).Errorf("Dropping message - failed decode: %s", err)
+				continue
 			}
-			go recvChan.Send(reflect.Indirect(v))
+			go utilities.SendMessage(ctx, conf.Receive, reflect.Indirect(v).Interface())
 		case m := <-bRecv:
 			//Send ack to corresponding goroutine
 			if m.Ack {
@@ -118,10 +128,13 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 					idSet[m.SenderID] = struct{}{}
 				}
 			} else {
-				//Send ACK
-				m.Ack = true
-				m.SenderID = conf.ID
-				bSend <- m
+				//Send ACK without the data
+				ack := atLeastOnceMsg{
+					Ack:       true,
+					SenderID:  conf.ID,
+					MessageID: m.MessageID,
+				}
+				go utilities.SendMessage(ctx, bSend, ack)
 				go utilities.SendMessage(ctx, ret, m)
 			}
 		//Set nodesOnline to updated value
@@ -148,10 +161,10 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 						//Cancel send go routine
 						c()
 					} else {
-						log.Println("Missing cancel function for test")
+						conf.Logger.With(logging.FieldMessageID, m).Warnf("Missing cancel function")
 					}
 				} else {
-					log.Println("Test name from receivedAcks not in activeMsgs")
+					conf.Logger.With(logging.FieldMessageID, m).Warnf("Acked message not in active publishers")
 				}
 				delete(publishers, m)
 				delete(acks, m)
@@ -160,20 +173,30 @@ func RunAtLeastOnce(ctx context.Context, conf AtLeastOnceConfig) {
 	}
 }
 
-//Send until context ends
-func sendUntilDone(ctx context.Context, content atLeastOnceMsg, send chan<- atLeastOnceMsg, ret chan<- atLeastOnceMsg) {
-	timer := time.NewTicker(50 * time.Millisecond)
+//Send until sendCtx ends, then return the message on ret unless runCtx has ended
+//The message is always sent at least once, also if no other nodes are known
+func sendUntilDone(runCtx context.Context, sendCtx context.Context, content atLeastOnceMsg, interval time.Duration, send chan<- atLeastOnceMsg, ret chan<- atLeastOnceMsg) {
+	select {
+	case send <- content:
+	case <-runCtx.Done():
+		return
+	}
+	timer := time.NewTicker(interval)
 	defer timer.Stop()
 	//While not received all acks
 	done := false
 
 	for !done {
 		select {
-		case <-ctx.Done():
+		case <-sendCtx.Done():
 			done = true
 		case <-timer.C:
-			send <- content
+			select {
+			case send <- content:
+			case <-sendCtx.Done():
+				done = true
+			}
 		}
 	}
-	ret <- content
+	utilities.SendMessage(runCtx, ret, content)
 }
@@ -1,7 +1,6 @@
 package network
 
 import (
-	"log"
 	"reflect"
 
 	"golang.org/x/net/context"
@@ -16,44 +15,66 @@ type AtMostOnceConfig struct {
 	Send interface{}
 	//Receive is the channel used to receive data from the network. Must be of same type as Send
 	Receive interface{}
+	//AnyVersion receives messages with unsupported protocol versions. Fields used to detect
+	//incompatible nodes must be readable by all versions. Messages with unsupported versions are
+	//received even if some fields can not be decoded.
+	AnyVersion bool
 }
 
-//RunAtMostOnce runs at most once publishing at a certain port
-//Service is limited to one datatype per port
+//RunAtMostOnce runs at most once publishing on a topic
+//Service is limited to one datatype per topic
+//Messages are sent on the shared transport if set, otherwise on a socket of its own at the configured port
 //We use reflection to allow multiple channel types. The network module does not care what the user want to send.
-func RunAtMostOnce(ctx context.Context, conf AtMostOnceConfig) {
-	//Signal done when ready to exit
-	//Create channels
-	atMostOnceTx, err := utilities.ReflectChan2InterfaceChan(ctx, reflect.ValueOf(conf.Send))
-	if err != nil {
-		log.Panicln("Error starting AtMostOnce: ", err)
-	}
-	atMostOnceRx := make(chan interface{})
-	defer close(atMostOnceRx)
+//Returns an error if the connection fails.
+func RunAtMostOnce(ctx context.Context, conf AtMostOnceConfig) error {
+	//Stop transmitter and receiver on exit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	//Get datatype of send element
 	T := reflect.TypeOf(conf.Send).Elem()
 	if reflect.TypeOf(conf.Receive).Elem() != T {
-		log.Panicf("Inconsistent types in AtMostOnce")
+		conf.Logger.Panicf("Inconsistent types in AtMostOnce")
 	}
 
-	//Get channel from reflect
-	outChan := reflect.ValueOf(conf.Receive)
+	//Create channels
+	atMostOnceTx, err := utilities.ReflectChan2InterfaceChan(ctx, reflect.ValueOf(conf.Send))
+	if err != nil {
+		return err
+	}
 
-	//Wait for broadcast goroutines
-	//Create template used for Unmarshalling
-	//Launch transmitter and receiver
-	go broadcastTransmitter(ctx, conf.Port, conf.ID, atMostOnceTx)
-	go broadcastReceiver(ctx, conf.Port, conf.ID, atMostOnceRx, T)
+	errs := make(chan error, 1)
+	transport := conf.Transport
+	if transport == nil {
+		//Use a socket of its own
+		transport = NewTransport(conf.Config)
+		go func() {
+			errs <- transport.Run(ctx)
+		}()
+	}
+	sub := transport.subscribe(conf.Topic, conf.AnyVersion)
+	defer transport.unsubscribe(sub)
 
 	//Wait for completion
 	for {
 		select {
 		case <-ctx.Done():
-			return
-		case m := <-atMostOnceRx:
-			valuePtr := reflect.ValueOf(m)           //Pointer type
-			outChan.Send(reflect.Indirect(valuePtr)) //Get actual value
+			return nil
+		case err := <-errs:
+			return err
+		case m := <-atMostOnceTx:
+			transport.publish(ctx, conf.Topic, m)
+		case msg := <-sub.messages:
+			v := reflect.New(T)
+			if err := msg.Data.Decode(v.Interface()); err != nil {
+				if SupportedVersions.Contains(msg.Version) {
+					conf.Logger.Warnf("Failed to decode message on topic %q: %s", conf.Topic, err)
+					continue
+				}
+				//Messages from incompatible nodes are expected to fail, and are only partially decoded
+				conf.Logger.Debugf("Failed to decode message on topic %q with protocol version %d: %s", conf.Topic, msg.Version, err)
+			}
+			utilities.SendMessage(ctx, conf.Receive, reflect.Indirect(v).Interface())
 		}
 	}
 }
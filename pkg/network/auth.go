@@ -0,0 +1,161 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//frameMagicSigned replaces frameMagic in signed messages, which end with an HMAC-SHA256 signature
+const frameMagicSigned byte = 0xE2
+
+//replayWindowSize is the number of sequence numbers below the highest received from a node
+//that are still accepted, once each. Older messages are rejected as replayed.
+const replayWindowSize = 64
+
+//firstContactAge is the age of the oldest sequence number accepted from a node not heard from before.
+//Sequence numbers are times, so older messages may be replayed from before this node started.
+//The clocks of the nodes must be synchronized within it.
+const firstContactAge = defaultHeartbeatTimeout
+
+var errUnsigned = errors.New("message is not signed")
+var errBadSignature = errors.New("invalid signature")
+
+//DropCounts contains the number of received messages dropped by a transport
+type DropCounts struct {
+	//Malformed messages could not be decoded
+	Malformed uint64
+	//Unauthenticated messages were not signed, or had an invalid signature
+	Unauthenticated uint64
+	//Replayed messages had a sequence number received before
+	Replayed uint64
+	//Incompatible messages had an unsupported protocol version
+	Incompatible uint64
+	//Overflowed messages were received while the queue of their topic was full
+	Overflowed uint64
+}
+
+//authenticator signs and verifies messages with the shared cluster key, and rejects replayed messages.
+//Messages are not signed or verified if the key is empty, but signed messages are still accepted.
+type authenticator struct {
+	key []byte
+	//sequence is the sequence number of the last message sent
+	sequence uint64
+
+	mtx     sync.Mutex
+	windows map[int]*replayWindow
+	//now returns the current time, and is replaced in tests
+	now func() time.Time
+
+	//Counters are updated atomically
+	malformed       uint64
+	unauthenticated uint64
+	replayed        uint64
+}
+
+//replayWindow contains the highest sequence number received from a node,
+//and a bitmap of the sequence numbers received below it
+type replayWindow struct {
+	highest uint64
+	seen    uint64
+}
+
+//newAuthenticator creates an authenticator.
+//Sequence numbers start at the current time, so they keep increasing when the node restarts.
+func newAuthenticator(key []byte) *authenticator {
+	return &authenticator{
+		key:      key,
+		sequence: uint64(time.Now().UnixNano()),
+		windows:  make(map[int]*replayWindow),
+		now:      time.Now,
+	}
+}
+
+//nextSequence returns the sequence number of the next message sent
+func (a *authenticator) nextSequence() uint64 {
+	return atomic.AddUint64(&a.sequence, 1)
+}
+
+//sign adds a signature to a frame if a key is set
+func (a *authenticator) sign(frame []byte) []byte {
+	if len(a.key) == 0 {
+		return frame
+	}
+	frame[0] = frameMagicSigned
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(frame)
+	return mac.Sum(frame)
+}
+
+//verify checks the signature of a frame if a key is set, and returns the frame without the signature
+func (a *authenticator) verify(frame []byte) ([]byte, error) {
+	if len(frame) == 0 || frame[0] != frameMagicSigned {
+		if len(a.key) != 0 {
+			return nil, errUnsigned
+		}
+		return frame, nil
+	}
+	if len(frame) < frameHeaderSize+sha256.Size {
+		return nil, errBadSignature
+	}
+	signed, signature := frame[:len(frame)-sha256.Size], frame[len(frame)-sha256.Size:]
+	if len(a.key) != 0 {
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errBadSignature
+		}
+	}
+	return signed, nil
+}
+
+//fresh returns true if the sequence number has not been received from the node before.
+//The first sequence number from a node is rejected if it is older than firstContactAge.
+//Only verified messages are checked, since the sequence number of unsigned messages can not be trusted.
+func (a *authenticator) fresh(sender int, sequence uint64) bool {
+	if len(a.key) == 0 {
+		return true
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	w, ok := a.windows[sender]
+	if !ok {
+		if oldest := a.now().Add(-firstContactAge).UnixNano(); oldest > 0 && sequence < uint64(oldest) {
+			return false
+		}
+		a.windows[sender] = &replayWindow{highest: sequence}
+		return true
+	}
+	if sequence > w.highest {
+		shift := sequence - w.highest
+		if shift > replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen = w.seen<<shift | 1<<(shift-1)
+		}
+		w.highest = sequence
+		return true
+	}
+	offset := w.highest - sequence
+	if offset == 0 || offset > replayWindowSize {
+		return false
+	}
+	bit := uint64(1) << (offset - 1)
+	if w.seen&bit != 0 {
+		return false
+	}
+	w.seen |= bit
+	return true
+}
+
+//counts returns the number of dropped messages
+func (a *authenticator) counts() DropCounts {
+	return DropCounts{
+		Malformed:       atomic.LoadUint64(&a.malformed),
+		Unauthenticated: atomic.LoadUint64(&a.unauthenticated),
+		Replayed:        atomic.LoadUint64(&a.replayed),
+	}
+}
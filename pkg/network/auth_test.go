@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatorFresh(t *testing.T) {
+	//Every step receives a sequence number from a sender, and expects it to be accepted or rejected
+	type step struct {
+		sender   int
+		sequence uint64
+		fresh    bool
+	}
+	tests := []struct {
+		name  string
+		key   string
+		steps []step
+	}{
+		{"in order", "key", []step{{1, 100, true}, {1, 101, true}, {1, 102, true}}},
+		{"out of order inside window", "key", []step{{1, 100, true}, {1, 90, true}, {1, 95, true}, {1, 101, true}, {1, 99, true}}},
+		{"duplicate highest", "key", []step{{1, 100, true}, {1, 100, false}}},
+		{"duplicate inside window", "key", []step{{1, 100, true}, {1, 90, true}, {1, 90, false}, {1, 101, true}, {1, 90, false}}},
+		{"oldest in window", "key", []step{{1, 100, true}, {1, 36, true}, {1, 36, false}}},
+		{"older than window", "key", []step{{1, 100, true}, {1, 35, false}, {1, 1, false}}},
+		{"jump larger than window", "key", []step{{1, 100, true}, {1, 99, true}, {1, 300, true}, {1, 250, true}, {1, 100, false}, {1, 99, false}, {1, 300, false}}},
+		{"jump of exactly the window", "key", []step{{1, 100, true}, {1, 164, true}, {1, 100, false}, {1, 101, true}}},
+		//Sequence numbers start at the time a node starts, so a restarted sender continues above the old numbers
+		{"restarted sender", "key", []step{{1, 1000, true}, {1, 1001, true}, {1, 5000, true}, {1, 5001, true}, {1, 1001, false}}},
+		{"senders are independent", "key", []step{{1, 100, true}, {2, 100, true}, {2, 100, false}, {1, 101, true}}},
+		{"no key", "", []step{{1, 100, true}, {1, 100, true}, {1, 1, true}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newAuthenticator([]byte(test.key))
+			//Every sequence number is new enough for a first contact
+			a.now = func() time.Time { return time.Unix(0, 0) }
+			for i, s := range test.steps {
+				if fresh := a.fresh(s.sender, s.sequence); fresh != s.fresh {
+					t.Errorf("step %d: sequence %d from %d: got fresh %t, want %t", i, s.sequence, s.sender, fresh, s.fresh)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticatorFirstContact(t *testing.T) {
+	sender := newAuthenticator([]byte("key"))
+	recorded := sender.nextSequence()
+	sent := time.Unix(0, int64(recorded))
+	tests := []struct {
+		name     string
+		received time.Time
+		sequence uint64
+		fresh    bool
+	}{
+		{"new message", sent, recorded, true},
+		{"delayed message", sent.Add(firstContactAge), recorded, true},
+		{"sender clock ahead", sent.Add(-time.Minute), recorded, true},
+		//The receiver has restarted since the message was recorded, and has forgotten the sequence numbers
+		{"replay after the receiver restarted", sent.Add(firstContactAge + time.Millisecond), recorded, false},
+		{"replay of an old message", sent.Add(time.Hour), recorded, false},
+		{"new message after the receiver restarted", sent.Add(time.Hour), uint64(sent.Add(time.Hour).UnixNano()), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newAuthenticator([]byte("key"))
+			receiver.now = func() time.Time { return test.received }
+			if fresh := receiver.fresh(1, test.sequence); fresh != test.fresh {
+				t.Errorf("got fresh %t, want %t", fresh, test.fresh)
+			}
+			//A rejected first contact does not start a window, so the next message from the sender is accepted
+			next := uint64(test.received.UnixNano())
+			if next <= test.sequence {
+				next = test.sequence + 1
+			}
+			if !receiver.fresh(1, next) {
+				t.Errorf("current sequence %d rejected after %d", next, test.sequence)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorSignVerify(t *testing.T) {
+	frame := func() []byte {
+		return []byte{frameMagic, codecIDJSON, '{', '}'}
+	}
+	signed := newAuthenticator([]byte("key")).sign(frame())
+	tampered := append([]byte(nil), signed...)
+	tampered[2] = '['
+	badSignature := append([]byte(nil), signed...)
+	badSignature[len(badSignature)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		key   string
+		frame []byte
+		err   error
+	}{
+		{"signed", "key", signed, nil},
+		{"tampered frame", "key", tampered, errBadSignature},
+		{"tampered signature", "key", badSignature, errBadSignature},
+		{"missing signature", "key", signed[:len(signed)-sha256.Size], errBadSignature},
+		{"other key", "other key", signed, errBadSignature},
+		{"unsigned with key", "key", frame(), errUnsigned},
+		{"empty frame with key", "key", []byte{}, errUnsigned},
+		{"unsigned without key", "", frame(), nil},
+		//Signed messages are accepted without checking the signature if no key is set
+		{"signed without key", "", tampered, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verified, err := newAuthenticator([]byte(test.key)).verify(test.frame)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && !bytes.Equal(verified[1:], test.frame[1:len(verified)]) {
+				t.Errorf("got frame %x from %x", verified, test.frame)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorSign(t *testing.T) {
+	if got := newAuthenticator(nil).sign([]byte{frameMagic, codecIDJSON, '{', '}'}); !bytes.Equal(got, []byte{frameMagic, codecIDJSON, '{', '}'}) {
+		t.Errorf("frame changed without a key: %x", got)
+	}
+	got := newAuthenticator([]byte("key")).sign([]byte{frameMagic, codecIDJSON, '{', '}'})
+	if len(got) != 4+sha256.Size || got[0] != frameMagicSigned || got[2] != '{' {
+		t.Errorf("got signed frame %x", got)
+	}
+	if _, err := decodeFrame(got[:4]); err != nil {
+		t.Errorf("signed frame can not be decoded: %s", err)
+	}
+}
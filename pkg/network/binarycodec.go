@@ -0,0 +1,803 @@
+package network
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Every value in the binary format starts with one of these tags.
+//Structs are encoded as maps from the JSON field names, so fields can be added and removed
+//like with the JSON codec. String map keys are only sent once in each message, and are
+//referred to by their index after that.
+const (
+	binNil byte = iota
+	binFalse
+	binTrue
+	//binInt is followed by a zigzag encoded varint
+	binInt
+	//binUint is followed by a varint
+	binUint
+	//binFloat is followed by 8 bytes, and binFloat32 by 4 bytes if no precision is lost
+	binFloat
+	binFloat32
+	//binString and binBytes are followed by the length and the bytes
+	binString
+	binBytes
+	//binArray is followed by the number of elements and the elements
+	binArray
+	//binMap is followed by the number of entries and a key and a value for each entry
+	binMap
+	//binRef is followed by the index of a map key sent earlier in the message
+	binRef
+	//binPayload is followed by the length and an encoded message with its own map keys
+	binPayload
+)
+
+//maxBinaryDepth limits the nesting of received values
+const maxBinaryDepth = 64
+
+var errBinaryCorrupt = errors.New("binary codec: corrupt data")
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) ID() byte {
+	return codecIDBinary
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	e := binaryEncoder{keys: make(map[string]int)}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("binary codec: unmarshal needs a non-nil pointer, got %T", v)
+	}
+	d := binaryDecoder{data: data}
+	if err := d.decode(target.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errBinaryCorrupt
+	}
+	return d.err
+}
+
+//binaryField is an encoded struct field
+type binaryField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+//binaryFieldCache contains the fields of every encoded struct type
+var binaryFieldCache sync.Map
+
+//binaryFields returns the encoded fields of a struct, named by their JSON tags.
+//Untagged embedded structs are flattened like in JSON.
+func binaryFields(t reflect.Type) []binaryField {
+	if fields, ok := binaryFieldCache.Load(t); ok {
+		return fields.([]binaryField)
+	}
+	var fields []binaryField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, embedded := range binaryFields(f.Type) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		field := binaryField{name: name, index: []int{i}}
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				field.omitEmpty = true
+			}
+		}
+		fields = append(fields, field)
+	}
+	binaryFieldCache.Store(t, fields)
+	return fields
+}
+
+//isEmptyValue returns true for values left out by omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+type binaryEncoder struct {
+	buf []byte
+	//keys contains the index of every map key sent
+	keys map[string]int
+}
+
+func (e *binaryEncoder) uvarint(x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	e.buf = append(e.buf, tmp[:n]...)
+}
+
+func (e *binaryEncoder) bytes(tag byte, b []byte) {
+	e.buf = append(e.buf, tag)
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+//key encodes a map key, or a reference if the key has been sent before
+func (e *binaryEncoder) key(k string) {
+	if i, ok := e.keys[k]; ok {
+		e.buf = append(e.buf, binRef)
+		e.uvarint(uint64(i))
+		return
+	}
+	e.keys[k] = len(e.keys)
+	e.bytes(binString, []byte(k))
+}
+
+func (e *binaryEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, binNil)
+		return nil
+	}
+	if v.Type() == payloadType {
+		data, err := v.Interface().(Payload).Encode(BinaryCodec)
+		if err != nil {
+			return err
+		}
+		e.bytes(binPayload, data)
+		return nil
+	}
+	if v.Type() == jsonNumberType {
+		return e.number(json.Number(v.String()))
+	}
+	if v.Type().Implements(binaryMarshalerType) && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.bytes(binBytes, b)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, binTrue)
+		} else {
+			e.buf = append(e.buf, binFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := v.Int()
+		e.buf = append(e.buf, binInt)
+		e.uvarint(uint64(x<<1) ^ uint64(x>>63))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.buf = append(e.buf, binUint)
+		e.uvarint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		var tmp [8]byte
+		if f := v.Float(); float64(float32(f)) == f || math.IsNaN(f) {
+			e.buf = append(e.buf, binFloat32)
+			binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(float32(f)))
+			e.buf = append(e.buf, tmp[:4]...)
+		} else {
+			e.buf = append(e.buf, binFloat)
+			binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+			e.buf = append(e.buf, tmp[:]...)
+		}
+	case reflect.String:
+		e.bytes(binString, []byte(v.String()))
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, binNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.bytes(binBytes, v.Bytes())
+			return nil
+		}
+		return e.array(v)
+	case reflect.Array:
+		return e.array(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, binNil)
+			return nil
+		}
+		e.buf = append(e.buf, binMap)
+		e.uvarint(uint64(v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			if iter.Key().Kind() == reflect.String {
+				e.key(iter.Key().String())
+			} else if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		var fields []binaryField
+		for _, f := range binaryFields(v.Type()) {
+			if !(f.omitEmpty && isEmptyValue(v.FieldByIndex(f.index))) {
+				fields = append(fields, f)
+			}
+		}
+		e.buf = append(e.buf, binMap)
+		e.uvarint(uint64(len(fields)))
+		for _, f := range fields {
+			e.key(f.name)
+			if err := e.encode(v.FieldByIndex(f.index)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, binNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("binary codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+//number encodes a JSON number as an integer if possible, and as a float otherwise
+func (e *binaryEncoder) number(n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return e.encode(reflect.ValueOf(i))
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return e.encode(reflect.ValueOf(u))
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("binary codec: invalid number %q", n)
+	}
+	return e.encode(reflect.ValueOf(f))
+}
+
+func (e *binaryEncoder) array(v reflect.Value) error {
+	e.buf = append(e.buf, binArray)
+	e.uvarint(uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+	//keys contains the map keys received, in order
+	keys []string
+	//err is the first field that could not be decoded
+	err error
+}
+
+func (d *binaryDecoder) tag() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errBinaryCorrupt
+	}
+	d.pos++
+	return d.data[d.pos-1], nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errBinaryCorrupt
+	}
+	d.pos += n
+	return x, nil
+}
+
+//length reads the length of a string, array or map. Every element uses at least one byte.
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errBinaryCorrupt
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	d.pos += n
+	return d.data[d.pos-n : d.pos], nil
+}
+
+func (d *binaryDecoder) float(tag byte) (float64, error) {
+	if tag == binFloat32 {
+		if len(d.data)-d.pos < 4 {
+			return 0, errBinaryCorrupt
+		}
+		d.pos += 4
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(d.data[d.pos-4:]))), nil
+	}
+	if len(d.data)-d.pos < 8 {
+		return 0, errBinaryCorrupt
+	}
+	d.pos += 8
+	return math.Float64frombits(binary.LittleEndian.Uint64(d.data[d.pos-8:])), nil
+}
+
+//key reads a string map key. Returns false without reading anything if the key is not a string.
+func (d *binaryDecoder) key() (string, bool, error) {
+	if d.pos >= len(d.data) {
+		return "", false, errBinaryCorrupt
+	}
+	switch d.data[d.pos] {
+	case binString:
+		d.pos++
+		b, err := d.bytes()
+		if err != nil {
+			return "", false, err
+		}
+		d.keys = append(d.keys, string(b))
+		return string(b), true, nil
+	case binRef:
+		d.pos++
+		i, err := d.uvarint()
+		if err != nil || i >= uint64(len(d.keys)) {
+			return "", false, errBinaryCorrupt
+		}
+		return d.keys[i], true, nil
+	}
+	return "", false, nil
+}
+
+//payload reads the data of a payload
+func (d *binaryDecoder) payload() ([]byte, error) {
+	b, err := d.bytes()
+	return append([]byte(nil), b...), err
+}
+
+//enter limits the nesting of arrays and maps
+func (d *binaryDecoder) enter() error {
+	d.depth++
+	if d.depth > maxBinaryDepth {
+		return errBinaryCorrupt
+	}
+	return nil
+}
+
+//number reads an integer or a float
+func (d *binaryDecoder) number(tag byte) (i int64, u uint64, f float64, err error) {
+	switch tag {
+	case binInt:
+		x, err := d.uvarint()
+		i = int64(x>>1) ^ -int64(x&1)
+		return i, uint64(i), float64(i), err
+	case binUint:
+		u, err = d.uvarint()
+		return int64(u), u, float64(u), err
+	case binFloat, binFloat32:
+		f, err = d.float(tag)
+		return int64(f), uint64(f), f, err
+	}
+	return 0, 0, 0, errBinaryCorrupt
+}
+
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	start := d.pos
+	tag, err := d.tag()
+	if err != nil {
+		return err
+	}
+	if tag == binNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("binary codec: cannot decode tag %d into %s", tag, v.Type())
+	}
+	if v.Type() == payloadType {
+		if tag != binPayload {
+			return mismatch()
+		}
+		data, err := d.payload()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(RawPayload(BinaryCodec, data)))
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && reflect.PtrTo(v.Type()).Implements(binaryUnmarshalerType) {
+		if tag != binBytes {
+			return mismatch()
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.pos = start
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		//Decode into the value pointed to, like JSON
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			d.pos = start
+			return d.decode(v.Elem().Elem())
+		}
+		if v.NumMethod() != 0 {
+			return mismatch()
+		}
+		g, err := d.generic(tag)
+		if err != nil {
+			return err
+		}
+		if g == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(g))
+		}
+	case reflect.Bool:
+		if tag != binTrue && tag != binFalse {
+			return mismatch()
+		}
+		v.SetBool(tag == binTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, u, f, err := d.number(tag)
+		if err != nil {
+			return mismatch()
+		}
+		if (tag == binUint && u > math.MaxInt64) || f != math.Trunc(f) || v.OverflowInt(i) {
+			return fmt.Errorf("binary codec: number out of range for %s", v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, u, f, err := d.number(tag)
+		if err != nil {
+			return mismatch()
+		}
+		if (tag == binInt && i < 0) || f < 0 || f != math.Trunc(f) || v.OverflowUint(u) {
+			return fmt.Errorf("binary codec: number out of range for %s", v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		_, _, f, err := d.number(tag)
+		if err != nil {
+			return mismatch()
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if tag != binString {
+			return mismatch()
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if tag == binBytes && v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		if tag != binArray {
+			return mismatch()
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		return d.elements(v, n)
+	case reflect.Array:
+		if tag != binArray {
+			return mismatch()
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.Zero(v.Type()))
+		return d.elements(v, n)
+	case reflect.Map:
+		if tag != binMap {
+			return mismatch()
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer func() { d.depth-- }()
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if k, ok, err := d.key(); err != nil {
+				return err
+			} else if ok && key.Kind() == reflect.String {
+				key.SetString(k)
+			} else if ok {
+				return mismatch()
+			} else if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		if tag != binMap {
+			return mismatch()
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer func() { d.depth-- }()
+		fields := binaryFields(v.Type())
+		for i := 0; i < n; i++ {
+			name, ok, err := d.key()
+			if err != nil {
+				return err
+			} else if !ok {
+				return errBinaryCorrupt
+			}
+			found := false
+			for _, f := range fields {
+				if f.name == name {
+					start, keys := d.pos, len(d.keys)
+					if err := d.decode(v.FieldByIndex(f.index)); err == errBinaryCorrupt {
+						return err
+					} else if err != nil {
+						//Like JSON, fields of the wrong type are skipped and the first error is returned
+						d.pos, d.keys = start, d.keys[:keys]
+						if d.err == nil {
+							d.err = err
+						}
+						if err := d.skip(); err != nil {
+							return err
+						}
+					}
+					found = true
+					break
+				}
+			}
+			//Unknown fields are ignored
+			if !found {
+				if err := d.skip(); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+//elements decodes n array elements. Elements not fitting in an array are skipped.
+func (d *binaryDecoder) elements(v reflect.Value, n int) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer func() { d.depth-- }()
+	for i := 0; i < n; i++ {
+		var err error
+		if i < v.Len() {
+			err = d.decode(v.Index(i))
+		} else {
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//generic decodes a value without a known type, using the same types as JSON where possible
+func (d *binaryDecoder) generic(tag byte) (interface{}, error) {
+	switch tag {
+	case binNil:
+		return nil, nil
+	case binFalse, binTrue:
+		return tag == binTrue, nil
+	case binInt:
+		i, _, _, err := d.number(tag)
+		return i, err
+	case binUint:
+		_, u, _, err := d.number(tag)
+		return u, err
+	case binFloat, binFloat32:
+		return d.float(tag)
+	case binPayload:
+		//The payload has its own map keys
+		data, err := d.payload()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		err = BinaryCodec.Unmarshal(data, &v)
+		return v, err
+	case binString:
+		b, err := d.bytes()
+		return string(b), err
+	case binBytes:
+		b, err := d.bytes()
+		return append([]byte(nil), b...), err
+	case binArray:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { d.depth-- }()
+		values := make([]interface{}, n)
+		for i := range values {
+			tag, err := d.tag()
+			if err != nil {
+				return nil, err
+			}
+			if values[i], err = d.generic(tag); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case binMap:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { d.depth-- }()
+		//Keys are converted to strings like in JSON
+		values := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			var key interface{}
+			k, ok, err := d.key()
+			if err != nil {
+				return nil, err
+			} else if ok {
+				key = k
+			} else if tag, err := d.tag(); err != nil {
+				return nil, err
+			} else if key, err = d.generic(tag); err != nil {
+				return nil, err
+			}
+			tag, err := d.tag()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.generic(tag)
+			if err != nil {
+				return nil, err
+			}
+			values[fmt.Sprint(key)] = value
+		}
+		return values, nil
+	}
+	return nil, errBinaryCorrupt
+}
+
+//skip reads past a value
+func (d *binaryDecoder) skip() error {
+	tag, err := d.tag()
+	if err != nil {
+		return err
+	}
+	switch tag {
+	case binNil, binFalse, binTrue:
+		return nil
+	case binInt, binUint:
+		_, err := d.uvarint()
+		return err
+	case binFloat, binFloat32:
+		_, err := d.float(tag)
+		return err
+	case binString, binBytes, binPayload:
+		_, err := d.bytes()
+		return err
+	case binArray, binMap:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer func() { d.depth-- }()
+		for i := 0; i < n; i++ {
+			//Map keys must be read to keep track of the keys sent
+			if tag == binMap {
+				if _, ok, err := d.key(); err != nil {
+					return err
+				} else if !ok {
+					if err := d.skip(); err != nil {
+						return err
+					}
+				}
+			}
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errBinaryCorrupt
+}
@@ -0,0 +1,216 @@
+package network_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/HaavardM/TTK4145-Elevator/internal/scheduler"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+)
+
+//envelope is a message with a payload, like the envelopes of the network modules
+type envelope struct {
+	Topic string          `json:"topic"`
+	Data  network.Payload `json:"data"`
+}
+
+func testOrder() scheduler.SchedulableOrder {
+	return scheduler.SchedulableOrder{
+		Order:        common.Order{Dir: common.DownDir, Floor: 3},
+		Worker:       2,
+		Timestamp:    network.Timestamp{Wall: 1571500000123456789, Logical: 7},
+		OrderID:      "bmr1ce2pmdlc7ba4s6t0",
+		CompletedAt:  network.Timestamp{Wall: -1, Logical: 1},
+		Term:         12,
+		Version:      1 << 40,
+		Destinations: []int{0, 2, -1},
+	}
+}
+
+func testCosts() common.OrderCosts {
+	return common.OrderCosts{
+		ID:         1,
+		OrderCount: 3,
+		HallUp:     []float64{0, 1.5, 0.1, 1e300},
+		HallDown:   []float64{},
+		Cab:        []float64{-2.25, 3},
+		Full:       true,
+		Stops:      []int{1},
+		Unserved:   []int{0, 3},
+	}
+}
+
+//roundTrip encodes v with a codec and decodes it into a new value of the same type
+func roundTrip(t *testing.T, c network.Codec, v interface{}) interface{} {
+	t.Helper()
+	data, err := c.Marshal(v)
+	if err != nil {
+		t.Fatalf("%s marshal: %s", c.Name(), err)
+	}
+	decoded := reflect.New(reflect.TypeOf(v))
+	if err := c.Unmarshal(data, decoded.Interface()); err != nil {
+		t.Fatalf("%s unmarshal: %s", c.Name(), err)
+	}
+	return decoded.Elem().Interface()
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"order", testOrder()},
+		{"empty order", scheduler.SchedulableOrder{}},
+		{"order slice", []*scheduler.SchedulableOrder{nil, func() *scheduler.SchedulableOrder { o := testOrder(); return &o }()}},
+		{"costs", testCosts()},
+		{"empty costs", common.OrderCosts{}},
+		{"costs map", map[string]common.OrderCosts{"a": testCosts(), "b": {ID: 2, Unavailable: true}}},
+		{"int keys", map[int]string{-1: "a", 1 << 40: "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := roundTrip(t, network.BinaryCodec, test.value)
+			json := roundTrip(t, network.JSONCodec, test.value)
+			if !reflect.DeepEqual(binary, test.value) {
+				t.Errorf("binary round trip changed the value:\n got %+v\nwant %+v", binary, test.value)
+			}
+			if !reflect.DeepEqual(binary, json) {
+				t.Errorf("binary and JSON codecs differ:\nbinary %+v\n  json %+v", binary, json)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecPayloads(t *testing.T) {
+	order := testOrder()
+	jsonOrder, err := network.JSONCodec.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryOrder, err := network.BinaryCodec.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		payload network.Payload
+		nested  bool
+	}{
+		{"value", network.NewPayload(order), false},
+		{"pointer", network.NewPayload(&order), false},
+		{"raw json", network.RawPayload(network.JSONCodec, jsonOrder), false},
+		{"raw binary", network.RawPayload(network.BinaryCodec, binaryOrder), false},
+		{"nested value", network.NewPayload(envelope{Topic: "inner", Data: network.NewPayload(order)}), true},
+		{"nested raw json", network.NewPayload(envelope{Topic: "inner", Data: network.RawPayload(network.JSONCodec, jsonOrder)}), true},
+		{"nested raw binary", network.NewPayload(envelope{Topic: "inner", Data: network.RawPayload(network.BinaryCodec, binaryOrder)}), true},
+	}
+	for _, test := range tests {
+		for _, c := range []network.Codec{network.BinaryCodec, network.JSONCodec} {
+			t.Run(fmt.Sprintf("%s/%s", test.name, c.Name()), func(t *testing.T) {
+				received := roundTrip(t, c, envelope{Topic: "orders", Data: test.payload}).(envelope)
+				if received.Topic != "orders" {
+					t.Errorf("got topic %q", received.Topic)
+				}
+				data := received.Data
+				if test.nested {
+					var inner envelope
+					if err := data.Decode(&inner); err != nil {
+						t.Fatalf("decode nested payload: %s", err)
+					}
+					if inner.Topic != "inner" {
+						t.Errorf("got nested topic %q", inner.Topic)
+					}
+					data = inner.Data
+				}
+				var decoded scheduler.SchedulableOrder
+				if err := data.Decode(&decoded); err != nil {
+					t.Fatalf("decode payload: %s", err)
+				}
+				if !reflect.DeepEqual(decoded, order) {
+					t.Errorf("got %+v, want %+v", decoded, order)
+				}
+			})
+		}
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	data, err := network.BinaryCodec.Marshal(envelope{Topic: "orders", Data: network.NewPayload(testOrder())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		var e envelope
+		if err := decodeBinary(t, data[:n], &e); err == nil {
+			t.Errorf("no error for %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+func TestBinaryCodecCorrupt(t *testing.T) {
+	//binArray, binMap and binRef tags
+	const array, mapTag, ref = 9, 10, 11
+	deep := make([]byte, 0, 200)
+	for i := 0; i < 100; i++ {
+		deep = append(deep, array, 1)
+	}
+	deep = append(deep, 0)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unknown tag", []byte{0xff}},
+		{"length past end", []byte{7, 10, 'a'}},
+		{"varint overflow", []byte{3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"unknown key reference", []byte{mapTag, 1, ref, 5, 0}},
+		{"too deep", deep},
+		{"trailing data", []byte{0, 0}},
+		{"short float", []byte{5, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var v interface{}
+			if err := decodeBinary(t, test.data, &v); err == nil {
+				t.Errorf("no error decoding into interface: got %v", v)
+			}
+			var e envelope
+			if err := decodeBinary(t, test.data, &e); err == nil {
+				t.Errorf("no error decoding into struct: got %+v", e)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecMutated(t *testing.T) {
+	for _, v := range []interface{}{testOrder(), testCosts(), envelope{Topic: "orders", Data: network.NewPayload(testOrder())}} {
+		data, err := network.BinaryCodec.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//Any result is accepted, as long as the decoder does not panic
+		for i := range data {
+			for _, b := range []byte{0, 1, 7, 9, 10, 11, 12, 0x7f, 0x80, 0xff} {
+				mutated := append([]byte(nil), data...)
+				mutated[i] = b
+				target := reflect.New(reflect.TypeOf(v)).Interface()
+				decodeBinary(t, mutated, target)
+				var generic interface{}
+				decodeBinary(t, mutated, &generic)
+			}
+		}
+	}
+}
+
+//decodeBinary decodes with the binary codec, and fails the test if the decoder panics
+func decodeBinary(t *testing.T, data []byte, v interface{}) (err error) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("panic decoding %x: %v", data, r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return network.BinaryCodec.Unmarshal(data, v)
+}
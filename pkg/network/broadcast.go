@@ -1,113 +1,165 @@
 package network
 
 import (
-	"encoding/json"
-	"log"
-	"reflect"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
-	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
 	"golang.org/x/net/context"
 )
 
+//readTimeout is the maximum time spent blocking on a read before checking the context
+const readTimeout = 500 * time.Millisecond
+
+//maxDatagramSize is the largest UDP payload, large enough for state snapshots
+const maxDatagramSize = 65507
+
+//frameMagic is the first byte of every broadcast message. It is followed by the id of the codec
+//used to encode the rest of the message.
+const frameMagic byte = 0xE1
+
+//frameHeaderSize is the size of the header before the encoded message
+const frameHeaderSize = 2
+
+//broadcastMsg is the envelope of all broadcast messages.
+//Data is decoded by the topic.
 type broadcastMsg struct {
-	SenderID int         `json:"sender_id"`
-	Data     interface{} `json:"data"`
+	SenderID int    `json:"sender_id"`
+	Topic    string `json:"topic"`
+	//Version is the protocol version of the data
+	Version uint16    `json:"version"`
+	Clock   Timestamp `json:"clock"`
+	//Sequence increases with every message sent by a node, and is used to reject replayed messages
+	Sequence uint64  `json:"seq"`
+	Data     Payload `json:"data"`
 }
 
-//broadcastReceiver receives JSON messages from a UDP broadcast port and unmarshalls into template
-func broadcastReceiver(ctx context.Context, port int, id int, message chan<- interface{}, T reflect.Type) {
-	noConn := make(chan error)
-	defer close(noConn)
-	conn, _, err := createConn(port)
-	//Close connection on exit
-	defer conn.Close()
+//encodeFrame encodes a message with the codec and adds the header
+func encodeFrame(codec Codec, msg broadcastMsg) ([]byte, error) {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{frameMagic, codec.ID()}, data...), nil
+}
 
+//decodeFrame decodes a message with the codec given in the header
+func decodeFrame(frame []byte) (broadcastMsg, error) {
+	msg := broadcastMsg{SenderID: -1}
+	if len(frame) < frameHeaderSize || (frame[0] != frameMagic && frame[0] != frameMagicSigned) {
+		return msg, errors.New("missing message header")
+	}
+	codec, ok := codecByID(frame[1])
+	if !ok {
+		return msg, fmt.Errorf("unknown codec %d", frame[1])
+	}
+	err := codec.Unmarshal(frame[frameHeaderSize:], &msg)
+	return msg, err
+}
+
+//broadcastReceiver receives messages from a UDP broadcast port and passes them to dispatch
+//Messages with an invalid signature or a replayed sequence number are dropped and counted by auth.
+//The clock is updated with the timestamp of every message from other nodes, and the sender
+//address is recorded in the address book
+//Returns an error if the connection fails
+func broadcastReceiver(ctx context.Context, conf Config, auth *authenticator, dispatch func(broadcastMsg)) error {
+	conn, _, err := createConn(conf.Port)
 	if err != nil {
-		noConn <- err
+		return err
 	}
-	var buf [1024]byte
+	//Close connection on exit
+	defer conn.Close()
+
+	var buf [maxDatagramSize]byte
 	for {
 		select {
-		case <-noConn:
-			//Wait before retry
-			<-time.After(1 * time.Second)
-			//Close old
-			conn.Close()
-			//Dial new
-			conn, _, err = createConn(port)
-			if err != nil {
-				noConn <- err
-			}
 		case <-ctx.Done():
-			return
+			return nil
 		default:
 		}
 
-		n, _, err := conn.ReadFrom(buf[0:])
+		//Use a deadline to check the context regularly
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+		n, from, err := conn.ReadFrom(buf[0:])
 		if err != nil {
-			log.Println("Failed to read - reconnecting")
-			noConn <- err
-			continue
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return err
 		}
 
-		//Create message template
-		msg := &broadcastMsg{
-			SenderID: -1,
-			Data:     reflect.New(T).Interface(),
+		//Dropped messages are logged at debug level, since anyone on the network can send them
+		frame, err := auth.verify(buf[0:n])
+		if err != nil {
+			atomic.AddUint64(&auth.unauthenticated, 1)
+			conf.Logger.Debugf("Dropping message from %s: %s", from, err)
+			continue
 		}
-		err = json.Unmarshal(buf[0:n], msg)
+		//Data is decoded by the topic
+		msg, err := decodeFrame(frame)
 		if err != nil {
-			log.Println(err)
+			atomic.AddUint64(&auth.malformed, 1)
+			conf.Logger.Debugf("Failed to decode message from %s: %s", from, err)
+			continue
 		}
-		if msg.SenderID != id || msg.SenderID < 0 {
-			if msg.Data != nil {
-				go utilities.SendMessage(ctx, message, msg.Data)
+		if !auth.fresh(msg.SenderID, msg.Sequence) {
+			atomic.AddUint64(&auth.replayed, 1)
+			conf.Logger.Debugf("Dropping replayed message %d from %d", msg.Sequence, msg.SenderID)
+			continue
+		}
+		if msg.SenderID != conf.ID || msg.SenderID < 0 {
+			if conf.Clock != nil && !msg.Clock.IsZero() {
+				if _, err := conf.Clock.Update(msg.Clock); err != nil {
+					//Logged at debug level since every message from the node fails
+					conf.Logger.Debugf("Ignoring clock from node %d: %s", msg.SenderID, err)
+				}
+			}
+			if udpAddr, ok := from.(*net.UDPAddr); ok && msg.SenderID >= 0 {
+				conf.Addresses.observeIP(msg.SenderID, udpAddr.IP)
 			}
+			dispatch(msg)
 		}
 	}
 }
 
-//broadcastTransmitter transmits JSONs messages to a UDP broadcast port
-func broadcastTransmitter(ctx context.Context, port int, id int, message <-chan interface{}) {
-	noConn := make(chan error)
-	transmitQueue := utilities.RChan2RWChan(ctx, message)
-	conn, addr, err := createConn(port)
-	defer conn.Close()
+//broadcastTransmitter transmits messages to a UDP broadcast port
+//Messages are encoded with the codec in the configuration, or JSON if not set,
+//stamped with the clock if it is not nil, and signed by auth
+//Returns an error if the connection fails
+func broadcastTransmitter(ctx context.Context, conf Config, auth *authenticator, message <-chan broadcastMsg) error {
+	conn, addr, err := createConn(conf.Port)
 	if err != nil {
-		go func() {
-			noConn <- err
-		}()
+		return err
 	}
+	defer conn.Close()
 
+	codec := conf.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
 	for {
 		select {
-		case <-noConn:
-			//Wait before retry
-			<-time.After(1 * time.Second)
-			//Close old
-			conn.Close()
-			//Dial new
-			conn, addr, err = createConn(port)
-			if err != nil {
-				noConn <- err
-			}
 		case <-ctx.Done():
-			return
-		case m := <-transmitQueue:
-			data, err := json.Marshal(broadcastMsg{
-				Data:     m,
-				SenderID: id,
-			},
-			)
+			return nil
+		case msg := <-message:
+			msg.SenderID = conf.ID
+			msg.Sequence = auth.nextSequence()
+			if conf.Clock != nil {
+				msg.Clock = conf.Clock.Now()
+			}
+			data, err := encodeFrame(codec, msg)
 			if err != nil {
-				log.Println("Couldn't marshal message ", err)
+				conf.Logger.Errorf("Couldn't encode message: %s", err)
 				continue
 			}
+			data = auth.sign(data)
 			_, err = conn.WriteTo(data, addr)
 			if err != nil {
-				log.Println("Failed to write - attempting reconnect")
-				go utilities.SendMessage(ctx, noConn, err)
+				return err
 			}
 		}
 	}
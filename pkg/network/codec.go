@@ -0,0 +1,179 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+//DefaultCodec is the name of the codec used if none is configured
+const DefaultCodec = "json"
+
+//Codec ids sent in the message header
+const (
+	codecIDJSON byte = iota + 1
+	codecIDBinary
+)
+
+//Codec encodes and decodes the messages sent on the network.
+//Every message has the id of the codec in its header, so nodes using different codecs can
+//communicate as long as they know each others codecs.
+//A codec must be able to encode and decode Payload values, using Payload.Encode and RawPayload.
+type Codec interface {
+	//Name is used to select the codec in the configuration
+	Name() string
+	//ID is sent in the message header. Must be unique and not 0.
+	ID() byte
+	//Marshal encodes a value
+	Marshal(v interface{}) ([]byte, error)
+	//Unmarshal decodes data into the value pointed to by v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//JSONCodec encodes messages as JSON
+var JSONCodec Codec = jsonCodec{}
+
+//BinaryCodec encodes messages in a compact, self-describing binary format
+var BinaryCodec Codec = binaryCodec{}
+
+//codecs contains all known codecs by name and by id
+var codecs = struct {
+	mtx    sync.RWMutex
+	byName map[string]Codec
+	byID   map[byte]Codec
+}{
+	byName: map[string]Codec{JSONCodec.Name(): JSONCodec, BinaryCodec.Name(): BinaryCodec},
+	byID:   map[byte]Codec{JSONCodec.ID(): JSONCodec, BinaryCodec.ID(): BinaryCodec},
+}
+
+//RegisterCodec adds a codec, which can then be selected by name and decoded from other nodes.
+//Returns an error if the name or the id is already used.
+func RegisterCodec(c Codec) error {
+	codecs.mtx.Lock()
+	defer codecs.mtx.Unlock()
+	if c.ID() == 0 {
+		return fmt.Errorf("codec %q: id 0 is reserved", c.Name())
+	}
+	if _, ok := codecs.byName[c.Name()]; ok {
+		return fmt.Errorf("codec %q already exists", c.Name())
+	}
+	if other, ok := codecs.byID[c.ID()]; ok {
+		return fmt.Errorf("codec %q: id %d is used by %q", c.Name(), c.ID(), other.Name())
+	}
+	codecs.byName[c.Name()] = c
+	codecs.byID[c.ID()] = c
+	return nil
+}
+
+//LookupCodec returns the codec with the given name
+func LookupCodec(name string) (Codec, error) {
+	codecs.mtx.RLock()
+	defer codecs.mtx.RUnlock()
+	c, ok := codecs.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+//codecByID returns the codec with the given id
+func codecByID(id byte) (Codec, bool) {
+	codecs.mtx.RLock()
+	defer codecs.mtx.RUnlock()
+	c, ok := codecs.byID[id]
+	return c, ok
+}
+
+//Payload is the data of a message.
+//A payload created by NewPayload contains a value, which is encoded with the codec of the message.
+//A received payload contains the encoded data, and is decoded once by the receiver when the type is known.
+type Payload struct {
+	value interface{}
+	codec Codec
+	data  []byte
+}
+
+//payloadType is used by codecs to find payloads
+var payloadType = reflect.TypeOf(Payload{})
+
+//NewPayload creates a payload containing a value
+func NewPayload(v interface{}) Payload {
+	return Payload{value: v}
+}
+
+//RawPayload creates a payload from data encoded by a codec
+func RawPayload(c Codec, data []byte) Payload {
+	return Payload{codec: c, data: data}
+}
+
+//Encode returns the payload encoded by a codec.
+//Encoded data is converted if it is encoded by another codec.
+func (p Payload) Encode(c Codec) ([]byte, error) {
+	if p.codec == nil {
+		return c.Marshal(p.value)
+	}
+	if p.codec.ID() == c.ID() {
+		return p.data, nil
+	}
+	var v interface{}
+	if p.codec.ID() == codecIDJSON {
+		//Numbers are kept as text, since large integers like timestamps do not fit in a float
+		dec := json.NewDecoder(bytes.NewReader(p.data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+	} else if err := p.codec.Unmarshal(p.data, &v); err != nil {
+		return nil, err
+	}
+	return c.Marshal(v)
+}
+
+//Decode stores the payload in the value pointed to by v
+func (p Payload) Decode(v interface{}) error {
+	if p.codec != nil {
+		return p.codec.Unmarshal(p.data, v)
+	}
+	//Values are assigned directly if possible
+	target := reflect.ValueOf(v)
+	if target.Kind() == reflect.Ptr && !target.IsNil() && p.value != nil && reflect.TypeOf(p.value).AssignableTo(target.Elem().Type()) {
+		target.Elem().Set(reflect.ValueOf(p.value))
+		return nil
+	}
+	data, err := JSONCodec.Marshal(p.value)
+	if err != nil {
+		return err
+	}
+	return JSONCodec.Unmarshal(data, v)
+}
+
+//MarshalJSON encodes the payload as JSON
+func (p Payload) MarshalJSON() ([]byte, error) {
+	return p.Encode(JSONCodec)
+}
+
+//UnmarshalJSON keeps the JSON data until the payload is decoded
+func (p *Payload) UnmarshalJSON(data []byte) error {
+	*p = RawPayload(JSONCodec, append([]byte(nil), data...))
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) ID() byte {
+	return codecIDJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//NoLeader is used as LeaderID when no leader is known
+const NoLeader = -1
+
+//Leadership contains the current leader and its term.
+//The term is increased every time a node claims leadership, and is used to fence off
+//decisions made by a deposed leader.
+type Leadership struct {
+	Term     uint64 `json:"term"`
+	LeaderID int    `json:"leader_id"`
+}
+
+//election elects the node with the lowest id among the online nodes as leader (bully algorithm).
+//The leadership is advertised in the heartbeats.
+type election struct {
+	id      int
+	current Leadership
+	//maxTerm is the highest term seen from any node
+	maxTerm uint64
+	//claimAfter is the earliest time this node may claim leadership.
+	//Gives the node time to discover other nodes after starting.
+	claimAfter time.Time
+}
+
+//newElection creates an election for the node with the given id.
+//The node waits for discovery before claiming leadership.
+func newElection(id int, discovery time.Duration) *election {
+	return &election{
+		id:         id,
+		current:    Leadership{LeaderID: NoLeader},
+		claimAfter: time.Now().Add(discovery),
+	}
+}
+
+//observe records the leadership advertised by another node
+func (e *election) observe(l Leadership) {
+	if l.Term > e.maxTerm {
+		e.maxTerm = l.Term
+	}
+}
+
+//update recalculates the leadership from the online nodes.
+//Returns true if the leadership changed.
+func (e *election) update(nodes map[int]stampedHeartbeat) bool {
+	candidate := e.id
+	for id := range nodes {
+		if id < candidate {
+			candidate = id
+		}
+	}
+
+	prev := e.current
+	switch {
+	case candidate == e.id:
+		//Claim leadership with a new term, also if another node has used a higher term
+		if (e.current.LeaderID != e.id || e.maxTerm > e.current.Term) && !time.Now().Before(e.claimAfter) {
+			e.maxTerm++
+			e.current = Leadership{Term: e.maxTerm, LeaderID: e.id}
+		}
+	case nodes[candidate].hbt.Leadership.LeaderID == candidate && nodes[candidate].hbt.Leadership.Term >= e.current.Term:
+		//Follow the candidate when it has claimed leadership
+		e.current = nodes[candidate].hbt.Leadership
+	default:
+		//Step down or forget a lost leader until the candidate has claimed leadership
+		if _, ok := nodes[e.current.LeaderID]; !ok {
+			e.current.LeaderID = NoLeader
+		}
+	}
+	return e.current != prev
+}
+
+//runSendLatestLeadership sends the latest leadership when the receiver is ready.
+//Older values are dropped if the receiver is slow.
+func runSendLatestLeadership(ctx context.Context, send chan<- Leadership, latest <-chan Leadership) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case l := <-latest:
+			for sent := false; !sent; {
+				select {
+				case <-ctx.Done():
+					return
+				case send <- l:
+					sent = true
+				case l = <-latest:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElectionUpdate(t *testing.T) {
+	//Every step receives heartbeats with the leaderships advertised by the online nodes,
+	//and expects the resulting leadership of the node
+	type step struct {
+		nodes map[int]Leadership
+		//discovered is set once the node may claim leadership
+		discovered bool
+		want       Leadership
+	}
+	none := Leadership{LeaderID: NoLeader}
+	tests := []struct {
+		name  string
+		id    int
+		steps []step
+	}{
+		{"alone", 2, []step{
+			{nil, false, none},
+			{nil, true, Leadership{Term: 1, LeaderID: 2}},
+			{nil, true, Leadership{Term: 1, LeaderID: 2}},
+		}},
+		{"lowest id claims", 1, []step{
+			{map[int]Leadership{2: none, 3: none}, false, none},
+			{map[int]Leadership{2: none, 3: none}, true, Leadership{Term: 1, LeaderID: 1}},
+		}},
+		{"follow a claimed leader", 2, []step{
+			{map[int]Leadership{1: none}, true, none},
+			{map[int]Leadership{1: {Term: 1, LeaderID: 1}}, true, Leadership{Term: 1, LeaderID: 1}},
+		}},
+		{"step down for a lower id", 2, []step{
+			{nil, true, Leadership{Term: 1, LeaderID: 2}},
+			{map[int]Leadership{1: none}, true, Leadership{Term: 1, LeaderID: NoLeader}},
+			{map[int]Leadership{1: {Term: 2, LeaderID: 1}}, true, Leadership{Term: 2, LeaderID: 1}},
+		}},
+		{"claim above the highest term seen", 1, []step{
+			{map[int]Leadership{2: {Term: 5, LeaderID: 2}}, true, Leadership{Term: 6, LeaderID: 1}},
+		}},
+		{"take over from a lost leader", 2, []step{
+			{map[int]Leadership{1: {Term: 3, LeaderID: 1}, 3: {Term: 3, LeaderID: 1}}, true, Leadership{Term: 3, LeaderID: 1}},
+			{map[int]Leadership{3: {Term: 3, LeaderID: 1}}, true, Leadership{Term: 4, LeaderID: 2}},
+		}},
+		{"forget a lost leader until the candidate claims", 3, []step{
+			{map[int]Leadership{1: {Term: 3, LeaderID: 1}, 2: {Term: 3, LeaderID: 1}}, true, Leadership{Term: 3, LeaderID: 1}},
+			{map[int]Leadership{2: {Term: 3, LeaderID: 1}}, true, Leadership{Term: 3, LeaderID: NoLeader}},
+			{map[int]Leadership{2: {Term: 4, LeaderID: 2}}, true, Leadership{Term: 4, LeaderID: 2}},
+		}},
+		{"ignore an older term of the candidate", 2, []step{
+			{map[int]Leadership{1: {Term: 3, LeaderID: 1}}, true, Leadership{Term: 3, LeaderID: 1}},
+			{map[int]Leadership{1: {Term: 2, LeaderID: 1}}, true, Leadership{Term: 3, LeaderID: 1}},
+		}},
+		{"claim again after a higher term", 1, []step{
+			{map[int]Leadership{2: none}, true, Leadership{Term: 1, LeaderID: 1}},
+			{map[int]Leadership{2: {Term: 2, LeaderID: 2}}, true, Leadership{Term: 3, LeaderID: 1}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newElection(test.id, time.Hour)
+			for i, s := range test.steps {
+				if s.discovered {
+					e.claimAfter = time.Time{}
+				}
+				nodes := make(map[int]stampedHeartbeat)
+				for id, l := range s.nodes {
+					nodes[id] = stampedHeartbeat{timestamp: time.Now(), hbt: heartbeat{Leadership: l}}
+					e.observe(l)
+				}
+				prev := e.current
+				if changed := e.update(nodes); changed != (prev != e.current) {
+					t.Errorf("step %d: got changed %t from %+v to %+v", i, changed, prev, e.current)
+				}
+				if e.current != s.want {
+					t.Errorf("step %d: got leadership %+v, want %+v", i, e.current, s.want)
+				}
+			}
+		})
+	}
+}
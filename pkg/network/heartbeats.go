@@ -1,16 +1,18 @@
 package network
 
 import (
-	"fmt"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/HaavardM/TTK4145-Elevator/pkg/common"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/utilities"
 	"golang.org/x/net/context"
 )
 
-const heartbInterval = 50 * time.Millisecond
-const timeout = 10 * heartbInterval
+//Used if no interval or timeout is configured
+const defaultHeartbeatInterval = 50 * time.Millisecond
+const defaultHeartbeatTimeout = 10 * defaultHeartbeatInterval
 
 //HeartbeatConfig contains config parameters for the heartbeat module
 type HeartbeatConfig struct {
@@ -19,51 +21,186 @@ type HeartbeatConfig struct {
 	CostOut         chan<- common.OrderCosts
 	LostElevators   chan<- int
 	OnlineElevators chan<- []int
+	//Interval is the time between heartbeats
+	Interval time.Duration
+	//Timeout is the time without heartbeats before a node is considered lost
+	Timeout time.Duration
+	//Reload receives new values for interval and timeout
+	Reload <-chan HeartbeatTiming
+	//Leadership receives the elected leader when it changes, and regularly after that.
+	//Optional.
+	Leadership chan<- Leadership
+	//UnicastPort is advertised to the other nodes, which add it to their address book. Optional.
+	UnicastPort int
+	//Membership receives all nodes sending heartbeats, including incompatible nodes, when it changes.
+	//Optional.
+	Membership chan<- []Member
+}
+
+//Member is a node in the membership view
+type Member struct {
+	ID int `json:"id"`
+	//Protocol is the range of protocol versions supported by the node
+	Protocol VersionRange `json:"protocol"`
+	//Compatible is false if the node has no protocol version in common with this node.
+	//Incompatible nodes are not considered online.
+	Compatible bool `json:"compatible"`
+}
+
+//HeartbeatTiming contains the heartbeat values that can be changed while running
+type HeartbeatTiming struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+//heartbeat is the message sent by every node.
+//Heartbeats are received from nodes with all protocol versions, so the id and the protocol
+//fields must not be changed.
+type heartbeat struct {
+	common.OrderCosts `json:"costs"`
+	Leadership        Leadership   `json:"leadership"`
+	UnicastPort       int          `json:"unicast_port"`
+	Protocol          VersionRange `json:"protocol"`
 }
 
 //stampedHeartbeat contains a heartbeat and a timestamp of when the heartbeat was last updated
 type stampedHeartbeat struct {
 	timestamp time.Time
-	hbt       common.OrderCosts
+	hbt       heartbeat
 }
 
 //RunHeartbeat is the main entrypoint for heartbeats
-func RunHeartbeat(ctx context.Context, conf HeartbeatConfig, onlineElevators ...chan<- []int) {
-	sendHeartbeatChan := make(chan common.OrderCosts)
-	recvHeartbeatChan := make(chan common.OrderCosts)
-	defer close(sendHeartbeatChan)
-	defer close(recvHeartbeatChan)
+//Returns an error if the underlying connection fails
+func RunHeartbeat(ctx context.Context, conf HeartbeatConfig, onlineElevators ...chan<- []int) error {
+	//Stop AtMostOnce service on exit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if conf.Interval <= 0 {
+		conf.Interval = defaultHeartbeatInterval
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultHeartbeatTimeout
+	}
+
+	sendHeartbeatChan := make(chan heartbeat)
+	recvHeartbeatChan := make(chan heartbeat)
 
 	atMostOnceConfig := AtMostOnceConfig{
-		Config:  conf.Config,
-		Send:    sendHeartbeatChan,
-		Receive: recvHeartbeatChan,
+		Config:     conf.Config,
+		Send:       sendHeartbeatChan,
+		Receive:    recvHeartbeatChan,
+		AnyVersion: true,
 	}
 	//Store last received heartbeats
 	mapLastHeartbeat := make(map[int]stampedHeartbeat)
+	//Store last received heartbeats from nodes without a common protocol version
+	mapIncompatible := make(map[int]stampedHeartbeat)
+
+	//Negotiate the protocol version and publish the membership when nodes are added or removed
+	var members []Member
+	updateMembership := func() {
+		versions := []VersionRange{}
+		for _, hbt := range mapLastHeartbeat {
+			versions = append(versions, hbt.hbt.Protocol)
+		}
+		if version := negotiateVersion(versions); conf.Transport != nil && conf.Transport.setVersion(version) {
+			conf.Logger.Infof("Sending protocol version %d", version)
+		}
+		updated := membership(mapLastHeartbeat, mapIncompatible)
+		if !reflect.DeepEqual(updated, members) {
+			members = updated
+			conf.Logger.With("members", members).Infof("Membership changed")
+			if conf.Membership != nil {
+				go utilities.SendMessage(ctx, conf.Membership, updated)
+			}
+		}
+	}
+
+	//Elect a leader among the online nodes. Wait one timeout to discover other nodes first.
+	elect := newElection(conf.ID, conf.Timeout)
+	leadership := make(chan Leadership)
+	if conf.Leadership != nil {
+		go runSendLatestLeadership(ctx, conf.Leadership, leadership)
+	}
+	publishLeadership := func() {
+		if conf.Leadership != nil {
+			utilities.SendMessage(ctx, leadership, elect.current)
+		}
+	}
+	updateLeadership := func() {
+		if elect.update(mapLastHeartbeat) {
+			conf.Logger.Infof("Leader is %d in term %d", elect.current.LeaderID, elect.current.Term)
+			publishLeadership()
+		}
+	}
 
 	//Wait for first ordercost from anotherm module
-	cost := <-conf.CostIn
+	var cost common.OrderCosts
+	select {
+	case <-ctx.Done():
+		return nil
+	case cost = <-conf.CostIn:
+	}
 
-	timeoutTimer := time.NewTicker(timeout)
-	heartbeatTicker := time.NewTicker(heartbInterval)
+	timeoutTimer := time.NewTicker(conf.Timeout)
+	heartbeatTicker := time.NewTicker(conf.Interval)
+	//Tickers are replaced on reload
+	defer func() {
+		timeoutTimer.Stop()
+		heartbeatTicker.Stop()
+	}()
 
 	//Start atMostOnce service
-	go RunAtMostOnce(ctx, atMostOnceConfig)
+	atMostOnceErr := make(chan error, 1)
+	go func() {
+		atMostOnceErr <- RunAtMostOnce(ctx, atMostOnceConfig)
+	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
+		case err := <-atMostOnceErr:
+			return err
 
 		case cost = <-conf.CostIn:
 
+		case t := <-conf.Reload:
+			if t.Interval > 0 && t.Timeout > t.Interval {
+				conf.Interval = t.Interval
+				conf.Timeout = t.Timeout
+				timeoutTimer.Stop()
+				heartbeatTicker.Stop()
+				timeoutTimer = time.NewTicker(conf.Timeout)
+				heartbeatTicker = time.NewTicker(conf.Interval)
+			}
+
 		case hbt := <-recvHeartbeatChan:
+			//Nodes without a common protocol version are shown in the membership, but are not online
+			if !SupportedVersions.Compatible(hbt.Protocol) {
+				if _, found := mapIncompatible[hbt.ID]; !found {
+					conf.Logger.Warnf("Ignoring node %d with protocol versions %s, this node supports %s", hbt.ID, hbt.Protocol, SupportedVersions)
+				}
+				mapIncompatible[hbt.ID] = stampedHeartbeat{timestamp: time.Now(), hbt: heartbeat{OrderCosts: common.OrderCosts{ID: hbt.ID}, Protocol: hbt.Protocol}}
+				if _, online := mapLastHeartbeat[hbt.ID]; online {
+					delete(mapLastHeartbeat, hbt.ID)
+					utilities.SendMessage(ctx, conf.LostElevators, hbt.ID)
+					go publishNodesOnline(onlineNodes(mapLastHeartbeat), onlineElevators...)
+					updateLeadership()
+				}
+				updateMembership()
+				continue
+			}
+			delete(mapIncompatible, hbt.ID)
+
 			_, idfound := mapLastHeartbeat[hbt.ID]
+			//Update the address before other modules learn about the node
+			conf.Addresses.setPort(hbt.ID, hbt.UnicastPort)
 
 			//Send orders cost (includes id) to receiver
-			if !idfound || !reflect.DeepEqual(hbt, mapLastHeartbeat[hbt.ID].hbt) {
-				conf.CostOut <- hbt
+			if !idfound || !reflect.DeepEqual(hbt.OrderCosts, mapLastHeartbeat[hbt.ID].hbt.OrderCosts) {
+				utilities.SendMessage(ctx, conf.CostOut, hbt.OrderCosts)
 			}
 			//Store timestamp
 			mapLastHeartbeat[hbt.ID] = stampedHeartbeat{
@@ -73,33 +210,67 @@ func RunHeartbeat(ctx context.Context, conf HeartbeatConfig, onlineElevators ...
 			//If no previous heartbeat exitst - notify channels
 			if !idfound {
 				//Publish online elevators list
-				go publishNodesOnline(mapLastHeartbeat, onlineElevators...)
-				fmt.Printf("New node detected %d\n", hbt.ID)
+				go publishNodesOnline(onlineNodes(mapLastHeartbeat), onlineElevators...)
+				conf.Logger.Infof("New node detected %d with protocol versions %s", hbt.ID, hbt.Protocol)
 			}
+			updateMembership()
+			elect.observe(hbt.Leadership)
+			updateLeadership()
 
 		case <-timeoutTimer.C:
 			for id, hbt := range mapLastHeartbeat {
-				if time.Now().Sub(hbt.timestamp) > timeout {
+				if time.Now().Sub(hbt.timestamp) > conf.Timeout {
 					delete(mapLastHeartbeat, id)
-					conf.LostElevators <- id
+					utilities.SendMessage(ctx, conf.LostElevators, id)
 					//Published updated list of online elevators
-					go publishNodesOnline(mapLastHeartbeat, onlineElevators...)
-					fmt.Printf("Disconnected node detected %d\n", id)
+					go publishNodesOnline(onlineNodes(mapLastHeartbeat), onlineElevators...)
+					conf.Logger.Warnf("Disconnected node detected %d", id)
 				}
 			}
+			for id, hbt := range mapIncompatible {
+				if time.Now().Sub(hbt.timestamp) > conf.Timeout {
+					delete(mapIncompatible, id)
+				}
+			}
+			updateMembership()
+			updateLeadership()
+			//Republish in case the receiver has been restarted
+			publishLeadership()
 		case <-heartbeatTicker.C:
-			sendHeartbeatChan <- cost
+			utilities.SendMessage(ctx, sendHeartbeatChan, heartbeat{OrderCosts: cost, Leadership: elect.current, UnicastPort: conf.UnicastPort, Protocol: SupportedVersions})
 		}
 	}
 }
 
-//publishNodesOnline finds all the online nodes going through the sampedHeartbeat map and publish them an array
-func publishNodesOnline(mapLastHeartbeat map[int]stampedHeartbeat, sends ...chan<- []int) {
+//membership returns the online and incompatible nodes sorted by id
+func membership(online map[int]stampedHeartbeat, incompatible map[int]stampedHeartbeat) []Member {
+	members := []Member{}
+	for id, hbt := range online {
+		members = append(members, Member{ID: id, Protocol: hbt.hbt.Protocol, Compatible: true})
+	}
+	for id, hbt := range incompatible {
+		members = append(members, Member{ID: id, Protocol: hbt.hbt.Protocol})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+//onlineNodes returns the ids of the nodes in the stampedHeartbeat map sorted by id.
+//The list is built before publishing, since the map is changed while the list is sent.
+func onlineNodes(mapLastHeartbeat map[int]stampedHeartbeat) []int {
+	online := make([]int, 0, len(mapLastHeartbeat))
+	for id := range mapLastHeartbeat {
+		online = append(online, id)
+	}
+	sort.Ints(online)
+	return online
+}
+
+//publishNodesOnline publishes a copy of the online nodes to every channel
+func publishNodesOnline(online []int, sends ...chan<- []int) {
 	for _, c := range sends {
-		msg := []int{}
-		for id := range mapLastHeartbeat {
-			msg = append(msg, id)
-		}
-		c <- msg
+		c <- append([]int{}, online...)
 	}
 }
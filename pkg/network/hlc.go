@@ -0,0 +1,119 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//MaxClockOffset is the maximum difference between a remote timestamp and the local clock.
+//Timestamps further ahead are not used to update the clock, so that one node with a wrong
+//clock can not move the clocks of all nodes.
+const MaxClockOffset = time.Minute
+
+//Timestamp is a hybrid logical clock timestamp. Wall is the physical time in unix nanoseconds,
+//and Logical orders events with the same physical time.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+}
+
+//Before returns true if t is ordered before u
+func (t Timestamp) Before(u Timestamp) bool {
+	return t.Wall < u.Wall || (t.Wall == u.Wall && t.Logical < u.Logical)
+}
+
+//IsZero returns true if the timestamp is not set
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+//Sub returns the physical time between t and u
+func (t Timestamp) Sub(u Timestamp) time.Duration {
+	return time.Duration(t.Wall - u.Wall)
+}
+
+//Time returns the physical part of the timestamp
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+//String formats the timestamp for logging
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s+%d", t.Time().Format(time.RFC3339Nano), t.Logical)
+}
+
+//UnmarshalJSON reads a timestamp. Plain time strings, used in older order files, are also accepted.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var wall time.Time
+		if err := json.Unmarshal(data, &wall); err != nil {
+			return err
+		}
+		*t = Timestamp{Wall: wall.UnixNano()}
+		return nil
+	}
+	//Alias type to avoid recursion
+	type timestamp Timestamp
+	return json.Unmarshal(data, (*timestamp)(t))
+}
+
+//Clock is a hybrid logical clock. Timestamps from the clock never decrease, and are always
+//after every timestamp the clock has been updated with. The physical part follows the fastest
+//clock among the nodes, so time differences between timestamps from different nodes are not
+//affected by clock skew.
+//A nil *Clock does not stamp messages, and returns the physical time.
+type Clock struct {
+	mtx  sync.Mutex
+	last Timestamp
+}
+
+//NewClock creates a new hybrid logical clock
+func NewClock() *Clock {
+	return &Clock{}
+}
+
+//Now returns a timestamp for a local event or a sent message
+func (c *Clock) Now() Timestamp {
+	pt := time.Now().UnixNano()
+	if c == nil {
+		return Timestamp{Wall: pt}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if pt > c.last.Wall {
+		c.last = Timestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+//Update moves the clock past a timestamp from a received message.
+//Returns an error and leaves the clock unchanged if the timestamp is too far ahead.
+func (c *Clock) Update(remote Timestamp) (Timestamp, error) {
+	pt := time.Now().UnixNano()
+	if time.Duration(remote.Wall-pt) > MaxClockOffset {
+		return c.Now(), fmt.Errorf("remote clock %s is more than %s ahead", remote, MaxClockOffset)
+	}
+	if c == nil {
+		return Timestamp{Wall: pt}, nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last = Timestamp{Wall: pt}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	return c.last, nil
+}
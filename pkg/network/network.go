@@ -2,9 +2,9 @@ package network
 
 import (
 	"fmt"
-	"log"
 	"net"
 
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
 	"github.com/TTK4145/Network-go/network/conn"
 )
 
@@ -12,17 +12,37 @@ import (
 type Config struct {
 	//ID is the unique id of this node
 	ID int
-	//Port is the UDP port number to use for communication
+	//Port is the UDP port number to use for communication if no transport is set
 	Port int
+	//Transport is the shared socket used by all topics. Optional.
+	Transport *Transport
+	//Topic is the name of the topic. Must be unique for each module using the same transport.
+	Topic string
+	//Logger is used to log network events
+	Logger *logging.Logger
+	//Clock is the hybrid logical clock of the node. All messages are stamped with the clock,
+	//and the clock is updated with the timestamps of received messages. The clock of the
+	//transport is used for broadcasts if a transport is set. Optional.
+	Clock *Clock
+	//Codec is used to encode sent messages. JSON is used if not set.
+	//Received messages are decoded with the codec in their header.
+	Codec Codec
+	//Key is the shared cluster key used to sign broadcast and unicast messages with HMAC-SHA256.
+	//Messages are not signed or verified if empty.
+	Key []byte
+	//Addresses records the address of every node a message is received from. Optional.
+	Addresses *AddressBook
 }
 
 //createConn creates an UDP broadcast connection and finds the connection address
 func createConn(port int) (net.PacketConn, *net.UDPAddr, error) {
-	conn := conn.DialBroadcastUDP(port)
 	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", port))
 	if err != nil {
-		log.Panicf("Can't connect to net %s", err)
 		return nil, nil, err
 	}
+	conn := conn.DialBroadcastUDP(port)
+	if conn == nil {
+		return nil, nil, fmt.Errorf("failed to create broadcast socket on port %d", port)
+	}
 	return conn, addr, nil
 }
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//Transport shares one UDP broadcast socket between all topics.
+//Every message has the name of its topic in the envelope, and is delivered to the module
+//subscribed to the topic. Subscriptions are kept if the transport is restarted.
+//Messages are signed with the key in the configuration if set, and messages without a valid
+//signature or with a replayed sequence number are dropped.
+//Messages are sent with the negotiated protocol version, and messages with an unsupported
+//version are dropped unless the topic accepts all versions.
+//Messages are delivered to each topic in the order they are received.
+type Transport struct {
+	conf     Config
+	outgoing chan broadcastMsg
+	auth     *authenticator
+	//version, incompatible and overflowed are accessed atomically
+	version      uint32
+	incompatible uint64
+	overflowed   uint64
+
+	mtx    sync.Mutex
+	topics map[string]*subscription
+}
+
+//subscription receives the messages of a topic until it is cancelled.
+//Messages are queued in order, and dropped if the queue is full.
+type subscription struct {
+	topic    string
+	messages chan broadcastMsg
+	//anyVersion is set if messages with unsupported protocol versions are delivered
+	anyVersion bool
+}
+
+//dropLogInterval is the time between logs of dropped messages
+const dropLogInterval = 10 * time.Second
+
+//subscriptionQueueSize is the number of received messages queued for a topic
+const subscriptionQueueSize = 64
+
+//NewTransport creates a transport using the port in the configuration
+func NewTransport(conf Config) *Transport {
+	return &Transport{
+		conf:     conf,
+		outgoing: make(chan broadcastMsg),
+		auth:     newAuthenticator(conf.Key),
+		version:  uint32(MinProtocolVersion),
+		topics:   make(map[string]*subscription),
+	}
+}
+
+//Run sends and receives messages for all topics until the context is done
+//Returns an error if the connection fails
+func (t *Transport) Run(ctx context.Context) error {
+	//Stop transmitter and receiver on exit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- broadcastTransmitter(ctx, t.conf, t.auth, t.outgoing)
+	}()
+	go func() {
+		errs <- broadcastReceiver(ctx, t.conf, t.auth, t.dispatch)
+	}()
+
+	//Dropped messages are summarized regularly instead of logged one by one
+	ticker := time.NewTicker(dropLogInterval)
+	defer ticker.Stop()
+	logged := t.Dropped()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case <-ticker.C:
+			dropped := t.Dropped()
+			if dropped != logged {
+				t.conf.Logger.Warnf("Dropped messages in the last %s: %d malformed, %d unauthenticated, %d replayed, %d incompatible, %d overflowed", dropLogInterval,
+					dropped.Malformed-logged.Malformed, dropped.Unauthenticated-logged.Unauthenticated, dropped.Replayed-logged.Replayed, dropped.Incompatible-logged.Incompatible,
+					dropped.Overflowed-logged.Overflowed)
+				logged = dropped
+			}
+		}
+	}
+}
+
+//Dropped returns the number of received messages dropped since the transport was created
+func (t *Transport) Dropped() DropCounts {
+	counts := t.auth.counts()
+	counts.Incompatible = atomic.LoadUint64(&t.incompatible)
+	counts.Overflowed = atomic.LoadUint64(&t.overflowed)
+	return counts
+}
+
+//Version returns the protocol version used to send messages.
+//The oldest supported version is used until a version is negotiated by the heartbeat module.
+func (t *Transport) Version() uint16 {
+	return uint16(atomic.LoadUint32(&t.version))
+}
+
+//setVersion sets the protocol version used to send messages. Returns true if it changed.
+func (t *Transport) setVersion(version uint16) bool {
+	return atomic.SwapUint32(&t.version, uint32(version)) != uint32(version)
+}
+
+//subscribe registers a topic, replacing any previous subscription to the topic
+func (t *Transport) subscribe(topic string, anyVersion bool) *subscription {
+	sub := &subscription{
+		topic:      topic,
+		messages:   make(chan broadcastMsg, subscriptionQueueSize),
+		anyVersion: anyVersion,
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.topics[topic] = sub
+	return sub
+}
+
+//unsubscribe removes a subscription if it has not been replaced
+func (t *Transport) unsubscribe(sub *subscription) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.topics[sub.topic] == sub {
+		delete(t.topics, sub.topic)
+	}
+}
+
+//publish sends a message on a topic when the transmitter is ready
+func (t *Transport) publish(ctx context.Context, topic string, data interface{}) {
+	select {
+	case t.outgoing <- broadcastMsg{Topic: topic, Version: t.Version(), Data: NewPayload(data)}:
+	case <-ctx.Done():
+	}
+}
+
+//dispatch queues a received message for the subscriber of its topic.
+//The message is dropped if the queue is full, so a slow topic does not block the receiver or the other topics.
+func (t *Transport) dispatch(msg broadcastMsg) {
+	t.mtx.Lock()
+	sub, ok := t.topics[msg.Topic]
+	t.mtx.Unlock()
+	if !ok {
+		t.conf.Logger.Debugf("Dropping message on unknown topic %q from %d", msg.Topic, msg.SenderID)
+		return
+	}
+	if !sub.anyVersion && !SupportedVersions.Contains(msg.Version) {
+		atomic.AddUint64(&t.incompatible, 1)
+		t.conf.Logger.Debugf("Dropping message on topic %q from %d with protocol version %d", msg.Topic, msg.SenderID, msg.Version)
+		return
+	}
+	select {
+	case sub.messages <- msg:
+	default:
+		atomic.AddUint64(&t.overflowed, 1)
+		t.conf.Logger.Debugf("Dropping message on topic %q from %d: queue is full", msg.Topic, msg.SenderID)
+	}
+}
@@ -0,0 +1,50 @@
+package network
+
+import "testing"
+
+func TestTransportDispatchOrdered(t *testing.T) {
+	transport := NewTransport(Config{})
+	sub := transport.subscribe("orders", false)
+	other := transport.subscribe("costs", false)
+	const sent = subscriptionQueueSize + 10
+	for i := 0; i < sent; i++ {
+		transport.dispatch(broadcastMsg{Topic: "orders", Version: ProtocolVersion, Sequence: uint64(i)})
+	}
+	//A full topic does not block the other topics
+	transport.dispatch(broadcastMsg{Topic: "costs", Version: ProtocolVersion})
+	if len(other.messages) != 1 {
+		t.Errorf("got %d messages on the other topic, want 1", len(other.messages))
+	}
+
+	for i := 0; i < subscriptionQueueSize; i++ {
+		if msg := <-sub.messages; msg.Sequence != uint64(i) {
+			t.Fatalf("got message %d at position %d", msg.Sequence, i)
+		}
+	}
+	if len(sub.messages) != 0 {
+		t.Errorf("got %d messages after the queue was full", len(sub.messages))
+	}
+	if dropped := transport.Dropped(); dropped.Overflowed != sent-subscriptionQueueSize {
+		t.Errorf("got %d overflowed messages, want %d", dropped.Overflowed, sent-subscriptionQueueSize)
+	}
+}
+
+func TestTransportDispatchDropped(t *testing.T) {
+	transport := NewTransport(Config{})
+	sub := transport.subscribe("orders", false)
+	transport.dispatch(broadcastMsg{Topic: "unknown", Version: ProtocolVersion})
+	transport.dispatch(broadcastMsg{Topic: "orders", Version: ProtocolVersion + 1})
+	if len(sub.messages) != 0 {
+		t.Errorf("got %d messages, want none", len(sub.messages))
+	}
+	if dropped := transport.Dropped(); dropped.Incompatible != 1 || dropped.Overflowed != 0 {
+		t.Errorf("got drop counts %+v", dropped)
+	}
+
+	//Messages are not delivered after unsubscribing
+	transport.unsubscribe(sub)
+	transport.dispatch(broadcastMsg{Topic: "orders", Version: ProtocolVersion})
+	if len(sub.messages) != 0 {
+		t.Errorf("got %d messages after unsubscribing", len(sub.messages))
+	}
+}
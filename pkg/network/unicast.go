@@ -0,0 +1,372 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+	"github.com/rs/xid"
+)
+
+//Used if no timeout or resend interval is configured
+const defaultRequestTimeout = time.Second
+const defaultRequestResendInterval = 100 * time.Millisecond
+
+//responseCacheDuration is how long responses are kept to answer resent requests
+const responseCacheDuration = 10 * time.Second
+
+//ErrRequestTimeout is returned if no response is received within the timeout
+var ErrRequestTimeout = errors.New("request timed out")
+
+//errUnicastClosed is returned if a message is sent while the service is not running
+var errUnicastClosed = errors.New("unicast socket is closed")
+
+//UnicastConfig contains configuration for the unicast service
+type UnicastConfig struct {
+	//Config.Port is the UDP port to listen on. A free port is used if 0.
+	//Config.Addresses is used to find the address of other nodes.
+	//Config.Key is used to sign requests and responses like broadcast messages.
+	Config
+	//Timeout is the default time to wait for a response
+	Timeout time.Duration
+	//ResendInterval is the time between resends of a request without a response
+	ResendInterval time.Duration
+}
+
+//Handler handles a request from another node and returns the response.
+//A handler may be called more than once for the same request if the response is lost,
+//unless the response is still cached.
+type Handler func(ctx context.Context, from int, request json.RawMessage) (interface{}, error)
+
+type unicastMsg struct {
+	Response      bool            `json:"response"`
+	SenderID      int             `json:"sender_id"`
+	CorrelationID string          `json:"correlation_id"`
+	Service       string          `json:"service"`
+	Clock         Timestamp       `json:"clock"`
+	Sequence      uint64          `json:"seq,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+}
+
+//waitingRequest is a request waiting for the response from its target
+type waitingRequest struct {
+	target    int
+	responses chan unicastMsg
+}
+
+//cachedResponse is a response, or nil while the handler is running
+type cachedResponse struct {
+	msg     *unicastMsg
+	created time.Time
+}
+
+//Unicast sends point-to-point requests to other nodes and waits for the responses.
+//Requests are sent to the address of the node in the address book, and resent until a
+//response is received or the request times out. Responses are matched to requests by a correlation id.
+//Messages are framed and signed like broadcast messages, and messages without a valid
+//signature or with a replayed sequence number are dropped.
+type Unicast struct {
+	conf UnicastConfig
+	//port is the port the service listens on, also when the socket is reopened
+	port int
+	auth *authenticator
+
+	mtx       sync.Mutex
+	conn      *net.UDPConn
+	handlers  map[string]Handler
+	waiting   map[string]waitingRequest
+	responses map[string]cachedResponse
+}
+
+//NewUnicast opens the unicast socket, so the port is known before the service runs.
+//The socket is closed when Run returns, and opened again on the same port when Run is restarted.
+//Returns an error if the port can not be opened.
+func NewUnicast(conf UnicastConfig) (*Unicast, error) {
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultRequestTimeout
+	}
+	if conf.ResendInterval <= 0 {
+		conf.ResendInterval = defaultRequestResendInterval
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: conf.Port})
+	if err != nil {
+		return nil, err
+	}
+	return &Unicast{
+		conf:      conf,
+		port:      conn.LocalAddr().(*net.UDPAddr).Port,
+		conn:      conn,
+		auth:      newAuthenticator(conf.Key),
+		handlers:  make(map[string]Handler),
+		waiting:   make(map[string]waitingRequest),
+		responses: make(map[string]cachedResponse),
+	}, nil
+}
+
+//Port returns the port the service listens on
+func (u *Unicast) Port() int {
+	return u.port
+}
+
+//open returns the socket, and opens it again if it has been closed
+func (u *Unicast) open() (*net.UDPConn, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.conn == nil {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: u.port})
+		if err != nil {
+			return nil, err
+		}
+		u.conn = conn
+	}
+	return u.conn, nil
+}
+
+//close closes the socket
+func (u *Unicast) close() {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+//Dropped returns the number of received messages dropped since the service was created
+func (u *Unicast) Dropped() DropCounts {
+	return u.auth.counts()
+}
+
+//Handle registers the handler of a service, replacing any previous handler
+func (u *Unicast) Handle(service string, handler Handler) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.handlers[service] = handler
+}
+
+//Request sends a request to a node and unmarshals the response into response.
+//Returns ErrUnknownNode if the address of the node is unknown, ErrRequestTimeout if no response
+//is received within the timeout, or the error returned by the handler on the other node.
+func (u *Unicast) Request(ctx context.Context, target int, service string, request interface{}, response interface{}) error {
+	addr, err := u.conf.Addresses.Lookup(target)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	msg := unicastMsg{
+		SenderID:      u.conf.ID,
+		CorrelationID: xid.New().String(),
+		Service:       service,
+		Data:          data,
+	}
+	logger := u.conf.Logger.With(logging.FieldMessageID, msg.CorrelationID)
+
+	//Register before sending to not miss the response
+	responses := make(chan unicastMsg, 1)
+	u.mtx.Lock()
+	u.waiting[msg.CorrelationID] = waitingRequest{target: target, responses: responses}
+	u.mtx.Unlock()
+	defer func() {
+		u.mtx.Lock()
+		delete(u.waiting, msg.CorrelationID)
+		u.mtx.Unlock()
+	}()
+
+	timeout := time.NewTimer(u.conf.Timeout)
+	defer timeout.Stop()
+	resend := time.NewTicker(u.conf.ResendInterval)
+	defer resend.Stop()
+	for {
+		if err := u.send(msg, addr); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			logger.Debugf("Request %s to %d timed out", service, target)
+			return ErrRequestTimeout
+		case <-resend.C:
+		case r := <-responses:
+			if r.Error != "" {
+				return fmt.Errorf("node %d: %s", target, r.Error)
+			}
+			return json.Unmarshal(r.Data, response)
+		}
+	}
+}
+
+//send stamps, signs and sends a message.
+//Every send has a new sequence number, also when a request or response is resent.
+func (u *Unicast) send(msg unicastMsg, addr *net.UDPAddr) error {
+	if u.conf.Clock != nil {
+		msg.Clock = u.conf.Clock.Now()
+	}
+	msg.Sequence = u.auth.nextSequence()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := u.auth.sign(append([]byte{frameMagic, JSONCodec.ID()}, data...))
+	u.mtx.Lock()
+	conn := u.conn
+	u.mtx.Unlock()
+	if conn == nil {
+		return errUnicastClosed
+	}
+	_, err = conn.WriteToUDP(frame, addr)
+	return err
+}
+
+//decodeUnicast verifies and decodes a received message.
+//Messages without a header are accepted from nodes which do not frame unicast messages, if no key is set.
+func (u *Unicast) decodeUnicast(data []byte) (unicastMsg, error) {
+	var msg unicastMsg
+	frame, err := u.auth.verify(data)
+	if err != nil {
+		atomic.AddUint64(&u.auth.unauthenticated, 1)
+		return msg, err
+	}
+	if len(frame) >= frameHeaderSize && (frame[0] == frameMagic || frame[0] == frameMagicSigned) {
+		frame = frame[frameHeaderSize:]
+	}
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		atomic.AddUint64(&u.auth.malformed, 1)
+		return msg, err
+	}
+	if !u.auth.fresh(msg.SenderID, msg.Sequence) {
+		atomic.AddUint64(&u.auth.replayed, 1)
+		return msg, fmt.Errorf("replayed message %d from %d", msg.Sequence, msg.SenderID)
+	}
+	return msg, nil
+}
+
+//Run receives requests and responses until the context is done.
+//The socket is opened again if it was closed when Run last returned.
+//Returns an error if the connection fails
+func (u *Unicast) Run(ctx context.Context) error {
+	conn, err := u.open()
+	if err != nil {
+		return err
+	}
+	//Close connection on exit
+	defer u.close()
+
+	var buf [maxDatagramSize]byte
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		u.pruneResponses()
+
+		//Use a deadline to check the context regularly
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+		n, from, err := conn.ReadFromUDP(buf[0:])
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		//Dropped messages are logged at debug level, since anyone on the network can send them
+		msg, err := u.decodeUnicast(buf[0:n])
+		if err != nil {
+			u.conf.Logger.Debugf("Dropping unicast message from %s: %s", from, err)
+			continue
+		}
+		if u.conf.Clock != nil && !msg.Clock.IsZero() {
+			if _, err := u.conf.Clock.Update(msg.Clock); err != nil {
+				u.conf.Logger.Debugf("Ignoring clock from node %d: %s", msg.SenderID, err)
+			}
+		}
+
+		if msg.Response {
+			u.mtx.Lock()
+			waiting, ok := u.waiting[msg.CorrelationID]
+			u.mtx.Unlock()
+			if ok && waiting.target != msg.SenderID {
+				u.conf.Logger.Debugf("Dropping response to a request to %d from %d", waiting.target, msg.SenderID)
+				continue
+			}
+			if ok {
+				//Only the first response is used
+				select {
+				case waiting.responses <- msg:
+				default:
+				}
+			}
+			continue
+		}
+		u.handleRequest(ctx, msg, from)
+	}
+}
+
+//handleRequest runs the handler of a request, or answers with the cached response if the request is resent
+func (u *Unicast) handleRequest(ctx context.Context, msg unicastMsg, from *net.UDPAddr) {
+	u.mtx.Lock()
+	cached, seen := u.responses[msg.CorrelationID]
+	handler, ok := u.handlers[msg.Service]
+	if !seen {
+		u.responses[msg.CorrelationID] = cachedResponse{created: time.Now()}
+	}
+	u.mtx.Unlock()
+
+	if seen {
+		//Still running if there is no response
+		if cached.msg != nil {
+			u.send(*cached.msg, from)
+		}
+		return
+	}
+
+	//Handlers may block, so they run in their own goroutine
+	go func() {
+		response := unicastMsg{
+			Response:      true,
+			SenderID:      u.conf.ID,
+			CorrelationID: msg.CorrelationID,
+			Service:       msg.Service,
+		}
+		if !ok {
+			response.Error = fmt.Sprintf("unknown service %q", msg.Service)
+		} else if result, err := handler(ctx, msg.SenderID, msg.Data); err != nil {
+			response.Error = err.Error()
+		} else if response.Data, err = json.Marshal(result); err != nil {
+			response.Error = err.Error()
+		}
+
+		u.mtx.Lock()
+		u.responses[msg.CorrelationID] = cachedResponse{msg: &response, created: time.Now()}
+		u.mtx.Unlock()
+		if err := u.send(response, from); err != nil {
+			u.conf.Logger.With(logging.FieldMessageID, msg.CorrelationID).Warnf("Failed to send response to %d: %s", msg.SenderID, err)
+		}
+	}()
+}
+
+//pruneResponses removes old responses from the cache
+func (u *Unicast) pruneResponses() {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	for id, r := range u.responses {
+		if time.Since(r.created) > responseCacheDuration {
+			delete(u.responses, id)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//newTestUnicast creates a unicast service on a free port, answering echo requests with its id
+func newTestUnicast(t *testing.T, id int, addresses *AddressBook) *Unicast {
+	t.Helper()
+	u, err := NewUnicast(UnicastConfig{
+		Config:  Config{ID: id, Key: []byte("key"), Addresses: addresses},
+		Timeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Handle("echo", func(ctx context.Context, from int, request json.RawMessage) (interface{}, error) {
+		return id, nil
+	})
+	return u
+}
+
+//runUnicast runs the service until the returned function is called, which waits for Run to return
+func runUnicast(t *testing.T, u *Unicast) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- u.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run: %s", err)
+		}
+	}
+}
+
+func TestUnicastRestart(t *testing.T) {
+	addresses := NewAddressBook()
+	client := newTestUnicast(t, 1, addresses)
+	server := newTestUnicast(t, 2, addresses)
+	addresses.observeIP(2, net.IPv4(127, 0, 0, 1))
+	addresses.setPort(2, server.Port())
+	defer runUnicast(t, client)()
+
+	//The socket is closed when Run returns, and opened on the same port when restarted
+	port := server.Port()
+	runUnicast(t, server)()
+	stop := runUnicast(t, server)
+	defer stop()
+	if server.Port() != port {
+		t.Errorf("port changed from %d to %d", port, server.Port())
+	}
+	var id int
+	if err := client.Request(context.Background(), 2, "echo", nil, &id); err != nil {
+		t.Fatalf("request after restart: %s", err)
+	}
+	if id != 2 {
+		t.Errorf("got response from %d", id)
+	}
+}
+
+func TestUnicastResponseFromOtherNode(t *testing.T) {
+	addresses := NewAddressBook()
+	client := newTestUnicast(t, 1, addresses)
+	other := newTestUnicast(t, 3, addresses)
+	//The address of node 2 is now used by node 3
+	addresses.observeIP(2, net.IPv4(127, 0, 0, 1))
+	addresses.setPort(2, other.Port())
+	defer runUnicast(t, client)()
+	defer runUnicast(t, other)()
+
+	var id int
+	if err := client.Request(context.Background(), 2, "echo", nil, &id); err != ErrRequestTimeout {
+		t.Errorf("got error %v and response from %d, want %v", err, id, ErrRequestTimeout)
+	}
+}
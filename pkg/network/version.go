@@ -0,0 +1,54 @@
+package network
+
+import (
+	"fmt"
+)
+
+//ProtocolVersion is the newest protocol version supported by this build.
+//It must be increased when messages change in a way older builds can not read.
+const ProtocolVersion uint16 = 1
+
+//MinProtocolVersion is the oldest protocol version this build can read and send.
+//Builds supporting more than one version send the newest version supported by all online nodes,
+//so a cluster can be upgraded one node at a time.
+const MinProtocolVersion uint16 = 1
+
+//VersionRange is a range of supported protocol versions
+type VersionRange struct {
+	Min uint16 `json:"min"`
+	Max uint16 `json:"max"`
+}
+
+//SupportedVersions is the range of protocol versions supported by this build
+var SupportedVersions = VersionRange{Min: MinProtocolVersion, Max: ProtocolVersion}
+
+//Contains returns true if the version is in the range
+func (r VersionRange) Contains(version uint16) bool {
+	return version >= r.Min && version <= r.Max && version > 0
+}
+
+//Compatible returns true if the ranges have a version in common
+func (r VersionRange) Compatible(other VersionRange) bool {
+	return r.Min <= other.Max && other.Min <= r.Max && r.Max > 0 && other.Max > 0
+}
+
+func (r VersionRange) String() string {
+	if r.Max == 0 {
+		return "unknown"
+	}
+	if r.Min == r.Max {
+		return fmt.Sprintf("%d", r.Max)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+//negotiateVersion returns the newest version supported by this build and all the compatible ranges
+func negotiateVersion(ranges []VersionRange) uint16 {
+	version := SupportedVersions.Max
+	for _, r := range ranges {
+		if SupportedVersions.Compatible(r) && r.Max < version {
+			version = r.Max
+		}
+	}
+	return version
+}
@@ -0,0 +1,323 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+//Commands used by the elevator server protocol. Every message is four bytes.
+const (
+	cmdMotorDirection byte = iota + 1
+	cmdButtonLamp
+	cmdFloorIndicator
+	cmdDoorLamp
+	cmdStopLamp
+	cmdGetButton
+	cmdGetFloor
+	cmdGetStop
+	cmdGetObstruction
+)
+
+//Commands used by the destination dispatch keypads, the load weighing and the card reader, not supported by the elevator server.
+//The driver polls them on a separate connection.
+const (
+	//cmdGetKeypad returns the oldest destination call as {cmd, valid, origin, destination}
+	cmdGetKeypad byte = iota + 10
+	//cmdKeypadDisplay shows a car on the keypad at a floor as {cmd, floor, car high byte, car low byte}
+	cmdKeypadDisplay
+	//cmdGetLoad returns the load of the car in percent of the capacity as {cmd, load, 0, 0}
+	cmdGetLoad
+	//cmdGetCard returns the oldest card presented at the card reader of the car as {cmd, valid, card high byte, card low byte}
+	cmdGetCard
+)
+
+//NoCar is shown on a keypad before any car is assigned
+const NoCar = -1
+
+//ButtonType is the type of a button, using the same values as the elevator server
+type ButtonType int
+
+const (
+	//HallUp is the hall button upwards
+	HallUp ButtonType = iota
+	//HallDown is the hall button downwards
+	HallDown
+	//Cab is the cab button
+	Cab
+	numButtonTypes
+)
+
+//buttonHoldTime is how long a simulated button press is held.
+//Must be longer than the poll rate of the driver.
+const buttonHoldTime = 100 * time.Millisecond
+
+//atFloorTolerance is the distance from a floor where the floor sensor is active
+const atFloorTolerance = 0.05
+
+//Config contains configuration for the simulator
+type Config struct {
+	//Address to listen for the elevator driver on, e.g. localhost:15657
+	Address   string
+	NumFloors int
+	//TravelTime is the time used to travel between two floors
+	TravelTime time.Duration
+	Logger     *logging.Logger
+}
+
+//Status contains the observable state of the simulated elevator
+type Status struct {
+	Position       float64
+	MotorDirection int
+	DoorOpen       bool
+	StopLamp       bool
+	FloorIndicator int
+	//Lamps is indexed by floor and button type
+	Lamps [][numButtonTypes]bool
+	//Keypads is the car shown on the destination dispatch keypad at each floor, or NoCar
+	Keypads []int
+	//Load is the load of the car in percent of the capacity
+	Load int
+}
+
+//keypadCall is a destination entered at a keypad
+type keypadCall struct {
+	origin      int
+	destination int
+}
+
+//Simulator simulates an elevator and serves the elevator server protocol over TCP
+type Simulator struct {
+	conf    Config
+	mtx     sync.Mutex
+	status  Status
+	pressed [][numButtonTypes]time.Time
+	//calls are the destination calls not yet read by the driver
+	calls []keypadCall
+	//cards are the cards presented at the card reader not yet read by the driver
+	cards []int
+}
+
+//New creates a simulator with the elevator at the bottom floor
+func New(conf Config) *Simulator {
+	if conf.TravelTime <= 0 {
+		conf.TravelTime = 2 * time.Second
+	}
+	keypads := make([]int, conf.NumFloors)
+	for i := range keypads {
+		keypads[i] = NoCar
+	}
+	return &Simulator{
+		conf: conf,
+		status: Status{
+			Lamps:   make([][numButtonTypes]bool, conf.NumFloors),
+			Keypads: keypads,
+		},
+		pressed: make([][numButtonTypes]time.Time, conf.NumFloors),
+	}
+}
+
+//PressButton simulates a button press
+func (s *Simulator) PressButton(floor int, button ButtonType) error {
+	if floor < 0 || floor >= s.conf.NumFloors || button < 0 || button >= numButtonTypes {
+		return fmt.Errorf("invalid button %d at floor %d", button, floor)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pressed[floor][button] = time.Now().Add(buttonHoldTime)
+	return nil
+}
+
+//EnterDestination simulates a passenger entering a destination at the keypad of a floor
+func (s *Simulator) EnterDestination(origin int, destination int) error {
+	if origin < 0 || origin >= s.conf.NumFloors || destination < 0 || destination >= s.conf.NumFloors || origin == destination {
+		return fmt.Errorf("invalid destination call from floor %d to %d", origin, destination)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.calls = append(s.calls, keypadCall{origin: origin, destination: destination})
+	return nil
+}
+
+//SetLoad simulates the load of the car in percent of the capacity
+func (s *Simulator) SetLoad(load int) error {
+	if load < 0 || load > math.MaxUint8 {
+		return fmt.Errorf("invalid load %d%%", load)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status.Load = load
+	return nil
+}
+
+//PresentCard simulates a card presented at the card reader of the car
+func (s *Simulator) PresentCard(card int) error {
+	if card < 0 || card > math.MaxUint16 {
+		return fmt.Errorf("invalid card %d", card)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.cards = append(s.cards, card)
+	return nil
+}
+
+//Status returns a copy of the current state of the simulated elevator
+func (s *Simulator) Status() Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	status := s.status
+	status.Lamps = append(make([][numButtonTypes]bool, 0, len(s.status.Lamps)), s.status.Lamps...)
+	status.Keypads = append(make([]int, 0, len(s.status.Keypads)), s.status.Keypads...)
+	return status
+}
+
+//Run starts the simulation and serves driver connections until the context is done.
+//Returns an error if the listener fails.
+func (s *Simulator) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.conf.Address)
+	if err != nil {
+		return err
+	}
+	//Close the listener to stop Accept when the context is done
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go s.runPhysics(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.conf.Logger.Infof("Driver connected from %s", conn.RemoteAddr())
+		go s.serve(ctx, conn)
+	}
+}
+
+//runPhysics moves the elevator according to the motor direction
+func (s *Simulator) runPhysics(ctx context.Context) {
+	const step = 10 * time.Millisecond
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mtx.Lock()
+			delta := float64(s.status.MotorDirection) * float64(step) / float64(s.conf.TravelTime)
+			s.status.Position = math.Max(0, math.Min(float64(s.conf.NumFloors-1), s.status.Position+delta))
+			s.mtx.Unlock()
+		}
+	}
+}
+
+//serve handles a single driver connection
+func (s *Simulator) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				s.conf.Logger.Warnf("Driver connection failed: %s", err)
+			}
+			return
+		}
+		reply, err := s.handle(buf)
+		if err != nil {
+			s.conf.Logger.Warnf("Invalid message %v: %s", buf, err)
+			continue
+		}
+		if reply != nil {
+			if _, err := conn.Write(reply); err != nil {
+				s.conf.Logger.Warnf("Failed to reply to driver: %s", err)
+				return
+			}
+		}
+	}
+}
+
+//handle executes a single message and returns the reply, if any
+func (s *Simulator) handle(msg [4]byte) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch msg[0] {
+	case cmdMotorDirection:
+		s.status.MotorDirection = int(int8(msg[1]))
+	case cmdButtonLamp:
+		floor, button := int(msg[2]), ButtonType(msg[1])
+		if floor >= s.conf.NumFloors || button >= numButtonTypes {
+			return nil, errors.New("lamp out of range")
+		}
+		s.status.Lamps[floor][button] = msg[3] != 0
+	case cmdFloorIndicator:
+		s.status.FloorIndicator = int(msg[1])
+	case cmdDoorLamp:
+		s.status.DoorOpen = msg[1] != 0
+	case cmdStopLamp:
+		s.status.StopLamp = msg[1] != 0
+	case cmdGetButton:
+		floor, button := int(msg[2]), ButtonType(msg[1])
+		if floor >= s.conf.NumFloors || button >= numButtonTypes {
+			return []byte{cmdGetButton, 0, 0, 0}, nil
+		}
+		return []byte{cmdGetButton, toByte(time.Now().Before(s.pressed[floor][button])), 0, 0}, nil
+	case cmdGetFloor:
+		floor := math.Round(s.status.Position)
+		if math.Abs(s.status.Position-floor) < atFloorTolerance {
+			return []byte{cmdGetFloor, 1, byte(floor), 0}, nil
+		}
+		return []byte{cmdGetFloor, 0, 0, 0}, nil
+	case cmdGetStop, cmdGetObstruction:
+		return []byte{msg[0], 0, 0, 0}, nil
+	case cmdGetKeypad:
+		if len(s.calls) == 0 {
+			return []byte{cmdGetKeypad, 0, 0, 0}, nil
+		}
+		call := s.calls[0]
+		s.calls = s.calls[1:]
+		return []byte{cmdGetKeypad, 1, byte(call.origin), byte(call.destination)}, nil
+	case cmdKeypadDisplay:
+		floor := int(msg[1])
+		if floor >= s.conf.NumFloors {
+			return nil, errors.New("keypad out of range")
+		}
+		s.status.Keypads[floor] = int(int16(uint16(msg[2])<<8 | uint16(msg[3])))
+	case cmdGetLoad:
+		return []byte{cmdGetLoad, byte(s.status.Load), 0, 0}, nil
+	case cmdGetCard:
+		if len(s.cards) == 0 {
+			return []byte{cmdGetCard, 0, 0, 0}, nil
+		}
+		card := s.cards[0]
+		s.cards = s.cards[1:]
+		return []byte{cmdGetCard, 1, byte(card >> 8), byte(card)}, nil
+	default:
+		return nil, fmt.Errorf("unknown command %d", msg[0])
+	}
+	return nil, nil
+}
+
+func toByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
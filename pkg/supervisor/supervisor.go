@@ -0,0 +1,73 @@
+package supervisor
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/pkg/logging"
+)
+
+//Service is a long running module. It should only return when the context
+//is done or when it fails and has to be restarted.
+type Service func(ctx context.Context) error
+
+//Config contains configuration for the supervisor
+type Config struct {
+	//MinBackoff is the delay before the first restart
+	MinBackoff time.Duration
+	//MaxBackoff is the maximum delay between restarts
+	MaxBackoff time.Duration
+	Logger     *logging.Logger
+}
+
+//DefaultConfig returns a configuration suitable for most services
+func DefaultConfig(logger *logging.Logger) Config {
+	return Config{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		Logger:     logger,
+	}
+}
+
+//Run runs the service until the context is done.
+//If the service returns before the context is done, it is restarted with exponential backoff.
+//The backoff is reset if the service ran longer than MaxBackoff before failing.
+//Panics are not recovered since they are reserved for programmer errors.
+func Run(ctx context.Context, conf Config, name string, service Service) {
+	logger := conf.Logger.With("service", name)
+	backoff := conf.MinBackoff
+	for {
+		started := time.Now()
+		err := service(ctx)
+
+		//Normal shutdown
+		if ctx.Err() != nil {
+			logger.Debugf("Service stopped")
+			return
+		}
+
+		//Service ran long enough to be considered healthy
+		if time.Now().Sub(started) > conf.MaxBackoff {
+			backoff = conf.MinBackoff
+		}
+
+		if err != nil {
+			logger.Errorf("Service failed, restarting in %s: %s", backoff, err)
+		} else {
+			logger.Warnf("Service returned unexpectedly, restarting in %s", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		//Increase backoff for next failure
+		backoff *= 2
+		if backoff > conf.MaxBackoff {
+			backoff = conf.MaxBackoff
+		}
+	}
+}
@@ -18,15 +18,27 @@ func ReflectChan2InterfaceChan(ctx context.Context, r reflect.Value) (<-chan int
 	go func() {
 		done := false
 		defer close(c)
+		selectCases := []reflect.SelectCase{
+			reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(ctx.Done()),
+			},
+			reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: r,
+			},
+		}
 		for !done {
-			//Get next value from channel
-			if val, ok := r.Recv(); ok {
-				select {
-				case c <- val.Interface():
-				case <-ctx.Done():
-					done = true
-				}
-			} else {
+			//Get next value from channel - stop waiting if the context is done
+			//to avoid consuming values meant for a new reader
+			i, val, ok := reflect.Select(selectCases)
+			if i == 0 || !ok {
+				done = true
+				continue
+			}
+			select {
+			case c <- val.Interface():
+			case <-ctx.Done():
 				done = true
 			}
 		}
@@ -45,8 +57,15 @@ func RChan2RWChan(ctx context.Context, inChan <-chan interface{}) chan interface
 			case <-ctx.Done():
 				running = false
 			case m, ok := <-inChan:
-				outChan <- m
-				running = ok
+				if !ok {
+					running = false
+					continue
+				}
+				select {
+				case outChan <- m:
+				case <-ctx.Done():
+					running = false
+				}
 			}
 		}
 	}()
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/HaavardM/TTK4145-Elevator/internal/configuration"
+	"github.com/HaavardM/TTK4145-Elevator/internal/elevatorcontroller"
+	"github.com/HaavardM/TTK4145-Elevator/internal/scheduler"
+	"github.com/HaavardM/TTK4145-Elevator/pkg/network"
+)
+
+//Helpers extracting the runtime values of each module from the configuration
+func controllerRuntime(conf configuration.Config) elevatorcontroller.RuntimeConfig {
+	return elevatorcontroller.RuntimeConfig{
+		DoorOpenDuration:  conf.Controller.DoorOpenDuration.Duration,
+		MotorStallTimeout: conf.Controller.MotorStallTimeout.Duration,
+		BypassLoad:        conf.Controller.BypassLoad,
+		PassengerLoad:     conf.Controller.PassengerLoad,
+	}
+}
+
+func schedulerRuntime(conf configuration.Config) scheduler.RuntimeConfig {
+	return scheduler.RuntimeConfig{
+		OrderTimeout:      conf.Scheduler.OrderTimeout.Duration,
+		CabPenalty:        conf.Scheduler.CabPenalty,
+		CostFunction:      conf.Scheduler.CostFunction,
+		Parking:           conf.Scheduler.Parking,
+		LobbyFloor:        conf.Scheduler.LobbyFloor,
+		ParkingDelay:      conf.Scheduler.ParkingDelay.Duration,
+		TrafficMode:       conf.Scheduler.TrafficMode,
+		TrafficSchedule:   conf.Scheduler.SchedulerPeriods(),
+		ServedFloors:      conf.Scheduler.ServedFloors,
+		SecuredFloors:     conf.Scheduler.SchedulerSecuredFloors(),
+		AuthorizedCards:   conf.Scheduler.AuthorizedCards,
+		AccessWindow:      conf.Scheduler.AccessWindow.Duration,
+		NuisanceStops:     conf.Scheduler.NuisanceStops,
+		CallsPerPassenger: conf.Scheduler.CallsPerPassenger,
+	}
+}
+
+func heartbeatRuntime(conf configuration.Config) network.HeartbeatTiming {
+	return network.HeartbeatTiming{
+		Interval: conf.Network.HeartbeatInterval.Duration,
+		Timeout:  conf.Network.HeartbeatTimeout.Duration,
+	}
+}
+
+//runForwardReloads pushes reloaded configurations to the running modules.
+//The update channels must have a buffer of one, and only the latest update is kept.
+func runForwardReloads(ctx context.Context, store *configuration.Store, reloaded <-chan configuration.Config,
+	controller chan elevatorcontroller.RuntimeConfig, sched chan scheduler.RuntimeConfig, heartbeat chan network.HeartbeatTiming) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case conf := <-reloaded:
+			//Restarted modules use the stored configuration
+			store.Set(conf)
+
+			//Replace any update not yet received
+			select {
+			case <-controller:
+			default:
+			}
+			controller <- controllerRuntime(conf)
+			select {
+			case <-sched:
+			default:
+			}
+			sched <- schedulerRuntime(conf)
+			select {
+			case <-heartbeat:
+			default:
+			}
+			heartbeat <- heartbeatRuntime(conf)
+		}
+	}
+}